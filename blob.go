@@ -0,0 +1,248 @@
+package goque
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// blobDirName is the name of the directory under the data directory that
+// blob files are stored in.
+const blobDirName = "blobs"
+
+// blobExt is the extension of every blob file.
+const blobExt = ".blob"
+
+// blobStore stores the values of a keyspace above its threshold in
+// separate files, keeping only a reference to the file in the database.
+// The name of each file starts with the database key it was written for,
+// followed by a random suffix, so a new file never replaces one that is
+// still referred to. Files that values no longer refer to are kept while a
+// snapshot of the keyspace is open, as it may still read them. A nil
+// blobStore keeps every value in the database.
+type blobStore struct {
+	dir       string
+	prefix    string
+	threshold int
+
+	mu        sync.Mutex
+	snapshots int
+	retired   []string
+}
+
+// newBlobStore returns the blob store of the keyspace with the given key
+// prefix under the given data directory, or nil if blob files are not
+// enabled by the given options.
+func newBlobStore(dataDir string, prefix []byte, opts *Options) (*blobStore, error) {
+	if opts == nil || opts.BlobThreshold <= 0 {
+		return nil, nil
+	}
+	if dataDir == "" {
+		return nil, ErrNoDataDir
+	}
+
+	// Create the blob directory, syncing the data directory so it is not
+	// lost in a crash.
+	dir := filepath.Join(dataDir, blobDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := syncDir(dataDir); err != nil {
+		return nil, err
+	}
+
+	return &blobStore{
+		dir:       dir,
+		prefix:    hex.EncodeToString(prefix),
+		threshold: opts.BlobThreshold,
+	}, nil
+}
+
+// spills returns whether the given stored value is kept in a blob file.
+func (bs *blobStore) spills(data []byte) bool {
+	return bs != nil && len(data) > bs.threshold
+}
+
+// write writes the given stored value of the given database key to a new
+// blob file and returns the name of the file. The file and the blob
+// directory are synced whatever the durability of the write referring to
+// it, as a synced reference to a file lost in a crash would leave a
+// corrupt item, and the periodic sync only syncs the database.
+func (bs *blobStore) write(key, data []byte) (string, error) {
+	var suffix [8]byte
+	if _, err := io.ReadFull(rand.Reader, suffix[:]); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(key) + "-" + hex.EncodeToString(suffix[:]) + blobExt
+
+	f, err := os.OpenFile(filepath.Join(bs.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(bs.dir)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return name, nil
+}
+
+// syncDir syncs the given directory, so the files created in it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// read returns the stored value kept in the blob file with the given
+// name.
+func (bs *blobStore) read(name string) ([]byte, error) {
+	// Refuse names that would read a file outside of the blob directory.
+	if filepath.Base(name) != name || !strings.HasSuffix(name, blobExt) {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.ReadFile(filepath.Join(bs.dir, name))
+}
+
+// remove deletes the blob files with the given names. Files that cannot
+// be deleted are left as orphans for Verify to find.
+func (bs *blobStore) remove(names []string) {
+	for _, name := range names {
+		os.Remove(filepath.Join(bs.dir, name))
+	}
+}
+
+// retire deletes the blob files with the given names once no value refers
+// to them, or keeps them until every open snapshot is released.
+func (bs *blobStore) retire(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	bs.mu.Lock()
+	if bs.snapshots > 0 {
+		bs.retired = append(bs.retired, names...)
+		bs.mu.Unlock()
+		return
+	}
+	bs.mu.Unlock()
+
+	bs.remove(names)
+}
+
+// hold keeps retired blob files until release is called, for a snapshot
+// that may read them.
+func (bs *blobStore) hold() {
+	if bs == nil {
+		return
+	}
+
+	bs.mu.Lock()
+	bs.snapshots++
+	bs.mu.Unlock()
+}
+
+// release undoes a call to hold, deleting the retired blob files once no
+// snapshot is left.
+func (bs *blobStore) release() {
+	if bs == nil {
+		return
+	}
+
+	bs.mu.Lock()
+	bs.snapshots--
+	var names []string
+	if bs.snapshots == 0 {
+		names, bs.retired = bs.retired, nil
+	}
+	bs.mu.Unlock()
+
+	bs.remove(names)
+}
+
+// kept returns the names of the retired blob files kept for open
+// snapshots.
+func (bs *blobStore) kept() []string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return append([]string{}, bs.retired...)
+}
+
+// list returns the names of every blob file of the keyspace.
+func (bs *blobStore) list() ([]string, error) {
+	files, err := ioutil.ReadDir(bs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), bs.prefix) && strings.HasSuffix(f.Name(), blobExt) {
+			names = append(names, f.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// dropBlobs deletes the blob files of the keyspace with the given key
+// prefix under the given data directory.
+func dropBlobs(dataDir string, prefix []byte) error {
+	bs := &blobStore{
+		dir:    filepath.Join(dataDir, blobDirName),
+		prefix: hex.EncodeToString(prefix),
+	}
+
+	names, err := bs.list()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bs.remove(names)
+
+	return nil
+}
+
+// blobRef returns the reference to the blob file with the given name that
+// is stored in its place.
+func blobRef(name string) []byte {
+	return append(valueHeader(valueBlob), name...)
+}
+
+// blobName returns the name of the blob file the given stored value
+// refers to, and false if it is not a reference.
+func blobName(data []byte) (string, bool) {
+	if format, ok := valueFormat(data); !ok || format != valueBlob {
+		return "", false
+	}
+
+	return string(data[len(valueMagic)+1:]), true
+}
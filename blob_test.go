@@ -0,0 +1,407 @@
+package goque
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countBlobs returns the number of blob files under the given data
+// directory.
+func countBlobs(t *testing.T, dataDir string) int {
+	files, err := ioutil.ReadDir(filepath.Join(dataDir, blobDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(files)
+}
+
+func TestQueueBlobs(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(strings.Repeat(fmt.Sprintf("value for item %d ", i), 100)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err = q.EnqueueString("value for item 4"); err != nil {
+		t.Error(err)
+	}
+
+	if count := countBlobs(t, file); count != 3 {
+		t.Errorf("Expected 3 blob files, got %d", count)
+	}
+
+	data, err := q.db.db.Get(idToKey(1))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, ok := blobName(data); !ok {
+		t.Errorf("Expected a blob reference to be stored, got %d bytes", len(data))
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := strings.Repeat("value for item 1 ", 100)
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected value to be read from its blob file, got %d bytes", len(deqItem.Value))
+	}
+
+	if count := countBlobs(t, file); count != 2 {
+		t.Errorf("Expected 2 blob files after dequeue, got %d", count)
+	}
+
+	// Updating a value below the threshold removes its blob file.
+	if _, err = q.UpdateString(2, "value for item 2"); err != nil {
+		t.Error(err)
+	}
+
+	if count := countBlobs(t, file); count != 1 {
+		t.Errorf("Expected 1 blob file after update, got %d", count)
+	}
+
+	for i := 2; i <= 4; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+		if i == 3 {
+			compStr = strings.Repeat(compStr+" ", 100)
+		}
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+
+	if count := countBlobs(t, file); count != 0 {
+		t.Errorf("Expected no blob files, got %d", count)
+	}
+}
+
+func TestQueueBlobsVerify(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A blob file written before a crash prevented its item from being
+	// stored.
+	if _, err = q.db.blobs.write(idToKey(3), []byte(value)); err != nil {
+		t.Error(err)
+	}
+
+	paths, err := q.Verify()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(paths) != 1 || !strings.HasPrefix(filepath.Base(paths[0]), fmt.Sprintf("%x", idToKey(3))) {
+		t.Errorf("Expected the blob file of item 3 to be orphaned, got %v", paths)
+	}
+
+	if count := countBlobs(t, file); count != 2 {
+		t.Errorf("Expected 2 blob files, got %d", count)
+	}
+
+	for i := 1; i <= 2; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if deqItem.ToString() != value {
+			t.Errorf("Expected value to be read from its blob file, got %d bytes", len(deqItem.Value))
+		}
+	}
+}
+
+func TestQueueBlobsMissing(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{
+		BlobThreshold: 1024,
+		Checksums:     true,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	names, err := q.db.blobs.list()
+	if err != nil {
+		t.Error(err)
+	}
+	q.db.blobs.remove(names[:1])
+
+	_, err = q.Dequeue()
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok || corruption.ID != 1 {
+		t.Fatalf("Expected to get corrupt error for item 1, got %v", err)
+	}
+
+	if err = q.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected value to be read from its blob file, got %d bytes", len(deqItem.Value))
+	}
+}
+
+func TestQueueBlobsReencrypt(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{
+		BlobThreshold:   1024,
+		Checksums:       true,
+		EncryptionKeys:  map[uint32][]byte{1: testKey1},
+		EncryptionKeyID: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithOptions(file, &Options{
+		BlobThreshold:   1024,
+		Checksums:       true,
+		EncryptionKeys:  map[uint32][]byte{1: testKey1, 2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	old, err := q.db.blobs.list()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Reencrypt(); err != nil {
+		t.Error(err)
+	}
+
+	// Every blob file is rewritten, and the old ones removed.
+	names, err := q.db.blobs.list()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(names) != 3 {
+		t.Errorf("Expected 3 blob files, got %d", len(names))
+	}
+	for _, name := range old {
+		for _, n := range names {
+			if n == name {
+				t.Errorf("Expected blob file %s to be removed", name)
+			}
+		}
+	}
+
+	if paths, err := q.Verify(); err != nil || len(paths) != 0 {
+		t.Errorf("Expected no orphaned blob files, got %v and %v", paths, err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected value to be decrypted, got %d bytes", len(deqItem.Value))
+	}
+}
+
+func TestQueueBlobsSnapshot(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	snap, err := q.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.Dequeue(); err != nil {
+		t.Error(err)
+	}
+
+	// The blob file of the dequeued item is kept for the snapshot.
+	if count := countBlobs(t, file); count != 2 {
+		t.Errorf("Expected 2 blob files while the snapshot is open, got %d", count)
+	}
+
+	if paths, err := q.Verify(); err != nil || len(paths) != 0 {
+		t.Errorf("Expected no orphaned blob files, got %v and %v", paths, err)
+	}
+
+	peekItem, err := snap.PeekByID(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != value {
+		t.Errorf("Expected value to be read from its blob file, got %d bytes", len(peekItem.Value))
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Error(err)
+	}
+
+	if count := countBlobs(t, file); count != 1 {
+		t.Errorf("Expected 1 blob file after release, got %d", count)
+	}
+}
+
+func TestQueueBlobsMagicValues(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	// Values that look like stored values with a header are kept as they
+	// are.
+	values := [][]byte{
+		blobRef("value for item 1" + blobExt),
+		append(valueHeader(valueRaw), "value for item 2"...),
+	}
+
+	for _, value := range values {
+		if _, err = q.Enqueue(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, value := range values {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !bytes.Equal(deqItem.Value, value) {
+			t.Errorf("Expected value to be '%x', got '%x'", value, deqItem.Value)
+		}
+	}
+}
+
+func TestStoreBlobsDrop(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	pq, err := st.OpenPrefixQueueWithOptions("prefix", &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	q, err := st.OpenQueueWithOptions("queue", &Options{BlobThreshold: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := bytes.Repeat([]byte("value for item "), 100)
+
+	for i := 1; i <= 2; i++ {
+		if _, err = pq.Enqueue([]byte("prefix"), value); err != nil {
+			t.Error(err)
+		}
+		if _, err = q.Enqueue(value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Each data structure only verifies its own blob files.
+	if paths, err := pq.Verify(); err != nil || len(paths) != 0 {
+		t.Errorf("Expected no orphaned blob files, got %v and %v", paths, err)
+	}
+
+	if err = st.Drop("prefix"); err != nil {
+		t.Error(err)
+	}
+
+	if count := countBlobs(t, file); count != 2 {
+		t.Errorf("Expected 2 blob files after drop, got %d", count)
+	}
+
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(peekItem.Value, value) {
+		t.Errorf("Expected value to be read from its blob file, got %d bytes", len(peekItem.Value))
+	}
+}
+
+func TestStackBlobsNoDataDir(t *testing.T) {
+	if _, err := OpenStackWithStorage(NewMemoryStorage(), &Options{BlobThreshold: 1024}); err != ErrNoDataDir {
+		t.Errorf("Expected to get no data directory error, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package goque
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// capacity tracks the total byte size of the item values of a data
+// structure, and of each group of items such as a priority level or
+// prefix, and enforces its optional item count and byte size limits. It
+// is not goroutine safe and relies on the lock of its owner.
+//
+// The sizes are saved in the same write as every change to them, so they
+// are only rebuilt from the stored items if they were never saved.
+type capacity struct {
+	db       *keyspace
+	key      []byte
+	maxItems uint64
+	maxBytes uint64
+	bytes    uint64
+	groups   map[string]uint64
+	freed    *notifier
+}
+
+// newCapacity creates the capacity limits for the given options, saving
+// the sizes under the given internal key prefix.
+func newCapacity(db *keyspace, prefix []byte, opts *Options) *capacity {
+	c := &capacity{
+		db:     db,
+		key:    append(append([]byte{}, prefix...), []byte("bytes")...),
+		groups: make(map[string]uint64),
+		freed:  newNotifier(),
+	}
+	if opts != nil {
+		c.maxItems = opts.MaxItems
+		c.maxBytes = opts.MaxBytes
+	}
+
+	return c
+}
+
+// bounded returns whether any limit is set.
+func (c *capacity) bounded() bool {
+	return c.maxItems > 0 || c.maxBytes > 0
+}
+
+// fits returns whether n items holding the given number of bytes can be
+// added to a data structure currently holding length items.
+func (c *capacity) fits(length, n, size uint64) bool {
+	return c.fitsAfterRemoving(length, n, size, 0, 0)
+}
+
+// fitsAfterRemoving returns whether n items holding the given number of
+// bytes can be added to a data structure currently holding length items,
+// once count of its items holding freed bytes have been removed.
+func (c *capacity) fitsAfterRemoving(length, n, size, count, freed uint64) bool {
+	if c.maxItems > 0 && length-count+n > c.maxItems {
+		return false
+	}
+	if c.maxBytes > 0 && c.bytes-freed+size > c.maxBytes {
+		return false
+	}
+
+	return true
+}
+
+// fitsWhenEmpty returns whether n items holding the given number of bytes
+// can be added to an empty data structure.
+func (c *capacity) fitsWhenEmpty(n, size uint64) bool {
+	return (c.maxItems == 0 || n <= c.maxItems) && (c.maxBytes == 0 || size <= c.maxBytes)
+}
+
+// added records that items holding the given number of bytes were added
+// to the given group. A nil group is only counted in the total.
+func (c *capacity) added(group []byte, size uint64) {
+	c.bytes += size
+	if group != nil {
+		c.groups[string(group)] += size
+	}
+}
+
+// removed records that items holding the given number of bytes were
+// removed from the given group, waking any producers waiting for space.
+func (c *capacity) removed(group []byte, size uint64) {
+	c.bytes = shrink(c.bytes, size)
+
+	if group != nil {
+		if left := shrink(c.groups[string(group)], size); left > 0 {
+			c.groups[string(group)] = left
+		} else {
+			delete(c.groups, string(group))
+		}
+	}
+
+	if c.bounded() {
+		c.freed.broadcast()
+	}
+}
+
+// size returns the total byte size of the items in the given group.
+func (c *capacity) size(group []byte) uint64 {
+	return c.groups[string(group)]
+}
+
+// wait returns a channel that is closed the next time space is freed.
+func (c *capacity) wait() <-chan struct{} {
+	return c.freed.wait()
+}
+
+// batch adds the sizes once items holding added bytes have been added to
+// the given group, and items holding removed bytes removed from it, to
+// the given batch. A nil group is only counted in the total. The tracked
+// sizes are updated by calling added and removed once the batch has been
+// written.
+func (c *capacity) batch(batch *leveldb.Batch, group []byte, added, removed uint64) {
+	c.batchTotal(batch, added, removed)
+	if group != nil {
+		c.batchGroup(batch, group, added, removed)
+	}
+}
+
+// batchTotal adds the total size once items holding added bytes have been
+// added and items holding removed bytes removed to the given batch.
+func (c *capacity) batchTotal(batch *leveldb.Batch, added, removed uint64) {
+	batch.Put(c.key, idToKey(shrink(c.bytes+added, removed)))
+}
+
+// batchGroup adds the size of the given group once items holding added
+// bytes have been added to it and items holding removed bytes removed
+// from it to the given batch. The record of an empty group is deleted.
+func (c *capacity) batchGroup(batch *leveldb.Batch, group []byte, added, removed uint64) {
+	if size := shrink(c.groups[string(group)]+added, removed); size > 0 {
+		batch.Put(c.groupKey(group), idToKey(size))
+	} else {
+		batch.Delete(c.groupKey(group))
+	}
+}
+
+// groupKey returns the key the size of the given group is saved under.
+func (c *capacity) groupKey(group []byte) []byte {
+	return append(append(append([]byte{}, c.key...), ':'), group...)
+}
+
+// load loads the sizes saved along with every write. If they were never
+// saved, such as by older versions, a saved size is corrupt or rebuild is
+// true, they are rebuilt from every value stored in the given range with
+// a key accepted by isItem, where the given function returns the group of
+// a key, or nil if items are not grouped, and saved again.
+func (c *capacity) load(r *util.Range, isItem func(key []byte) bool, group func(key []byte) []byte, rebuild bool) error {
+	if !rebuild {
+		ok, err := c.loadSaved()
+		if ok || err != nil {
+			return err
+		}
+		c.bytes = 0
+		c.groups = make(map[string]uint64)
+	}
+
+	iter := c.db.NewIterator(r, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		if isItem != nil && !isItem(key) {
+			continue
+		}
+
+		var g []byte
+		if group != nil {
+			g = group(key)
+		}
+		c.added(g, uint64(len(iter.Value())))
+	}
+
+	// Corrupt values are counted as empty, so the data structure can
+	// still be opened to quarantine them.
+	if err := iter.Error(); err != nil && !isCorrupt(err) {
+		return err
+	}
+
+	return c.save()
+}
+
+// loadSaved loads the saved sizes, returning false if they were never
+// saved or one of them is corrupt.
+func (c *capacity) loadSaved() (bool, error) {
+	rec, err := c.db.Get(c.key, nil)
+	if err == leveldb.ErrNotFound || isCorrupt(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if len(rec) != 8 {
+		return false, nil
+	}
+	c.bytes = keyToID(rec)
+
+	prefix := append(append([]byte{}, c.key...), ':')
+	iter := c.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		rec := iter.Value()
+		if len(rec) != 8 {
+			return false, nil
+		}
+		c.groups[string(iter.Key()[len(prefix):])] = keyToID(rec)
+	}
+	if err := iter.Error(); isCorrupt(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// save replaces the saved sizes with the tracked ones.
+func (c *capacity) save() error {
+	batch := new(leveldb.Batch)
+
+	iter := c.db.NewIterator(util.BytesPrefix(append(append([]byte{}, c.key...), ':')), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil && !isCorrupt(err) {
+		return err
+	}
+
+	c.batchTotal(batch, 0, 0)
+	for group := range c.groups {
+		c.batchGroup(batch, []byte(group), 0, 0)
+	}
+
+	return c.db.Write(batch, nil)
+}
+
+// reset clears the tracked sizes and wakes any producers waiting for
+// space.
+func (c *capacity) reset() {
+	c.bytes = 0
+	c.groups = make(map[string]uint64)
+	c.freed.broadcast()
+}
+
+// itemsSize returns the total size of the values of the given items.
+func itemsSize(items []*Item) uint64 {
+	var size uint64
+	for _, item := range items {
+		size += uint64(len(item.Value))
+	}
+
+	return size
+}
+
+// shrink returns the given size less the given number of bytes, or 0 if
+// it is not larger.
+func shrink(size, n uint64) uint64 {
+	if n < size {
+		return size - n
+	}
+
+	return 0
+}
+
+// valuesSize returns the total size of the given values.
+func valuesSize(values [][]byte) uint64 {
+	var size uint64
+	for _, value := range values {
+		size += uint64(len(value))
+	}
+
+	return size
+}
@@ -0,0 +1,44 @@
+package goque
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// crc32c is the CRC-32C table the checksums of values are computed with.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// addChecksum returns the given stored value with a header recording its
+// CRC-32C checksum.
+func addChecksum(data []byte) []byte {
+	rec := make([]byte, len(valueMagic)+5, len(valueMagic)+5+len(data))
+	copy(rec, valueHeader(valueChecksum))
+	binary.BigEndian.PutUint32(rec[len(valueMagic)+1:], crc32.Checksum(data, crc32c))
+	return append(rec, data...)
+}
+
+// verifyChecksum returns the stored value the given data holds after
+// verifying its checksum, and false if it does not match. Values written
+// without a checksum are returned as they are if unchecked is true, and
+// reported as not matching otherwise.
+func verifyChecksum(data []byte, unchecked bool) ([]byte, bool) {
+	if format, ok := valueFormat(data); !ok || format != valueChecksum {
+		return data, unchecked
+	}
+	if len(data) < len(valueMagic)+5 {
+		return nil, false
+	}
+
+	payload := data[len(valueMagic)+5:]
+	if crc32.Checksum(payload, crc32c) != binary.BigEndian.Uint32(data[len(valueMagic)+1:]) {
+		return nil, false
+	}
+
+	return payload, true
+}
+
+// isCorrupt returns whether the given error reports a corrupt value.
+func isCorrupt(err error) bool {
+	_, ok := err.(*ErrCorrupt)
+	return ok
+}
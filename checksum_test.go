@@ -0,0 +1,356 @@
+package goque
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// corruptValue flips the last byte of the value stored under the given
+// key.
+func corruptValue(t *testing.T, storage Storage, key []byte) {
+	data, err := storage.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append([]byte{}, data...)
+	data[len(data)-1] ^= 0xff
+	if err = storage.Put(key, data, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueChecksums(t *testing.T) {
+	storage := NewMemoryStorage()
+	q, err := OpenQueueWithStorage(storage, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	data, err := storage.Get(idToKey(1))
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.HasPrefix(data, valueHeader(valueChecksum)) {
+		t.Errorf("Expected value to be stored with a checksum, got '%x'", data)
+	}
+
+	corruptValue(t, storage, idToKey(1))
+
+	_, err = q.Peek()
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok || corruption.ID != 1 {
+		t.Fatalf("Expected to get corrupt error for item 1, got %v", err)
+	}
+
+	if _, err = q.Dequeue(); !isCorrupt(err) {
+		t.Errorf("Expected to get corrupt error, got %v", err)
+	}
+
+	// Only the item at the head of the queue can be quarantined.
+	if err = q.Quarantine(&ErrCorrupt{ID: 2, Key: idToKey(2)}); err != ErrOutOfBounds {
+		t.Errorf("Expected to get queue out of bounds error, got %v", err)
+	}
+
+	if err = q.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	if q.Length() != 9 {
+		t.Errorf("Expected queue length of 9, got %d", q.Length())
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 2"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	items, err := q.Quarantined()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 1 || items[0].ID != 1 {
+		t.Fatalf("Expected item 1 to be quarantined, got %d items", len(items))
+	}
+	if !bytes.HasPrefix(items[0].Value, valueHeader(valueChecksum)) {
+		t.Errorf("Expected quarantined item to hold its stored data, got '%x'", items[0].Value)
+	}
+
+	if err = q.PurgeQuarantined(); err != nil {
+		t.Error(err)
+	}
+
+	if items, err = q.Quarantined(); err != nil || len(items) != 0 {
+		t.Errorf("Expected no quarantined items, got %d items and %v", len(items), err)
+	}
+}
+
+func TestQueueChecksumsHeader(t *testing.T) {
+	storage := NewMemoryStorage()
+	q, err := OpenQueueWithStorage(storage, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Flip the first byte of the checksum header, so the value no longer
+	// appears to have one.
+	data, err := storage.Get(idToKey(1))
+	if err != nil {
+		t.Error(err)
+	}
+	data = append([]byte{}, data...)
+	data[0] ^= 0x01
+	if err = storage.Put(idToKey(1), data, false); err != nil {
+		t.Error(err)
+	}
+
+	_, err = q.Dequeue()
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok || corruption.ID != 1 {
+		t.Fatalf("Expected to get corrupt error for item 1, got %v", err)
+	}
+
+	if err = q.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 2"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestQueueChecksumsReopen(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	db, err := leveldb.OpenFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.Get(idToKey(1), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err = db.Put(idToKey(1), data, nil); err != nil {
+		t.Error(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// A corrupt item must not prevent the queue from being opened.
+	q, err = OpenQueueWithOptions(file, &Options{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Drop()
+
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
+	}
+
+	_, err = q.Dequeue()
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok {
+		t.Fatalf("Expected to get corrupt error, got %v", err)
+	}
+
+	if err = q.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	if q.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", q.Length())
+	}
+}
+
+func TestPriorityQueueChecksums(t *testing.T) {
+	storage := NewMemoryStorage()
+	pq, err := OpenPriorityQueueWithStorage(storage, ASC, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 2; p++ {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	corruptValue(t, storage, pq.generateKey(1, 1))
+
+	if _, err = pq.DequeueByPriority(0); err != nil {
+		t.Error(err)
+	}
+
+	_, err = pq.DequeueByPriority(1)
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok || corruption.ID != 1 {
+		t.Fatalf("Expected to get corrupt error for item 1, got %v", err)
+	}
+
+	if err = pq.Quarantine(&ErrCorrupt{ID: 2, Key: pq.generateKey(1, 2)}); err != ErrOutOfBounds {
+		t.Errorf("Expected to get queue out of bounds error, got %v", err)
+	}
+
+	if err = pq.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.DequeueByPriority(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.Priority != 1 || deqItem.ID != 2 {
+		t.Errorf("Expected item 2 of priority 1, got item %d of priority %d", deqItem.ID, deqItem.Priority)
+	}
+
+	if pq.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", pq.Length())
+	}
+}
+
+func TestPrefixQueueChecksums(t *testing.T) {
+	storage := NewMemoryStorage()
+	pq, err := OpenPrefixQueueWithStorage(storage, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	corruptValue(t, storage, generateKeyPrefixID([]byte("prefix"), 1))
+
+	_, err = pq.DequeueString("prefix")
+	corruption, ok := err.(*ErrCorrupt)
+	if !ok || corruption.ID != 1 {
+		t.Fatalf("Expected to get corrupt error for item 1, got %v", err)
+	}
+
+	if err = pq.Quarantine(corruption); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 2"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	if pq.Length() != 0 {
+		t.Errorf("Expected queue length of 0, got %d", pq.Length())
+	}
+}
+
+func TestStackChecksumsLegacyValues(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.PushString("value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Without allowing them, items stored without a checksum are corrupt.
+	s, err = OpenStackWithOptions(file, &Options{Checksums: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.Peek(); !isCorrupt(err) {
+		t.Errorf("Expected to get corrupt error, got %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	s, err = OpenStackWithOptions(file, &Options{Checksums: true, AllowUnchecksummed: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	if _, err = s.PushString("value for item 2"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 2; i >= 1; i-- {
+		popItem, err := s.Pop()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if popItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package goque
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+)
+
+// Codec encodes values into item values and decodes item values back,
+// letting data structures store any value type.
+type Codec interface {
+	// Encode encodes the given value.
+	Encode(value interface{}) ([]byte, error)
+
+	// Decode decodes the given data into the value pointed to by value.
+	Decode(data []byte, value interface{}) error
+}
+
+// The built-in codecs.
+var (
+	// GobCodec encodes values using encoding/gob. It is the default.
+	//
+	// Objects containing pointers with zero values will decode to nil
+	// when using this codec. This is due to how the encoding/gob package
+	// works. Because of this, you should only use it to encode simple
+	// types.
+	GobCodec Codec = gobCodec{}
+
+	// JSONCodec encodes values using encoding/json. Use it to handle
+	// encoding of complex types.
+	JSONCodec Codec = jsonCodec{}
+
+	// RawCodec stores byte slices and strings as they are. It decodes
+	// into a *[]byte or a *string.
+	RawCodec Codec = rawCodec{}
+)
+
+// errRawCodecType is returned when RawCodec is used with a value that is
+// not a byte slice or string.
+var errRawCodecType = errors.New("goque: Raw codec only supports byte slices and strings")
+
+// codecOf returns the codec of the given options, or GobCodec if none is
+// set.
+func codecOf(opts *Options) Codec {
+	if opts == nil || opts.Codec == nil {
+		return GobCodec
+	}
+
+	return opts.Codec
+}
+
+// gobCodec is the Codec using encoding/gob.
+type gobCodec struct{}
+
+// Encode encodes the given value using encoding/gob.
+func (gobCodec) Encode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Decode decodes the given data using encoding/gob.
+func (gobCodec) Decode(data []byte, value interface{}) error {
+	buffer := bytes.NewBuffer(data)
+	dec := gob.NewDecoder(buffer)
+	return dec.Decode(value)
+}
+
+// jsonCodec is the Codec using encoding/json.
+type jsonCodec struct{}
+
+// Encode encodes the given value using encoding/json.
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Decode decodes the given data using encoding/json.
+func (jsonCodec) Decode(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// rawCodec is the Codec storing byte slices and strings as they are.
+type rawCodec struct{}
+
+// Encode returns the given byte slice or string as bytes.
+func (rawCodec) Encode(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+
+	return nil, errRawCodecType
+}
+
+// Decode copies the given data into the byte slice or string pointed to
+// by value.
+func (rawCodec) Decode(data []byte, value interface{}) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = append([]byte{}, data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+
+	return errRawCodecType
+}
@@ -0,0 +1,179 @@
+package goque
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueueEnqueueValueJSON(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{Codec: JSONCodec})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	type subObject struct {
+		Value *int
+	}
+
+	type object struct {
+		Value     int
+		SubObject subObject
+	}
+
+	val := 0
+	obj := object{
+		Value: 0,
+		SubObject: subObject{
+			Value: &val,
+		},
+	}
+
+	item, err := q.EnqueueValue(obj)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var itemObj object
+	if err = q.DecodeValue(item, &itemObj); err != nil {
+		t.Error(err)
+	}
+
+	if itemObj.SubObject.Value == nil {
+		t.Fatal("Expected object subobject value to not be nil")
+	}
+
+	if *itemObj.SubObject.Value != 0 {
+		t.Errorf("Expected object subobject value to be '0', got '%d'", *itemObj.SubObject.Value)
+	}
+
+	if _, err = q.UpdateValue(item.ID, object{Value: 1}); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := `{"Value":1,"SubObject":{"Value":null}}`
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestStackPushValueGob(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	type object struct {
+		Value int
+	}
+
+	if _, err = s.PushValue(object{Value: 1}); err != nil {
+		t.Error(err)
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The default codec must match PushObject.
+	var itemObj object
+	if err = popItem.ToObject(&itemObj); err != nil {
+		t.Error(err)
+	}
+
+	if itemObj.Value != 1 {
+		t.Errorf("Expected object value to be '1', got '%d'", itemObj.Value)
+	}
+}
+
+func TestPriorityQueueEnqueueValueRaw(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueueWithOptions(file, ASC, &Options{Codec: RawCodec})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueValue(1, "value for priority 1"); err != nil {
+		t.Error(err)
+	}
+	if _, err = pq.EnqueueValue(0, []byte("value for priority 0")); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueValue(0, 1); err != errRawCodecType {
+		t.Errorf("Expected to get raw codec type error, got %v", err)
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var str string
+	if err = pq.DecodeValue(deqItem, &str); err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for priority 0"
+
+	if str != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, str)
+	}
+
+	deqItem, err = pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var value []byte
+	if err = pq.DecodeValue(deqItem, &value); err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for priority 1"
+
+	if string(value) != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, value)
+	}
+}
+
+func TestPrefixQueueEnqueueValueJSON(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueueWithOptions(file, &Options{Codec: JSONCodec})
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer pq.Close()
+
+	if _, err = pq.EnqueueValue([]byte("prefix"), map[string]int{"value": 1}); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var obj map[string]int
+	if err = pq.DecodeValue(deqItem, &obj); err != nil {
+		t.Error(err)
+	}
+
+	if obj["value"] != 1 {
+		t.Errorf("Expected object value to be '1', got '%d'", obj["value"])
+	}
+}
@@ -0,0 +1,110 @@
+package goque
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// compactor tracks the range of keys consumed from a data structure and
+// compacts it in the background once enough items have been removed, so
+// the deleted keys do not linger. It is not goroutine safe and relies on
+// the lock of its owner.
+type compactor struct {
+	db        *keyspace
+	threshold int
+	count     int
+	start     []byte
+	limit     []byte
+	ranges    chan *util.Range
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newCompactor creates the compactor for the given database and options,
+// compacting the consumed range each time CompactionThreshold items have
+// been removed.
+func newCompactor(db *keyspace, opts *Options) *compactor {
+	c := &compactor{db: db}
+
+	if opts != nil && opts.CompactionThreshold > 0 {
+		c.threshold = opts.CompactionThreshold
+		c.ranges = make(chan *util.Range, 1)
+		c.stop = make(chan struct{})
+		c.wg.Add(1)
+		go c.run(c.ranges, c.stop)
+	}
+
+	return c
+}
+
+// consumed records that the item with the given key was removed,
+// compacting the consumed range in the background once the threshold
+// is reached.
+func (c *compactor) consumed(key []byte) {
+	if c.stop == nil {
+		return
+	}
+
+	// Extend the consumed range.
+	if c.start == nil || bytes.Compare(key, c.start) < 0 {
+		c.start = append([]byte{}, key...)
+	}
+	if c.limit == nil || bytes.Compare(key, c.limit) > 0 {
+		c.limit = append([]byte{}, key...)
+	}
+
+	c.count++
+	if c.count < c.threshold {
+		return
+	}
+
+	// Hand the range to the background goroutine. If it is still busy
+	// with the previous range, keep extending this one.
+	r := &util.Range{Start: c.start, Limit: append(append([]byte{}, c.limit...), 0)}
+	select {
+	case c.ranges <- r:
+		c.start, c.limit, c.count = nil, nil, 0
+	default:
+	}
+}
+
+// run compacts each consumed range it is handed until the given channel
+// is closed.
+func (c *compactor) run(ranges <-chan *util.Range, stop <-chan struct{}) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case r := <-ranges:
+			c.db.CompactRange(*r)
+		}
+	}
+}
+
+// begin registers a manual compaction, which close waits for. The
+// returned function must be called once the compaction is done.
+func (c *compactor) begin() func() {
+	c.wg.Add(1)
+	return c.wg.Done
+}
+
+// compact compacts the whole database.
+func (c *compactor) compact() error {
+	return c.db.CompactRange(util.Range{})
+}
+
+// close stops compacting in the background and waits for any compaction
+// in progress to finish.
+func (c *compactor) close() {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.wg.Wait()
+
+	c.start, c.limit, c.count = nil, nil, 0
+}
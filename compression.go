@@ -0,0 +1,179 @@
+package goque
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCompressionThreshold is the size in bytes at or above which
+// values are compressed when no threshold is set.
+const defaultCompressionThreshold = 512
+
+// flateWriters and gzipWriters pool the compressors of values, which are
+// costly to allocate.
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+)
+
+// CompressionStats holds the statistics of the values written to a data
+// structure at or above its compression threshold.
+type CompressionStats struct {
+	Values      uint64 // The number of values.
+	RawBytes    uint64 // Their total size in bytes before compression.
+	StoredBytes uint64 // Their total size in bytes as stored.
+}
+
+// Ratio returns the stored size of the values divided by their size
+// before compression, or 1 if no values were written.
+func (cs CompressionStats) Ratio() float64 {
+	if cs.RawBytes == 0 {
+		return 1
+	}
+
+	return float64(cs.StoredBytes) / float64(cs.RawBytes)
+}
+
+// compressor compresses the values written to a keyspace and decompresses
+// the values read from it. Values below the threshold, or that do not
+// shrink, are stored as they are, so values written before compression
+// was enabled read back unchanged. A nil compressor leaves values as
+// they are.
+type compressor struct {
+	values      uint64
+	rawBytes    uint64
+	storedBytes uint64
+	format      byte
+	threshold   int
+}
+
+// newCompressor returns the compressor for the given options, or nil if
+// compression is not enabled.
+func newCompressor(opts *Options) *compressor {
+	if opts == nil || opts.Compression == CompressNone {
+		return nil
+	}
+
+	c := &compressor{
+		format:    valueFlate,
+		threshold: opts.CompressionThreshold,
+	}
+	if opts.Compression == CompressGzip {
+		c.format = valueGzip
+	}
+	if c.threshold <= 0 {
+		c.threshold = defaultCompressionThreshold
+	}
+
+	return c
+}
+
+// compress returns the given value as it is stored.
+func (c *compressor) compress(value []byte) []byte {
+	if c == nil {
+		return value
+	}
+
+	data := value
+	if len(value) >= c.threshold {
+		if cv, err := c.deflate(value); err == nil && len(cv) < len(value) {
+			data = cv
+		}
+	}
+
+	// Add a header to an uncompressed value that would otherwise be
+	// mistaken for one with a header.
+	if len(data) == len(value) {
+		data = escapeValue(value)
+	}
+
+	if len(value) >= c.threshold {
+		atomic.AddUint64(&c.values, 1)
+		atomic.AddUint64(&c.rawBytes, uint64(len(value)))
+		atomic.AddUint64(&c.storedBytes, uint64(len(data)))
+	}
+
+	return data
+}
+
+// deflate returns the given value compressed, with its header.
+func (c *compressor) deflate(value []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(valueHeader(c.format))
+
+	var w io.WriteCloser
+	switch c.format {
+	case valueGzip:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(gw)
+		gw.Reset(buffer)
+		w = gw
+	default:
+		fw := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(fw)
+		fw.Reset(buffer)
+		w = fw
+	}
+
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decompress returns the value stored as the given data.
+func (c *compressor) decompress(data []byte) ([]byte, error) {
+	format, ok := valueFormat(data)
+	if c == nil || !ok {
+		return data, nil
+	}
+
+	payload := data[len(valueMagic)+1:]
+
+	var r io.ReadCloser
+	switch format {
+	case valueRaw:
+		return unescapeValue(data), nil
+	case valueFlate:
+		r = flate.NewReader(bytes.NewReader(payload))
+	case valueGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		// An unknown format is a value written before compression was
+		// enabled that happens to start with the magic.
+		return data, nil
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// stats returns the statistics of the values compressed so far.
+func (c *compressor) stats() CompressionStats {
+	if c == nil {
+		return CompressionStats{}
+	}
+
+	return CompressionStats{
+		Values:      atomic.LoadUint64(&c.values),
+		RawBytes:    atomic.LoadUint64(&c.rawBytes),
+		StoredBytes: atomic.LoadUint64(&c.storedBytes),
+	}
+}
@@ -0,0 +1,196 @@
+package goque
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueCompression(t *testing.T) {
+	storage := NewMemoryStorage()
+	q, err := OpenQueueWithStorage(storage, &Options{Compression: CompressFlate})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	value := strings.Repeat(`{"name":"value","count":1},`, 100)
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(value); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err = q.EnqueueString("small value"); err != nil {
+		t.Error(err)
+	}
+
+	// Values at or above the threshold must be stored compressed.
+	data, err := storage.Get(idToKey(1))
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.HasPrefix(data, valueHeader(valueFlate)) || len(data) >= len(value) {
+		t.Errorf("Expected value to be stored compressed, got %d bytes", len(data))
+	}
+
+	data, err = storage.Get(idToKey(11))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(data) != "small value" {
+		t.Errorf("Expected small value to be stored as is, got '%s'", data)
+	}
+
+	stats := q.CompressionStats()
+	if stats.Values != 10 || stats.RawBytes != uint64(10*len(value)) {
+		t.Errorf("Expected stats of 10 values and %d bytes, got %d values and %d bytes", 10*len(value), stats.Values, stats.RawBytes)
+	}
+	if stats.Ratio() >= 0.5 {
+		t.Errorf("Expected compression ratio below 0.5, got %f", stats.Ratio())
+	}
+
+	if _, err = q.UpdateString(2, value+"updated"); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected dequeued value to be decompressed, got %d bytes", len(deqItem.Value))
+	}
+
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != value+"updated" {
+		t.Errorf("Expected peeked value to be decompressed, got %d bytes", len(peekItem.Value))
+	}
+
+	if q.SizeBytes() != uint64(9*len(value)+len("updated")+len("small value")) {
+		t.Errorf("Expected size of uncompressed values, got %d", q.SizeBytes())
+	}
+}
+
+func TestQueueCompressionLegacyValues(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := strings.Repeat("value for legacy item ", 50)
+
+	if _, err = q.EnqueueString(value); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithOptions(file, &Options{
+		Compression:          CompressGzip,
+		CompressionThreshold: 64,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	// A value that starts like a compressed one must read back as is.
+	magicValue := append(valueHeader(valueFlate), "not compressed"...)
+	if _, err = q.Enqueue(magicValue); err != nil {
+		t.Error(err)
+	}
+	if _, err = q.EnqueueString(value); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected legacy value to read back unchanged, got %d bytes", len(deqItem.Value))
+	}
+
+	deqItem, err = q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(deqItem.Value, magicValue) {
+		t.Errorf("Expected value '%s', got '%s'", magicValue, deqItem.Value)
+	}
+
+	deqItem, err = q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected compressed value to read back unchanged, got %d bytes", len(deqItem.Value))
+	}
+}
+
+func TestPrefixQueueCompression(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer st.Close()
+
+	pq, err := st.OpenPrefixQueueWithOptions("prefix", &Options{Compression: CompressFlate})
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 10; i++ {
+		if _, err = pq.EnqueueString("prefix", value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	snap, err := pq.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer snap.Release()
+
+	var count int
+	err = snap.ForEach(func(item *Item) error {
+		count++
+		if item.ToString() != value {
+			t.Errorf("Expected snapshot value to be decompressed, got %d bytes", len(item.Value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if count != 10 {
+		t.Errorf("Expected 10 items in snapshot, got %d", count)
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected dequeued value to be decompressed, got %d bytes", len(deqItem.Value))
+	}
+}
@@ -0,0 +1,55 @@
+package goque
+
+// consumeErrorOf returns the callback of the given options that is
+// called with the errors stopping Consume, or nil if none is set.
+func consumeErrorOf(opts *Options) func(err error) {
+	if opts == nil {
+		return nil
+	}
+
+	return opts.OnConsumeError
+}
+
+// reportConsumeError calls the given callback, if any, with the given
+// error unless it is nil.
+func reportConsumeError(onError func(err error), err error) {
+	if onError != nil && err != nil {
+		onError(err)
+	}
+}
+
+// drainItems receives every item still buffered in the given channel
+// and returns them in the order they were sent, followed by the given
+// pending item that was never sent, if any.
+func drainItems(ch chan *Item, pending *Item) []*Item {
+	var items []*Item
+	for {
+		select {
+		case item := <-ch:
+			items = append(items, item)
+		default:
+			if pending != nil {
+				items = append(items, pending)
+			}
+			return items
+		}
+	}
+}
+
+// drainPriorityItems receives every priority item still buffered in the
+// given channel and returns them in the order they were sent, followed
+// by the given pending item that was never sent, if any.
+func drainPriorityItems(ch chan *PriorityItem, pending *PriorityItem) []*PriorityItem {
+	var items []*PriorityItem
+	for {
+		select {
+		case item := <-ch:
+			items = append(items, item)
+		default:
+			if pending != nil {
+				items = append(items, pending)
+			}
+			return items
+		}
+	}
+}
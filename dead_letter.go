@@ -0,0 +1,249 @@
+package goque
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// DeadLetter represents an item that was moved out of its data
+// structure after its delivery failed more times than allowed.
+type DeadLetter struct {
+	ID       uint64
+	Key      []byte
+	Value    []byte
+	Attempts uint32
+}
+
+// ToString returns the dead letter value as a string.
+func (dl *DeadLetter) ToString() string {
+	return string(dl.Value)
+}
+
+// errDeadLetterRecord is returned when a stored dead letter record
+// cannot be decoded.
+var errDeadLetterRecord = errors.New("goque: Invalid dead letter record")
+
+// encodeDeadLetter encodes a dead letter record, which holds the
+// delivery attempts of the item, its original key and its value.
+func encodeDeadLetter(key, value []byte, attempts uint32) []byte {
+	rec := make([]byte, 4+binary.MaxVarintLen64, 4+binary.MaxVarintLen64+len(key)+len(value))
+	binary.BigEndian.PutUint32(rec, attempts)
+	n := binary.PutUvarint(rec[4:], uint64(len(key)))
+	rec = rec[:4+n]
+	rec = append(rec, key...)
+	return append(rec, value...)
+}
+
+// decodeDeadLetter decodes the dead letter record with the given ID.
+func decodeDeadLetter(id uint64, rec []byte) (*DeadLetter, error) {
+	if len(rec) < 5 {
+		return nil, errDeadLetterRecord
+	}
+
+	keyLen, n := binary.Uvarint(rec[4:])
+	if n <= 0 || uint64(len(rec)-4-n) < keyLen {
+		return nil, errDeadLetterRecord
+	}
+
+	start := 4 + n
+	return &DeadLetter{
+		ID:       id,
+		Key:      append([]byte{}, rec[start:start+int(keyLen)]...),
+		Value:    append([]byte{}, rec[start+int(keyLen):]...),
+		Attempts: binary.BigEndian.Uint32(rec),
+	}, nil
+}
+
+// deadLetters manages the delivery attempt counters and the dead letter
+// list of a data structure. It is not goroutine safe and relies on the
+// lock of its owner.
+type deadLetters struct {
+	db          *keyspace
+	sync        *syncer
+	prefix      []byte
+	maxAttempts uint32
+	length      uint64
+	seq         uint64
+}
+
+// newDeadLetters creates the dead letter list for the given database,
+// writing with the given syncer and storing its records under the given
+// internal key prefix.
+func newDeadLetters(db *keyspace, sync *syncer, prefix []byte) *deadLetters {
+	return &deadLetters{
+		db:     db,
+		sync:   sync,
+		prefix: prefix,
+	}
+}
+
+// keyPrefix returns the key prefix for stored dead letters.
+func (dls *deadLetters) keyPrefix() []byte {
+	return append(append([]byte{}, dls.prefix...), []byte("dead:")...)
+}
+
+// key generates the key of the dead letter with the given ID.
+func (dls *deadLetters) key(id uint64) []byte {
+	return append(dls.keyPrefix(), idToKey(id)...)
+}
+
+// attemptsKey generates the key of the delivery attempt counter for the
+// item with the given key.
+func (dls *deadLetters) attemptsKey(itemKey []byte) []byte {
+	key := append(append([]byte{}, dls.prefix...), []byte("attempts:")...)
+	return append(key, itemKey...)
+}
+
+// attempts returns the delivery attempt counter for the item with the
+// given key.
+func (dls *deadLetters) attempts(itemKey []byte) (uint32, error) {
+	val, err := dls.db.Get(dls.attemptsKey(itemKey), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(val), nil
+}
+
+// attemptsRange returns the delivery attempt counters for every item with
+// a key in the given range, keyed by the item key.
+func (dls *deadLetters) attemptsRange(start, limit []byte) (map[string]uint32, error) {
+	prefix := dls.attemptsKey(nil)
+	iter := dls.db.NewIterator(&util.Range{Start: dls.attemptsKey(start), Limit: dls.attemptsKey(limit)}, nil)
+	defer iter.Release()
+
+	attempts := make(map[string]uint32)
+	for iter.Next() {
+		attempts[string(iter.Key()[len(prefix):])] = binary.BigEndian.Uint32(iter.Value())
+	}
+
+	return attempts, iter.Error()
+}
+
+// setAttempts adds the update of the delivery attempt counter for the
+// item with the given key to the batch. Counters of zero are not
+// stored.
+func (dls *deadLetters) setAttempts(batch *leveldb.Batch, itemKey []byte, attempts uint32) {
+	if attempts == 0 {
+		batch.Delete(dls.attemptsKey(itemKey))
+		return
+	}
+
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, attempts)
+	batch.Put(dls.attemptsKey(itemKey), val)
+}
+
+// exceeded returns whether the given number of failed delivery attempts
+// exceeds the maximum allowed.
+func (dls *deadLetters) exceeded(attempts uint32) bool {
+	return dls.maxAttempts > 0 && attempts > dls.maxAttempts
+}
+
+// add adds the creation of a dead letter for the given item to the
+// batch, returning its ID. The list is only updated once commitAdd is
+// called after the batch has been written.
+func (dls *deadLetters) add(batch *leveldb.Batch, key, value []byte, attempts uint32) uint64 {
+	id := dls.seq + 1
+	batch.Put(dls.key(id), encodeDeadLetter(key, value, attempts))
+	return id
+}
+
+// commitAdd updates the list after a dead letter added to a batch has
+// been written.
+func (dls *deadLetters) commitAdd(id uint64) {
+	dls.seq = id
+	dls.length++
+}
+
+// get returns the dead letter with the given ID.
+func (dls *deadLetters) get(id uint64) (*DeadLetter, error) {
+	rec, err := dls.db.Get(dls.key(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrOutOfBounds
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeDeadLetter(id, rec)
+}
+
+// list returns all dead letters in the order they were added.
+func (dls *deadLetters) list() ([]*DeadLetter, error) {
+	prefix := dls.keyPrefix()
+	iter := dls.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	var letters []*DeadLetter
+	for iter.Next() {
+		dl, err := decodeDeadLetter(keyToID(iter.Key()[len(prefix):]), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, dl)
+	}
+
+	return letters, iter.Error()
+}
+
+// remove adds the deletion of the dead letter with the given ID to the
+// batch. The list is only updated once commitRemove is called after the
+// batch has been written.
+func (dls *deadLetters) remove(batch *leveldb.Batch, id uint64) {
+	batch.Delete(dls.key(id))
+}
+
+// commitRemove updates the list after a dead letter removed in a batch
+// has been written.
+func (dls *deadLetters) commitRemove() {
+	dls.length--
+}
+
+// purge deletes every dead letter.
+func (dls *deadLetters) purge() error {
+	iter := dls.db.NewIterator(util.BytesPrefix(dls.keyPrefix()), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if err := dls.db.Write(batch, dls.sync.options()); err != nil {
+		return err
+	}
+	dls.length = 0
+
+	return nil
+}
+
+// load counts the stored dead letters and finds the last issued ID.
+func (dls *deadLetters) load() error {
+	prefix := dls.keyPrefix()
+	iter := dls.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		dls.length++
+	}
+
+	if iter.Last() {
+		dls.seq = keyToID(iter.Key()[len(prefix):])
+	}
+
+	return iter.Error()
+}
+
+// reset clears the in-memory dead letter bookkeeping.
+func (dls *deadLetters) reset() {
+	dls.length = 0
+	dls.seq = 0
+}
@@ -0,0 +1,119 @@
+package goque
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errMalformedValue is returned when an encrypted value is too short to
+// hold its header and nonce.
+var errMalformedValue = errors.New("goque: Encrypted value is malformed")
+
+// encrypter encrypts the values written to a keyspace using AES-GCM and
+// decrypts the values read from it. Every encrypted value has a header
+// recording the ID of its key, followed by its nonce and its ciphertext.
+// The key of the value in the keyspace is authenticated with it, so a
+// value cannot be moved to another key. A nil encrypter leaves values as
+// they are.
+type encrypter struct {
+	keyID uint32
+	aeads map[uint32]cipher.AEAD
+}
+
+// newEncrypter returns the encrypter for the given options, or nil if
+// encryption is not enabled.
+func newEncrypter(opts *Options) (*encrypter, error) {
+	if opts == nil || len(opts.EncryptionKeys) == 0 {
+		return nil, nil
+	}
+
+	e := &encrypter{
+		keyID: opts.EncryptionKeyID,
+		aeads: make(map[uint32]cipher.AEAD, len(opts.EncryptionKeys)),
+	}
+	for id, key := range opts.EncryptionKeys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if e.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that new values can be encrypted.
+	if _, ok := e.aeads[e.keyID]; !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return e, nil
+}
+
+// encrypt returns the given value of the given key as it is stored.
+func (e *encrypter) encrypt(key, value []byte) ([]byte, error) {
+	if e == nil {
+		return value, nil
+	}
+
+	aead := e.aeads[e.keyID]
+	data := make([]byte, len(valueMagic)+5+aead.NonceSize(), len(valueMagic)+5+aead.NonceSize()+len(value)+aead.Overhead())
+	copy(data, valueHeader(valueEncrypted))
+	binary.BigEndian.PutUint32(data[len(valueMagic)+1:], e.keyID)
+
+	nonce := data[len(valueMagic)+5:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(data, nonce, value, key), nil
+}
+
+// decrypt returns the value of the given key stored as the given data.
+// Values that are not encrypted are returned as they are.
+func (e *encrypter) decrypt(key, data []byte) ([]byte, error) {
+	if format, ok := valueFormat(data); e == nil || !ok || format != valueEncrypted {
+		return data, nil
+	}
+
+	id, ok := encryptionKeyID(data)
+	if !ok {
+		return nil, errMalformedValue
+	}
+	aead, ok := e.aeads[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	start := len(valueMagic) + 5
+	if len(data) < start+aead.NonceSize() {
+		return nil, errMalformedValue
+	}
+	nonce := data[start : start+aead.NonceSize()]
+
+	return aead.Open(nil, nonce, data[start+aead.NonceSize():], key)
+}
+
+// current returns whether the given stored value is encrypted with the
+// current key.
+func (e *encrypter) current(data []byte) bool {
+	if format, ok := valueFormat(data); !ok || format != valueEncrypted {
+		return false
+	}
+
+	id, ok := encryptionKeyID(data)
+	return ok && id == e.keyID
+}
+
+// encryptionKeyID returns the key ID recorded in the header of the given
+// encrypted value.
+func encryptionKeyID(data []byte) (uint32, bool) {
+	if len(data) < len(valueMagic)+5 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(data[len(valueMagic)+1:]), true
+}
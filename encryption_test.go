@@ -0,0 +1,335 @@
+package goque
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestQueueEncryption(t *testing.T) {
+	storage := NewMemoryStorage()
+	q, err := OpenQueueWithStorage(storage, &Options{
+		EncryptionKeys:  map[uint32][]byte{1: testKey1},
+		EncryptionKeyID: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	data, err := storage.Get(idToKey(1))
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.HasPrefix(data, valueHeader(valueEncrypted)) || bytes.Contains(data, []byte("value for item")) {
+		t.Errorf("Expected value to be stored encrypted, got '%x'", data)
+	}
+
+	// A value copied to another key must not decrypt.
+	orig, err := storage.Get(idToKey(2))
+	if err != nil {
+		t.Error(err)
+	}
+	if err = storage.Put(idToKey(2), data, false); err != nil {
+		t.Error(err)
+	}
+	if _, err = q.PeekByID(2); err == nil {
+		t.Error("Expected value copied to another key to fail to decrypt")
+	}
+	if err = storage.Put(idToKey(2), orig, false); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.UpdateString(3, "value for item 3"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestQueueEncryptionKeyRotation(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{1: testKey1},
+		EncryptionKeyID: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value for item 2"); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{1: testKey1, 2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value for item 3"); err != nil {
+		t.Error(err)
+	}
+
+	// Old items still decrypt with the new key set.
+	for i := 1; i <= 3; i++ {
+		idItem, err := q.PeekByID(uint64(i))
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if idItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, idItem.ToString())
+		}
+	}
+
+	if err = q.Reencrypt(); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Every value must now be encrypted with the new key.
+	db, err := leveldb.OpenFile(file, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var count int
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		count++
+		id, ok := encryptionKeyID(iter.Value())
+		if !bytes.HasPrefix(iter.Value(), valueHeader(valueEncrypted)) || !ok || id != 2 {
+			t.Errorf("Expected key %x to be encrypted with key 2, got '%x'", iter.Key(), iter.Value())
+		}
+	}
+	iter.Release()
+
+	if count < 3 {
+		t.Errorf("Expected at least 3 keys, got %d", count)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 3; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestStackEncryptionUnknownKey(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStackWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{1: testKey1},
+		EncryptionKeyID: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.PushString("value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = OpenStackWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{2: testKey2},
+		EncryptionKeyID: 1,
+	}); err != ErrUnknownKey {
+		t.Errorf("Expected to get unknown key error, got %v", err)
+	}
+
+	if _, err = OpenStackWithOptions(file, &Options{
+		EncryptionKeys: map[uint32][]byte{0: []byte("short key")},
+	}); err == nil {
+		t.Error("Expected to get invalid key size error")
+	}
+
+	// The stored sizes of the items are encrypted with the old key too.
+	s, err = OpenStackWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != ErrUnknownKey {
+		t.Errorf("Expected to get unknown key error, got %v", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	s, err = OpenStackWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{1: testKey1, 2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = s.Reencrypt(); err != nil {
+		t.Error(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	s, err = OpenStackWithOptions(file, &Options{
+		EncryptionKeys:  map[uint32][]byte{2: testKey2},
+		EncryptionKeyID: 2,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	peekItem, err := s.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+}
+
+func TestPriorityQueueReencryptNoEncryption(t *testing.T) {
+	pq, err := OpenPriorityQueueInMemory(ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if err = pq.Reencrypt(); err != ErrNoEncryption {
+		t.Errorf("Expected to get no encryption error, got %v", err)
+	}
+}
+
+func TestPrefixQueueEncryptionWithCompression(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer st.Close()
+
+	pq, err := st.OpenPrefixQueueWithOptions("prefix", &Options{
+		Compression:     CompressFlate,
+		EncryptionKeys:  map[uint32][]byte{1: testKey1},
+		EncryptionKeyID: 1,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	value := strings.Repeat("value for item ", 100)
+
+	for i := 1; i <= 10; i++ {
+		if _, err = pq.EnqueueString("prefix", value); err != nil {
+			t.Error(err)
+		}
+	}
+
+	stats := pq.CompressionStats()
+	if stats.Ratio() >= 0.5 {
+		t.Errorf("Expected values to be compressed before being encrypted, got ratio %f", stats.Ratio())
+	}
+
+	snap, err := pq.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer snap.Release()
+
+	peekItem, err := snap.PeekString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != value {
+		t.Errorf("Expected snapshot value to be decrypted, got %d bytes", len(peekItem.Value))
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != value {
+		t.Errorf("Expected dequeued value to be decrypted, got %d bytes", len(deqItem.Value))
+	}
+}
@@ -2,6 +2,7 @@ package goque
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -20,4 +21,49 @@ var (
 	// been called, causing the stack or queue to close, as well as
 	// its underlying database.
 	ErrDBClosed = errors.New("goque: Database is closed")
+
+	// ErrFull is returned when adding an item would take the stack or
+	// queue past its maximum item count or byte size.
+	ErrFull = errors.New("goque: Stack or queue is full")
+
+	// ErrInvalidLease is returned when a lease token is unknown, has
+	// already been acknowledged or returned, or its lease has expired.
+	ErrInvalidLease = errors.New("goque: Lease is invalid or has expired")
+
+	// ErrInvalidMove is returned when an item is moved between data
+	// structures that are the same or do not share storage.
+	ErrInvalidMove = errors.New("goque: Move requires different data structures sharing storage")
+
+	// ErrUnknownKey is returned when a value is encrypted with a key
+	// that is not in the encryption keys, or the current encryption key
+	// ID is not one of them.
+	ErrUnknownKey = errors.New("goque: Encryption key is unknown")
+
+	// ErrNoEncryption is returned when values are reencrypted in a data
+	// structure opened without encryption keys.
+	ErrNoEncryption = errors.New("goque: Encryption is not enabled")
+
+	// ErrNoDataDir is returned when blob files are enabled for a data
+	// structure opened on a Storage without a data directory.
+	ErrNoDataDir = errors.New("goque: Blob files require a data directory")
 )
+
+// ErrCorrupt is returned when the checksum stored with a value does not
+// match its data.
+type ErrCorrupt struct {
+	// ID is the ID of the item the value belongs to, or 0 if it is a
+	// record kept by the data structure itself.
+	ID uint64
+
+	// Key is the key the value is stored under.
+	Key []byte
+}
+
+// Error returns the error message.
+func (e *ErrCorrupt) Error() string {
+	if e.ID == 0 {
+		return fmt.Sprintf("goque: Value of key %x is corrupt", e.Key)
+	}
+
+	return fmt.Sprintf("goque: Value of item %d is corrupt", e.ID)
+}
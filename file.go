@@ -15,6 +15,7 @@ const (
 	goqueQueue
 	goquePriorityQueue
 	goquePrefixQueue
+	goqueStore
 )
 
 // checkGoqueType checks if the type of Goque data structure
@@ -67,14 +68,20 @@ func checkGoqueType(dataDir string, gt goqueType) (bool, error) {
 	// Convert the file byte to its goqueType.
 	filegt := goqueType(fb[0])
 
+	return compatibleTypes(filegt, gt), nil
+}
+
+// compatibleTypes returns whether a data structure of the given stored
+// type can be opened by the given opener type.
+func compatibleTypes(stored, gt goqueType) bool {
 	// Compare the types.
-	if filegt == gt {
-		return true, nil
-	} else if filegt == goqueStack && gt == goqueQueue {
-		return true, nil
-	} else if filegt == goqueQueue && gt == goqueStack {
-		return true, nil
+	if stored == gt {
+		return true
+	} else if stored == goqueStack && gt == goqueQueue {
+		return true
+	} else if stored == goqueQueue && gt == goqueStack {
+		return true
 	}
 
-	return false, nil
+	return false
 }
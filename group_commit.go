@@ -0,0 +1,94 @@
+package goque
+
+// defaultGroupCommitSize is the maximum number of enqueues committed
+// together when Options.GroupCommitSize is not set.
+const defaultGroupCommitSize = 128
+
+// commitRequest is an enqueue waiting to be group committed.
+type commitRequest struct {
+	value   []byte
+	item    *Item
+	dropped []*Item
+	err     error
+	done    chan struct{}
+}
+
+// groupCommitter gathers concurrent enqueues so they can be committed
+// together as a single write by a background goroutine.
+type groupCommitter struct {
+	requests chan *commitRequest
+	stop     chan struct{}
+	size     int
+}
+
+// newGroupCommitter starts a group committer that passes up to size
+// requests at a time to the given commit function, which must set the
+// item or error of every request, and the items dropped for it.
+func newGroupCommitter(size int, commit func(reqs []*commitRequest)) *groupCommitter {
+	if size <= 0 {
+		size = defaultGroupCommitSize
+	}
+
+	gc := &groupCommitter{
+		requests: make(chan *commitRequest),
+		stop:     make(chan struct{}),
+		size:     size,
+	}
+	go gc.run(commit)
+
+	return gc
+}
+
+// submit hands the given value to the group committer and blocks until
+// the write it was gathered into has been committed. It returns the item
+// added for the value, along with the items dropped to make space for it.
+func (gc *groupCommitter) submit(value []byte) (*Item, []*Item, error) {
+	req := &commitRequest{value: value, done: make(chan struct{})}
+
+	select {
+	case gc.requests <- req:
+	case <-gc.stop:
+		return nil, nil, ErrDBClosed
+	}
+
+	<-req.done
+	return req.item, req.dropped, req.err
+}
+
+// run commits the requests that arrive while the previous write was in
+// progress together, until the group committer is closed.
+func (gc *groupCommitter) run(commit func(reqs []*commitRequest)) {
+	for {
+		var reqs []*commitRequest
+
+		// Wait for a request.
+		select {
+		case <-gc.stop:
+			return
+		case req := <-gc.requests:
+			reqs = append(reqs, req)
+		}
+
+		// Gather any other waiting requests.
+	gather:
+		for len(reqs) < gc.size {
+			select {
+			case req := <-gc.requests:
+				reqs = append(reqs, req)
+			default:
+				break gather
+			}
+		}
+
+		commit(reqs)
+		for _, req := range reqs {
+			close(req.done)
+		}
+	}
+}
+
+// close stops the group committer. Requests submitted afterwards fail
+// with ErrDBClosed.
+func (gc *groupCommitter) close() {
+	close(gc.stop)
+}
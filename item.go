@@ -3,15 +3,26 @@ package goque
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
-	"encoding/json"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// internalPrefix is the key prefix of internal records kept alongside
+// the items of a data structure, such as leases. Stack and queue item
+// keys are 8 byte IDs, which sort before this prefix for any ID below
+// 0xffff000000000000, and priority queue keys never start with it
+// since the second byte of those is always the prefix separator.
+var internalPrefix = []byte{0xff, 0xff}
+
 // Item represents an entry in either a stack or queue.
+//
+// Attempts holds the number of times delivery of a queue item has
+// failed, either by returning its lease or by calling Fail.
 type Item struct {
-	ID    uint64
-	Key   []byte
-	Value []byte
+	ID       uint64
+	Key      []byte
+	Value    []byte
+	Attempts uint32
 }
 
 // ToString returns the item value as a string.
@@ -31,9 +42,7 @@ func (i *Item) ToString() string {
 // package works. Because of this, you should only use this function
 // to decode simple types.
 func (i *Item) ToObject(value interface{}) error {
-	buffer := bytes.NewBuffer(i.Value)
-	dec := gob.NewDecoder(buffer)
-	return dec.Decode(value)
+	return GobCodec.Decode(i.Value, value)
 }
 
 // ToObjectFromJSON decodes the item value into the given value type
@@ -43,15 +52,18 @@ func (i *Item) ToObject(value interface{}) error {
 // of the type you wish to decode into. The variable pointed to will
 // hold the decoded object.
 func (i *Item) ToObjectFromJSON(value interface{}) error {
-	return json.Unmarshal(i.Value, value)
+	return JSONCodec.Decode(i.Value, value)
 }
 
 // PriorityItem represents an entry in a priority queue.
+//
+// Attempts holds the number of times delivery of the item has failed.
 type PriorityItem struct {
 	ID       uint64
 	Priority uint8
 	Key      []byte
 	Value    []byte
+	Attempts uint32
 }
 
 // ToString returns the priority item value as a string.
@@ -71,9 +83,7 @@ func (pi *PriorityItem) ToString() string {
 // package works. Because of this, you should only use this function
 // to decode simple types.
 func (pi *PriorityItem) ToObject(value interface{}) error {
-	buffer := bytes.NewBuffer(pi.Value)
-	dec := gob.NewDecoder(buffer)
-	return dec.Decode(value)
+	return GobCodec.Decode(pi.Value, value)
 }
 
 // ToObjectFromJSON decodes the item value into the given value type
@@ -83,7 +93,7 @@ func (pi *PriorityItem) ToObject(value interface{}) error {
 // of the type you wish to decode into. The variable pointed to will
 // hold the decoded object.
 func (pi *PriorityItem) ToObjectFromJSON(value interface{}) error {
-	return json.Unmarshal(pi.Value, value)
+	return JSONCodec.Decode(pi.Value, value)
 }
 
 // idToKey converts and returns the given ID to a key.
@@ -97,3 +107,15 @@ func idToKey(id uint64) []byte {
 func keyToID(key []byte) uint64 {
 	return binary.BigEndian.Uint64(key)
 }
+
+// itemRange returns the key range holding the items of a stack or
+// queue, excluding any internal records.
+func itemRange() *util.Range {
+	return &util.Range{Limit: internalPrefix}
+}
+
+// isItemKey returns whether the given key holds an item of a stack,
+// queue or priority queue rather than an internal record.
+func isItemKey(key []byte) bool {
+	return bytes.Compare(key, internalPrefix) < 0
+}
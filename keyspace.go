@@ -0,0 +1,701 @@
+package goque
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// reencryptBatchSize is the most values rewritten in a single write when
+// reencrypting a keyspace.
+const reencryptBatchSize = 1000
+
+// keyspace is the part of a Storage a data structure stores its keys in.
+// A data structure opened on its own has the whole storage to itself,
+// while one hosted by a Store has its keys stored under a prefix of the
+// shared storage, which is added to and stripped from every key
+// transparently. Values are compressed, encrypted, checksummed and
+// spilled to blob files the same way if enabled. A keyspace created by
+// snapshot reads from a snapshot of the storage instead.
+type keyspace struct {
+	db        Storage
+	snap      StorageSnapshot
+	prefix    []byte
+	comp      *compressor
+	crypt     *encrypter
+	checksums bool
+	unchecked bool
+	blobs     *blobStore
+	isItem    func(key []byte) bool
+	dir       string
+	store     *Store
+	name      string
+}
+
+// openKeyspace opens the LevelDB database at the given directory for a
+// data structure of the given type, using the given options.
+func openKeyspace(dataDir string, gt goqueType, opts *Options) (*keyspace, error) {
+	db, err := openLevelDBStorage(dataDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if this Goque type can open the requested data directory.
+	ok, err := checkGoqueType(dataDir, gt)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !ok {
+		db.Close()
+		return nil, ErrIncompatibleType
+	}
+
+	return &keyspace{db: db, dir: dataDir}, nil
+}
+
+// setValueOptions enables the compression, encryption, checksums and
+// blob files of values set in the given options. The given function
+// returns whether a key holds an item, so corrupt values can be reported
+// with their item ID.
+func (ks *keyspace) setValueOptions(opts *Options, isItem func(key []byte) bool) error {
+	crypt, err := newEncrypter(opts)
+	if err != nil {
+		return err
+	}
+	blobs, err := newBlobStore(ks.dir, ks.prefix, opts)
+	if err != nil {
+		return err
+	}
+
+	ks.comp = newCompressor(opts)
+	ks.crypt = crypt
+	ks.checksums = opts != nil && opts.Checksums
+	ks.unchecked = opts != nil && opts.AllowUnchecksummed
+	ks.blobs = blobs
+	ks.isItem = isItem
+
+	return nil
+}
+
+// key returns the database key for the given key.
+func (ks *keyspace) key(key []byte) []byte {
+	if len(ks.prefix) == 0 {
+		return key
+	}
+
+	return append(append(make([]byte, 0, len(ks.prefix)+len(key)), ks.prefix...), key...)
+}
+
+// keyRange returns the database range for the given range, where a nil
+// range or bound covers the whole keyspace.
+func (ks *keyspace) keyRange(r *util.Range) *util.Range {
+	if len(ks.prefix) == 0 {
+		return r
+	}
+
+	kr := util.BytesPrefix(ks.prefix)
+	if r != nil && r.Start != nil {
+		kr.Start = ks.key(r.Start)
+	}
+	if r != nil && r.Limit != nil {
+		kr.Limit = ks.key(r.Limit)
+	}
+
+	return kr
+}
+
+// snapshot returns a read-only copy of the keyspace that reads from a
+// snapshot of its current state. Closing the copy releases the
+// snapshot.
+func (ks *keyspace) snapshot() (*keyspace, error) {
+	snap, err := ks.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	ks.blobs.hold()
+
+	return &keyspace{
+		db:        ks.db,
+		snap:      snap,
+		prefix:    ks.prefix,
+		comp:      ks.comp,
+		crypt:     ks.crypt,
+		checksums: ks.checksums,
+		unchecked: ks.unchecked,
+		blobs:     ks.blobs,
+		isItem:    ks.isItem,
+		dir:       ks.dir,
+	}, nil
+}
+
+// plain returns whether keys and values are stored in the storage as
+// they are.
+func (ks *keyspace) plain() bool {
+	return len(ks.prefix) == 0 && ks.comp == nil && ks.crypt == nil && !ks.checksums && ks.blobs == nil
+}
+
+// encodeValue returns the value for the given key as it is stored,
+// before it is spilled to a blob file. Unless the keyspace is plain, a
+// value starting with valueMagic is always stored with a header, so it is
+// never mistaken for a value written by another step.
+func (ks *keyspace) encodeValue(key, value []byte) ([]byte, error) {
+	data := ks.comp.compress(value)
+	if ks.comp == nil && !ks.plain() {
+		data = escapeValue(data)
+	}
+
+	data, err := ks.crypt.encrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks.seal(data), nil
+}
+
+// decodeValue returns the value for the given key stored as the given
+// data.
+func (ks *keyspace) decodeValue(key, data []byte) ([]byte, error) {
+	data, err := ks.load(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks.decrypt(key, data)
+}
+
+// decrypt returns the value for the given key from the given stored data
+// once it has been loaded.
+func (ks *keyspace) decrypt(key, data []byte) ([]byte, error) {
+	value, err := ks.crypt.decrypt(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if ks.comp == nil && !ks.plain() {
+		return unescapeValue(value), nil
+	}
+
+	return ks.comp.decompress(value)
+}
+
+// seal returns the given stored data with its checksum if enabled.
+func (ks *keyspace) seal(data []byte) []byte {
+	if !ks.checksums {
+		return data
+	}
+
+	return addChecksum(data)
+}
+
+// unseal returns the given stored data of the given key without its
+// checksum, after verifying it if enabled. An item without a checksum is
+// reported as corrupt unless unchecksummed items are allowed, as its
+// header may have been damaged.
+func (ks *keyspace) unseal(key, data []byte) ([]byte, error) {
+	if !ks.checksums {
+		return data, nil
+	}
+
+	data, ok := verifyChecksum(data, ks.unchecked || ks.isItem == nil || !ks.isItem(key))
+	if !ok {
+		return nil, ks.corrupt(key)
+	}
+
+	return data, nil
+}
+
+// load returns the encrypted and compressed data of the given key stored
+// as the given data, verifying its checksum and reading it from its blob
+// file if it was spilled. A missing blob file is reported as corrupt.
+func (ks *keyspace) load(key, data []byte) ([]byte, error) {
+	data, err := ks.unseal(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := blobName(data)
+	if !ok || ks.blobs == nil {
+		return data, nil
+	}
+
+	if data, err = ks.blobs.read(name); os.IsNotExist(err) {
+		return nil, ks.corrupt(key)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ks.unseal(key, data)
+}
+
+// storedBlob returns the name of the blob file the value stored under the
+// given database key is spilled to, or an empty string if there is none.
+func (ks *keyspace) storedBlob(dbKey []byte) (string, error) {
+	data, err := ks.db.Get(dbKey)
+	if err == leveldb.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// A reference that fails its checksum cannot be trusted, so its file
+	// is left for Verify to find.
+	if ks.checksums {
+		var ok bool
+		if data, ok = verifyChecksum(data, true); !ok {
+			return "", nil
+		}
+	}
+	name, _ := blobName(data)
+
+	return name, nil
+}
+
+// corrupt returns the error reporting that the value of the given key is
+// corrupt.
+func (ks *keyspace) corrupt(key []byte) error {
+	err := &ErrCorrupt{Key: append([]byte{}, key...)}
+	if ks.isItem != nil && ks.isItem(key) {
+		err.ID = keyToID(key[len(key)-8:])
+	}
+
+	return err
+}
+
+// getRaw gets the value for the given key as it is stored, without
+// decoding it. A value spilled to a blob file is read from the file if it
+// still exists, so it is kept once the file is removed.
+func (ks *keyspace) getRaw(key []byte) ([]byte, error) {
+	data, err := ks.db.Get(ks.key(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if ref, err := ks.unseal(key, data); err == nil && ks.blobs != nil {
+		if name, ok := blobName(ref); ok {
+			if blob, err := ks.blobs.read(name); err == nil {
+				return blob, nil
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// Get gets the value for the given key.
+func (ks *keyspace) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	var data []byte
+	var err error
+	if ks.snap != nil {
+		data, err = ks.snap.Get(ks.key(key))
+	} else {
+		data, err = ks.db.Get(ks.key(key))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ks.decodeValue(key, data)
+}
+
+// Put sets the value for the given key.
+func (ks *keyspace) Put(key, value []byte, wo *opt.WriteOptions) error {
+	if ks.blobs != nil {
+		batch := new(leveldb.Batch)
+		batch.Put(key, value)
+		return ks.Write(batch, wo)
+	}
+
+	data, err := ks.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	return ks.db.Put(ks.key(key), data, syncWrite(wo))
+}
+
+// Delete deletes the value for the given key.
+func (ks *keyspace) Delete(key []byte, wo *opt.WriteOptions) error {
+	if ks.blobs != nil {
+		batch := new(leveldb.Batch)
+		batch.Delete(key)
+		return ks.Write(batch, wo)
+	}
+
+	return ks.db.Delete(ks.key(key), syncWrite(wo))
+}
+
+// Write applies the given batch to the keyspace as a single atomic write.
+func (ks *keyspace) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if ks.plain() {
+		return ks.db.Write(batch, syncWrite(wo))
+	}
+
+	kb := newKeyspaceBatch(ks, new(leveldb.Batch))
+	if err := kb.replay(batch); err != nil {
+		kb.abort()
+		return err
+	}
+
+	return kb.write(ks.db.Write(kb.batch, syncWrite(wo)))
+}
+
+// writeBatches applies the batches of two keyspaces sharing a database
+// as a single atomic write.
+func writeBatches(wo *opt.WriteOptions, ks1 *keyspace, b1 *leveldb.Batch, ks2 *keyspace, b2 *leveldb.Batch) error {
+	batch := new(leveldb.Batch)
+	kb1 := newKeyspaceBatch(ks1, batch)
+	kb2 := newKeyspaceBatch(ks2, batch)
+	if err := kb1.replay(b1); err != nil {
+		kb1.abort()
+		return err
+	}
+	if err := kb2.replay(b2); err != nil {
+		kb1.abort()
+		kb2.abort()
+		return err
+	}
+
+	err := ks1.db.Write(batch, syncWrite(wo))
+	kb1.write(err)
+	return kb2.write(err)
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole keyspace if it is nil.
+func (ks *keyspace) NewIterator(r *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	var iter iterator.Iterator
+	if ks.snap != nil {
+		iter = ks.snap.NewIterator(ks.keyRange(r))
+	} else {
+		iter = ks.db.NewIterator(ks.keyRange(r))
+	}
+	if ks.plain() {
+		return iter
+	}
+
+	return &keyspaceIterator{Iterator: iter, ks: ks}
+}
+
+// CompactRange compacts the keys of the given range, or of the whole
+// keyspace if both bounds are nil.
+func (ks *keyspace) CompactRange(r util.Range) error {
+	return ks.db.Compact(*ks.keyRange(&r))
+}
+
+// reencrypt rewrites every value of the keyspace that is not encrypted
+// with the current key, in atomic batches of at most reencryptBatchSize
+// values written with the given options.
+func (ks *keyspace) reencrypt(wo *opt.WriteOptions) error {
+	if ks.crypt == nil {
+		return ErrNoEncryption
+	}
+
+	var start []byte
+	for {
+		kb, next, err := ks.reencryptBatch(start)
+		if err != nil {
+			kb.abort()
+			return err
+		}
+
+		if kb.batch.Len() > 0 {
+			if err := kb.write(ks.db.Write(kb.batch, syncWrite(wo))); err != nil {
+				return err
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+		start = next
+	}
+}
+
+// reencryptBatch returns a batch rewriting the values from the given key
+// onwards that are not encrypted with the current key, and the key to
+// continue from, or nil if every key has been read. The batch is written
+// once the iterator is released, as writing while iterating is not
+// supported by every storage.
+func (ks *keyspace) reencryptBatch(start []byte) (*keyspaceBatch, []byte, error) {
+	kb := newKeyspaceBatch(ks, new(leveldb.Batch))
+
+	iter := ks.db.NewIterator(ks.keyRange(&util.Range{Start: start}))
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()[len(ks.prefix):]
+		data, err := ks.load(key, iter.Value())
+		if err != nil {
+			return kb, nil, err
+		}
+		if ks.crypt.current(data) {
+			continue
+		}
+
+		value, err := ks.decrypt(key, data)
+		if err != nil {
+			return kb, nil, err
+		}
+		if kb.Put(key, value); kb.err != nil {
+			return kb, nil, kb.err
+		}
+
+		if kb.batch.Len() >= reencryptBatchSize {
+			return kb, append(append([]byte{}, key...), 0), iter.Error()
+		}
+	}
+
+	return kb, nil, iter.Error()
+}
+
+// verify deletes the blob files of the keyspace that no stored value
+// refers to, such as those left by a crash between writing a blob file
+// and the value referring to it, or removing a value and its file. It
+// returns the paths of the deleted files.
+func (ks *keyspace) verify() ([]string, error) {
+	if ks.blobs == nil {
+		return nil, nil
+	}
+
+	names, err := ks.blobs.list()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the blob files referred to by the stored values.
+	refs := make(map[string]bool)
+	iter := ks.db.NewIterator(ks.keyRange(nil))
+	defer iter.Release()
+
+	for iter.Next() {
+		data := iter.Value()
+		if ks.checksums {
+			var ok bool
+			if data, ok = verifyChecksum(data, true); !ok {
+				continue
+			}
+		}
+		if name, ok := blobName(data); ok {
+			refs[name] = true
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// Retired blob files are still read by open snapshots.
+	for _, name := range ks.blobs.kept() {
+		refs[name] = true
+	}
+
+	var orphans []string
+	for _, name := range names {
+		if !refs[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	ks.blobs.remove(orphans)
+
+	paths := make([]string, len(orphans))
+	for i, name := range orphans {
+		paths[i] = filepath.Join(ks.blobs.dir, name)
+	}
+
+	return paths, nil
+}
+
+// Close closes the database, releases the keyspace back to its store, or
+// releases the snapshot of a read-only copy.
+func (ks *keyspace) Close() error {
+	if ks.snap != nil {
+		ks.snap.Release()
+		ks.blobs.release()
+		return nil
+	}
+	if ks.store != nil {
+		ks.store.release(ks.name)
+		return nil
+	}
+
+	return ks.db.Close()
+}
+
+// drop deletes the data structure stored in the keyspace, which must
+// already be closed. A keyspace opened on a Storage without a directory
+// has nothing left to delete once closed.
+func (ks *keyspace) drop() error {
+	if ks.store != nil {
+		return ks.store.Drop(ks.name)
+	}
+	if ks.dir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(ks.dir)
+}
+
+// syncWrite returns whether a write with the given options is synced.
+func syncWrite(wo *opt.WriteOptions) bool {
+	return wo != nil && wo.Sync
+}
+
+// keyspaceBatch replays a batch into another batch with the key prefix
+// of a keyspace added to every key, and every value encoded. Values above
+// the blob threshold are written to new blob files as they are replayed,
+// and the files of the values they replace are removed once the batch is
+// written.
+type keyspaceBatch struct {
+	ks      *keyspace
+	batch   *leveldb.Batch
+	created []string
+	stale   []string
+	blobs   map[string]string
+	err     error
+}
+
+// newKeyspaceBatch returns a batch replaying into the given batch for the
+// given keyspace.
+func newKeyspaceBatch(ks *keyspace, batch *leveldb.Batch) *keyspaceBatch {
+	return &keyspaceBatch{ks: ks, batch: batch}
+}
+
+// replay replays the given batch, returning the first error encoding
+// its values.
+func (kb *keyspaceBatch) replay(batch *leveldb.Batch) error {
+	if err := batch.Replay(kb); err != nil {
+		return err
+	}
+
+	return kb.err
+}
+
+// Put adds the given put to the batch.
+func (kb *keyspaceBatch) Put(key, value []byte) {
+	dbKey := kb.ks.key(key)
+	kb.replace(dbKey)
+
+	data, err := kb.ks.encodeValue(key, value)
+	if err == nil && kb.ks.blobs.spills(data) {
+		var name string
+		if name, err = kb.ks.blobs.write(dbKey, data); err == nil {
+			kb.created = append(kb.created, name)
+			kb.blobs[string(dbKey)] = name
+			data = kb.ks.seal(blobRef(name))
+		}
+	}
+	if err != nil {
+		kb.fail(err)
+		return
+	}
+
+	kb.batch.Put(dbKey, data)
+}
+
+// Delete adds the given delete to the batch.
+func (kb *keyspaceBatch) Delete(key []byte) {
+	dbKey := kb.ks.key(key)
+	kb.replace(dbKey)
+
+	kb.batch.Delete(dbKey)
+}
+
+// replace marks the blob file of the value the given database key holds
+// before this write for removal once the batch is written.
+func (kb *keyspaceBatch) replace(dbKey []byte) {
+	if kb.ks.blobs == nil {
+		return
+	}
+	if kb.blobs == nil {
+		kb.blobs = make(map[string]string)
+	}
+
+	// A key written earlier in the batch holds the value written then.
+	name, ok := kb.blobs[string(dbKey)]
+	if !ok {
+		var err error
+		if name, err = kb.ks.storedBlob(dbKey); err != nil {
+			kb.fail(err)
+			return
+		}
+	}
+	if name != "" {
+		kb.stale = append(kb.stale, name)
+	}
+	kb.blobs[string(dbKey)] = ""
+}
+
+// fail keeps the given error if it is the first one.
+func (kb *keyspaceBatch) fail(err error) {
+	if kb.err == nil {
+		kb.err = err
+	}
+}
+
+// write finishes the batch once it has been written with the given
+// result, retiring the blob files it replaced if it succeeded, or
+// removing the ones it created if it failed. The given result is returned.
+func (kb *keyspaceBatch) write(err error) error {
+	if err != nil {
+		kb.abort()
+		return err
+	}
+
+	kb.ks.blobs.retire(kb.stale)
+	return nil
+}
+
+// abort removes the blob files created by the batch when it is not
+// written.
+func (kb *keyspaceBatch) abort() {
+	kb.ks.blobs.remove(kb.created)
+}
+
+// keyspaceIterator strips the key prefix of a keyspace from the keys of a
+// database iterator, and decodes its values.
+type keyspaceIterator struct {
+	iterator.Iterator
+	ks  *keyspace
+	err error
+}
+
+// Key returns the key of the current entry.
+func (it *keyspaceIterator) Key() []byte {
+	key := it.Iterator.Key()
+	if key == nil {
+		return nil
+	}
+
+	return key[len(it.ks.prefix):]
+}
+
+// Seek moves the iterator to the first entry with a key at or after the
+// given key.
+func (it *keyspaceIterator) Seek(key []byte) bool {
+	return it.Iterator.Seek(it.ks.key(key))
+}
+
+// Value returns the value of the current entry. If it cannot be
+// decoded, nil is returned and the error is kept for Error.
+func (it *keyspaceIterator) Value() []byte {
+	value, err := it.ks.decodeValue(it.Key(), it.Iterator.Value())
+	if err != nil {
+		it.err = err
+		return nil
+	}
+
+	return value
+}
+
+// Error returns the error of the iterator, or else of the last value
+// that could not be decoded.
+func (it *keyspaceIterator) Error() error {
+	if err := it.Iterator.Error(); err != nil {
+		return err
+	}
+
+	return it.err
+}
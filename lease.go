@@ -0,0 +1,234 @@
+package goque
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LeaseToken identifies an item that has been handed out under a lease
+// and not yet acknowledged or returned.
+type LeaseToken uint64
+
+// lease holds the in-memory bookkeeping for an outstanding lease. The
+// item value itself is only kept in the database.
+type lease struct {
+	key      []byte
+	attempts uint32
+	deadline time.Time
+}
+
+// expired returns whether the lease has expired as of the given time.
+func (l *lease) expired(now time.Time) bool {
+	return !now.Before(l.deadline)
+}
+
+// errLeaseRecord is returned when a stored lease record cannot be
+// decoded.
+var errLeaseRecord = errors.New("goque: Invalid lease record")
+
+// encodeLease encodes a lease record, which holds the lease deadline,
+// the delivery attempts of the item, its original key and its value.
+func encodeLease(l *lease, value []byte) []byte {
+	rec := make([]byte, 12+binary.MaxVarintLen64, 12+binary.MaxVarintLen64+len(l.key)+len(value))
+	binary.BigEndian.PutUint64(rec, uint64(l.deadline.UnixNano()))
+	binary.BigEndian.PutUint32(rec[8:], l.attempts)
+	n := binary.PutUvarint(rec[12:], uint64(len(l.key)))
+	rec = rec[:12+n]
+	rec = append(rec, l.key...)
+	return append(rec, value...)
+}
+
+// decodeLease decodes a lease record, returning the lease and the
+// item value.
+func decodeLease(rec []byte) (*lease, []byte, error) {
+	if len(rec) < 13 {
+		return nil, nil, errLeaseRecord
+	}
+
+	deadline := int64(binary.BigEndian.Uint64(rec))
+	keyLen, n := binary.Uvarint(rec[12:])
+	if n <= 0 || uint64(len(rec)-12-n) < keyLen {
+		return nil, nil, errLeaseRecord
+	}
+
+	start := 12 + n
+	l := &lease{
+		key:      append([]byte{}, rec[start:start+int(keyLen)]...),
+		attempts: binary.BigEndian.Uint32(rec[8:]),
+		deadline: time.Unix(0, deadline),
+	}
+
+	return l, rec[start+int(keyLen):], nil
+}
+
+// leaseTable tracks the outstanding leases of a data structure. It is
+// not goroutine safe and relies on the lock of its owner.
+type leaseTable struct {
+	db     *keyspace
+	prefix []byte
+	leases map[LeaseToken]*lease
+	seq    uint64
+}
+
+// newLeaseTable creates a lease table for the given database, storing
+// its records under the given internal key prefix.
+func newLeaseTable(db *keyspace, prefix []byte) *leaseTable {
+	return &leaseTable{
+		db:     db,
+		prefix: prefix,
+		leases: make(map[LeaseToken]*lease),
+	}
+}
+
+// keyPrefix returns the key prefix for stored lease records.
+func (lt *leaseTable) keyPrefix() []byte {
+	return append(append([]byte{}, lt.prefix...), []byte("lease:")...)
+}
+
+// key generates the key of the lease record for the given token.
+func (lt *leaseTable) key(token LeaseToken) []byte {
+	return append(lt.keyPrefix(), idToKey(uint64(token))...)
+}
+
+// seqKey generates the key holding the last issued lease token.
+func (lt *leaseTable) seqKey() []byte {
+	return append(append([]byte{}, lt.prefix...), []byte("lease_seq")...)
+}
+
+// grant adds the deletion of the given item and the creation of its
+// lease record to the batch, returning the new lease token. The lease
+// only becomes active once commit is called after the batch has been
+// written.
+func (lt *leaseTable) grant(batch *leveldb.Batch, l *lease, value []byte) LeaseToken {
+	token := LeaseToken(lt.seq + 1)
+	batch.Delete(l.key)
+	batch.Put(lt.key(token), encodeLease(l, value))
+	batch.Put(lt.seqKey(), idToKey(uint64(token)))
+	return token
+}
+
+// commit activates a lease granted in a successfully written batch.
+func (lt *leaseTable) commit(token LeaseToken, l *lease) {
+	lt.seq = uint64(token)
+	lt.leases[token] = l
+}
+
+// get returns the lease for the given token, if it is still valid.
+func (lt *leaseTable) get(token LeaseToken) (*lease, error) {
+	l, ok := lt.leases[token]
+	if !ok || l.expired(time.Now()) {
+		return nil, ErrInvalidLease
+	}
+
+	return l, nil
+}
+
+// value reads the item value stored in the lease record of the given
+// token.
+func (lt *leaseTable) value(token LeaseToken) ([]byte, error) {
+	rec, err := lt.db.Get(lt.key(token), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, value, err := decodeLease(rec)
+	return value, err
+}
+
+// expired returns the tokens of all leases that have expired, in the
+// order they were granted.
+func (lt *leaseTable) expired() []LeaseToken {
+	now := time.Now()
+
+	var tokens []LeaseToken
+	for token, l := range lt.leases {
+		if l.expired(now) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	return tokens
+}
+
+// load reads all stored lease records into the table.
+func (lt *leaseTable) load() error {
+	// Get the last issued lease token.
+	seq, err := lt.db.Get(lt.seqKey(), nil)
+	if err == nil {
+		lt.seq = keyToID(seq)
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	// Load each outstanding lease.
+	prefix := lt.keyPrefix()
+	iter := lt.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		l, _, err := decodeLease(iter.Value())
+		if err != nil {
+			return err
+		}
+
+		lt.leases[LeaseToken(keyToID(iter.Key()[len(prefix):]))] = l
+	}
+
+	return iter.Error()
+}
+
+// expireAll marks every outstanding lease as expired. It is used when
+// opening a structure, since no holder of a lease from a previous
+// process can still acknowledge it.
+func (lt *leaseTable) expireAll() {
+	for _, l := range lt.leases {
+		l.deadline = time.Time{}
+	}
+}
+
+// release removes the lease for the given token from the table.
+func (lt *leaseTable) release(token LeaseToken) {
+	delete(lt.leases, token)
+}
+
+// reset clears the in-memory lease bookkeeping.
+func (lt *leaseTable) reset() {
+	lt.leases = make(map[LeaseToken]*lease)
+	lt.seq = 0
+}
+
+// nextDeadline returns the earliest deadline of all outstanding leases,
+// or the zero time if there are none.
+func (lt *leaseTable) nextDeadline() time.Time {
+	var next time.Time
+	for _, l := range lt.leases {
+		if next.IsZero() || l.deadline.Before(next) {
+			next = l.deadline
+		}
+	}
+
+	return next
+}
+
+// returnedBefore returns how many of the items at the head of a queue,
+// from the given head up to the given tail, were put back there after
+// being dequeued from an ID lower than the given one. The given map holds
+// the IDs items put back at the head were dequeued from, by their
+// current ID.
+func returnedBefore(returned map[uint64]uint64, head, tail, id uint64) uint64 {
+	var n uint64
+	for next := head + 1; next <= tail; next++ {
+		if from, ok := returned[next]; !ok || from >= id {
+			break
+		}
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,230 @@
+package goque
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// memoryEntryOverhead approximates the bookkeeping in bytes of a single
+// entry of the in-memory database.
+const memoryEntryOverhead = 48
+
+// memoryRebuildSize is the least number of bytes written to the
+// in-memory database before it is rebuilt to free deleted entries.
+const memoryRebuildSize = 1 << 20
+
+// memoryStorage is a Storage keeping its keys in memory only. The
+// in-memory database never frees deleted entries, so it is rebuilt with
+// only the live entries once the bytes written to it exceed twice their
+// size.
+type memoryStorage struct {
+	mu      sync.RWMutex
+	db      *memdb.DB
+	written int
+	isOpen  bool
+}
+
+// NewMemoryStorage returns a new Storage that keeps its keys in memory
+// only, which are lost once it is closed.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		db:     memdb.New(comparer.DefaultComparer, 0),
+		isOpen: true,
+	}
+}
+
+// Get gets the value for the given key.
+func (ms *memoryStorage) Get(key []byte) ([]byte, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return nil, leveldb.ErrClosed
+	}
+
+	return getMemDB(ms.db, key)
+}
+
+// Put sets the value for the given key.
+func (ms *memoryStorage) Put(key, value []byte, sync bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return leveldb.ErrClosed
+	}
+
+	ms.put(key, value)
+	ms.rebuild()
+
+	return nil
+}
+
+// Delete deletes the value for the given key.
+func (ms *memoryStorage) Delete(key []byte, sync bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return leveldb.ErrClosed
+	}
+
+	ms.delete(key)
+	ms.rebuild()
+
+	return nil
+}
+
+// Write applies the given batch as a single atomic write.
+func (ms *memoryStorage) Write(batch *leveldb.Batch, sync bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return leveldb.ErrClosed
+	}
+
+	if err := batch.Replay(&memoryBatch{ms: ms}); err != nil {
+		return err
+	}
+	ms.rebuild()
+
+	return nil
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole storage if it is nil.
+func (ms *memoryStorage) NewIterator(r *util.Range) iterator.Iterator {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return iterator.NewEmptyIterator(leveldb.ErrClosed)
+	}
+
+	return ms.db.NewIterator(r)
+}
+
+// Snapshot returns a copy of the storage. Taking it copies every key.
+func (ms *memoryStorage) Snapshot() (StorageSnapshot, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !ms.isOpen {
+		return nil, leveldb.ErrClosed
+	}
+
+	return &memorySnapshot{db: copyMemDB(ms.db)}, nil
+}
+
+// Compact does nothing, as deleted entries are freed as keys are written.
+func (ms *memoryStorage) Compact(r util.Range) error {
+	return nil
+}
+
+// Close discards the keys of the storage.
+func (ms *memoryStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.db = nil
+	ms.isOpen = false
+
+	return nil
+}
+
+// put sets the value for the given key.
+func (ms *memoryStorage) put(key, value []byte) {
+	ms.db.Put(key, value)
+	ms.written += len(key) + len(value) + memoryEntryOverhead
+}
+
+// delete deletes the value for the given key.
+func (ms *memoryStorage) delete(key []byte) {
+	ms.db.Delete(key)
+}
+
+// rebuild replaces the in-memory database with a copy holding only its
+// live entries, once enough has been written to it since it was last
+// rebuilt.
+func (ms *memoryStorage) rebuild() {
+	live := ms.db.Size() + ms.db.Len()*memoryEntryOverhead
+	if ms.written < memoryRebuildSize || ms.written < 2*live {
+		return
+	}
+
+	ms.db = copyMemDB(ms.db)
+	ms.written = live
+}
+
+// memoryBatch replays a batch into a memoryStorage.
+type memoryBatch struct {
+	ms *memoryStorage
+}
+
+// Put adds the given put to the storage.
+func (mb *memoryBatch) Put(key, value []byte) {
+	mb.ms.put(key, value)
+}
+
+// Delete adds the given delete to the storage.
+func (mb *memoryBatch) Delete(key []byte) {
+	mb.ms.delete(key)
+}
+
+// memorySnapshot is the StorageSnapshot of a memoryStorage.
+type memorySnapshot struct {
+	db *memdb.DB
+}
+
+// Get gets the value for the given key.
+func (ms *memorySnapshot) Get(key []byte) ([]byte, error) {
+	return getMemDB(ms.db, key)
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole snapshot if it is nil.
+func (ms *memorySnapshot) NewIterator(r *util.Range) iterator.Iterator {
+	return ms.db.NewIterator(r)
+}
+
+// Release does nothing, as the snapshot is freed once it is no longer
+// referenced.
+func (ms *memorySnapshot) Release() {}
+
+// getMemDB returns a copy of the value for the given key of an in-memory
+// database.
+func getMemDB(db *memdb.DB, key []byte) ([]byte, error) {
+	value, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+// copyMemDB returns a copy of an in-memory database holding only its live
+// entries.
+func copyMemDB(db *memdb.DB) *memdb.DB {
+	cp := memdb.New(comparer.DefaultComparer, db.Size())
+
+	iter := db.NewIterator(nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		cp.Put(iter.Key(), iter.Value())
+	}
+
+	return cp
+}
@@ -0,0 +1,260 @@
+package goque
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Source is a data structure items can be moved out of with Move. It is
+// implemented by *Stack, *Queue and *PriorityQueue.
+type Source interface {
+	sync.Locker
+	storage() *keyspace
+	takeNext() (*moveStep, error)
+}
+
+// Destination is a data structure items can be moved into with Move. It
+// is implemented by *Stack and *Queue.
+type Destination interface {
+	sync.Locker
+	storage() *keyspace
+	put(value []byte) (*moveStep, error)
+}
+
+// moveStep is the removal of an item from a data structure, or the
+// addition of one to it, as part of a move. The batch holds the writes of
+// the step, and commit updates the data structure once they are written.
+type moveStep struct {
+	item   *Item
+	batch  *leveldb.Batch
+	wo     *opt.WriteOptions
+	commit func()
+}
+
+// Move removes the next item from src and adds its value to dst as a
+// single atomic write, so the item can never be lost or duplicated by a
+// crash in between. The in-memory state of both data structures is only
+// updated once the write succeeds. It returns the item as added to dst,
+// whose delivery attempts start over.
+//
+// Both data structures must be different and share storage, which means
+// they were opened from the same Store. Otherwise ErrInvalidMove is
+// returned. If dst is full, ErrFull is returned without applying its
+// overflow policy.
+func Move(src Source, dst Destination) (*Item, error) {
+	// Check that both data structures share storage.
+	srcDB, dstDB := src.storage(), dst.storage()
+	if srcDB == nil || dstDB == nil || srcDB == dstDB || srcDB.db != dstDB.db {
+		return nil, ErrInvalidMove
+	}
+
+	// Lock both data structures in the order of their key prefixes, so
+	// concurrent moves between them in opposite directions cannot
+	// deadlock.
+	first, second := sync.Locker(src), sync.Locker(dst)
+	if bytes.Compare(srcDB.prefix, dstDB.prefix) > 0 {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	// Remove the next item from the source and add it to the destination.
+	from, err := src.takeNext()
+	if err != nil {
+		return nil, err
+	}
+	to, err := dst.put(from.item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write both as a single atomic write, syncing it if either data
+	// structure syncs every write.
+	wo := to.wo
+	if wo == nil {
+		wo = from.wo
+	}
+	if err := writeBatches(wo, srcDB, from.batch, dstDB, to.batch); err != nil {
+		return nil, err
+	}
+
+	// Update both data structures.
+	from.commit()
+	to.commit()
+
+	return to.item, nil
+}
+
+// storage returns the keyspace of the stack.
+func (s *Stack) storage() *keyspace {
+	return s.db
+}
+
+// takeNext prepares popping the next item in the stack.
+func (s *Stack) takeNext() (*moveStep, error) {
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Try to get the next item in the stack.
+	item, err := s.getItemByID(s.head)
+	if err != nil {
+		return nil, err
+	}
+
+	step := &moveStep{item: item, batch: new(leveldb.Batch), wo: s.sync.options()}
+	step.batch.Delete(item.Key)
+	s.cap.batch(step.batch, nil, 0, uint64(len(item.Value)))
+	step.commit = func() {
+		s.head--
+		s.compact.consumed(item.Key)
+		s.cap.removed(nil, uint64(len(item.Value)))
+	}
+
+	return step, nil
+}
+
+// put prepares pushing an item onto the stack.
+func (s *Stack) put(value []byte) (*moveStep, error) {
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if the item fits in the stack.
+	if !s.cap.fits(s.Length(), 1, uint64(len(value))) {
+		return nil, ErrFull
+	}
+
+	item := &Item{
+		ID:    s.head + 1,
+		Key:   idToKey(s.head + 1),
+		Value: value,
+	}
+
+	step := &moveStep{item: item, batch: new(leveldb.Batch), wo: s.sync.options()}
+	step.batch.Put(item.Key, item.Value)
+	s.cap.batch(step.batch, nil, uint64(len(value)), 0)
+	step.commit = func() {
+		s.head++
+		s.cap.added(nil, uint64(len(value)))
+		s.notify.broadcast()
+	}
+
+	return step, nil
+}
+
+// storage returns the keyspace of the queue.
+func (q *Queue) storage() *keyspace {
+	return q.db
+}
+
+// takeNext prepares dequeuing the next item in the queue.
+func (q *Queue) takeNext() (*moveStep, error) {
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Return any expired leases to the queue.
+	if err := q.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item in the queue.
+	item, err := q.getItemByID(q.head + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	step := &moveStep{item: item, batch: new(leveldb.Batch), wo: q.sync.options()}
+	step.batch.Delete(item.Key)
+	q.dead.setAttempts(step.batch, item.Key, 0)
+	q.cap.batch(step.batch, nil, 0, uint64(len(item.Value)))
+	step.commit = func() {
+		q.head++
+		q.compact.consumed(item.Key)
+		q.cap.removed(nil, uint64(len(item.Value)))
+	}
+
+	return step, nil
+}
+
+// put prepares enqueuing an item at the tail of the queue.
+func (q *Queue) put(value []byte) (*moveStep, error) {
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if the item fits in the queue.
+	if !q.cap.fits(q.Length(), 1, uint64(len(value))) {
+		return nil, ErrFull
+	}
+
+	item := &Item{
+		ID:    q.tail + 1,
+		Key:   idToKey(q.tail + 1),
+		Value: value,
+	}
+
+	step := &moveStep{item: item, batch: new(leveldb.Batch), wo: q.sync.options()}
+	step.batch.Put(item.Key, item.Value)
+	q.cap.batch(step.batch, nil, uint64(len(value)), 0)
+	step.commit = func() {
+		q.tail++
+		q.cap.added(nil, uint64(len(value)))
+		q.notify.broadcast()
+	}
+
+	return step, nil
+}
+
+// storage returns the keyspace of the priority queue.
+func (pq *PriorityQueue) storage() *keyspace {
+	return pq.db
+}
+
+// takeNext prepares dequeuing the next item in the priority queue.
+func (pq *PriorityQueue) takeNext() (*moveStep, error) {
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item.
+	pItem, err := pq.getNextItem()
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{
+		ID:       pItem.ID,
+		Key:      pItem.Key,
+		Value:    pItem.Value,
+		Attempts: pItem.Attempts,
+	}
+
+	step := &moveStep{item: item, batch: new(leveldb.Batch), wo: pq.sync.options()}
+	step.batch.Delete(item.Key)
+	pq.dead.setAttempts(step.batch, item.Key, 0)
+	pq.cap.batch(step.batch, []byte{pItem.Priority}, 0, uint64(len(item.Value)))
+	step.commit = func() {
+		pq.levels[pItem.Priority].head++
+		pq.compact.consumed(item.Key)
+		pq.cap.removed([]byte{pItem.Priority}, uint64(len(item.Value)))
+	}
+
+	return step, nil
+}
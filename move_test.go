@@ -0,0 +1,257 @@
+package goque
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMoveQueueToQueue(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	src, err := st.OpenQueue("src")
+	if err != nil {
+		t.Error(err)
+	}
+
+	dst, err := st.OpenQueue("dst")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, err = src.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, err := Move(src, dst)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if item.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+	}
+
+	if src.Length() != 2 {
+		t.Errorf("Expected source length of 2, got %d", src.Length())
+	}
+
+	if dst.Length() != 1 {
+		t.Errorf("Expected destination length of 1, got %d", dst.Length())
+	}
+
+	if src.SizeBytes() != 32 || dst.SizeBytes() != 16 {
+		t.Errorf("Expected sizes of 32 and 16 bytes, got %d and %d", src.SizeBytes(), dst.SizeBytes())
+	}
+
+	if err = st.Close(); err != nil {
+		t.Error(err)
+	}
+
+	st, err = OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	src, err = st.OpenQueue("src")
+	if err != nil {
+		t.Error(err)
+	}
+
+	dst, err = st.OpenQueue("dst")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if src.Length() != 2 || dst.Length() != 1 {
+		t.Errorf("Expected lengths of 2 and 1 after reopening, got %d and %d", src.Length(), dst.Length())
+	}
+
+	deqItem, err := dst.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	deqItem, err = src.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for item 2"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestMovePriorityQueueToStack(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	src, err := st.OpenPriorityQueue("src", ASC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	dst, err := st.OpenStack("dst")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if _, err = src.EnqueueString(uint8(i%2), fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = Move(src, dst); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if src.Length() != 2 || dst.Length() != 2 {
+		t.Errorf("Expected lengths of 2 and 2, got %d and %d", src.Length(), dst.Length())
+	}
+
+	if src.SizeBytesByPriority(0) != 0 {
+		t.Errorf("Expected priority 0 size of 0 bytes, got %d", src.SizeBytesByPriority(0))
+	}
+
+	popItem, err := dst.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 4"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+
+	deqItem, err := src.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestMoveFull(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	src, err := st.OpenStack("src")
+	if err != nil {
+		t.Error(err)
+	}
+
+	dst, err := st.OpenQueueWithOptions("dst", &Options{MaxItems: 1})
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if _, err = src.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = Move(src, dst); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Move(src, dst); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
+
+	if src.Length() != 1 || dst.Length() != 1 {
+		t.Errorf("Expected lengths of 1 and 1, got %d and %d", src.Length(), dst.Length())
+	}
+
+	peekItem, err := src.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	if _, err = Move(dst, src); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Move(dst, src); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+}
+
+func TestMoveInvalid(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	q, err := st.OpenQueue("queue")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Move(q, q); err != ErrInvalidMove {
+		t.Errorf("Expected to get invalid move error, got %v", err)
+	}
+
+	other := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(other)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	if _, err = Move(q, s); err != ErrInvalidMove {
+		t.Errorf("Expected to get invalid move error, got %v", err)
+	}
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	}
+}
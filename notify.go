@@ -0,0 +1,51 @@
+package goque
+
+import (
+	"context"
+	"time"
+)
+
+// notifier wakes goroutines waiting for items to be added to a data
+// structure. It is not goroutine safe and relies on the lock of its
+// owner.
+type notifier struct {
+	ch chan struct{}
+}
+
+// newNotifier creates a new notifier.
+func newNotifier() *notifier {
+	return &notifier{ch: make(chan struct{})}
+}
+
+// wait returns a channel that is closed the next time broadcast is
+// called.
+func (n *notifier) wait() <-chan struct{} {
+	return n.ch
+}
+
+// broadcast wakes every goroutine waiting on the notifier.
+func (n *notifier) broadcast() {
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// waitFor blocks until the given channel is closed, the context is done
+// or, if deadline is not zero, the deadline passes. It returns the
+// context error if the context is done first.
+func waitFor(ctx context.Context, ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ch:
+	case <-timeout:
+	}
+
+	return nil
+}
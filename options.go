@@ -0,0 +1,262 @@
+package goque
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// defaultSyncInterval is how often pending writes are synced when using
+// SyncPeriodic and no interval is set.
+const defaultSyncInterval = time.Second
+
+// durability defines when writes are synced to stable storage.
+type durability int
+
+// Defines the durability modes of a data structure.
+const (
+	NoSync         durability = iota // Leave syncing writes to the operating system.
+	SyncEveryWrite                   // Sync every write before it returns.
+	SyncPeriodic                     // Sync pending writes every SyncInterval.
+)
+
+// overflowPolicy defines what happens when items are added to a full data
+// structure.
+type overflowPolicy int
+
+// Defines the overflow policies of a data structure.
+const (
+	OverflowReject     overflowPolicy = iota // Return ErrFull.
+	OverflowDropNewest                       // Drop the new items.
+	OverflowDropOldest                       // Evict items at the head to make space.
+)
+
+// compression defines how item values are compressed.
+type compression int
+
+// Defines the value compression formats of a data structure.
+const (
+	CompressNone  compression = iota // Store values as they are.
+	CompressFlate                    // Compress values using compress/flate.
+	CompressGzip                     // Compress values using compress/gzip.
+)
+
+// Options holds the optional settings used when opening a data structure.
+// The zero value uses the LevelDB defaults and does not sync writes.
+type Options struct {
+	// WriteBuffer is the size in bytes of the LevelDB memtable, which is
+	// written to disk once full.
+	WriteBuffer int
+
+	// BlockCacheCapacity is the size in bytes of the LevelDB block cache.
+	BlockCacheCapacity int
+
+	// OpenFilesCacheCapacity is the number of table files LevelDB keeps
+	// open at once.
+	OpenFilesCacheCapacity int
+
+	// NoCompression disables the Snappy compression of LevelDB tables.
+	NoCompression bool
+
+	// Compression defines how the values stored by the data structure
+	// are compressed. Once a data structure has stored compressed values,
+	// it must keep being opened with compression enabled to read them.
+	Compression compression
+
+	// CompressionThreshold is the size in bytes at or above which values
+	// are compressed. It defaults to 512.
+	CompressionThreshold int
+
+	// EncryptionKeys holds the AES keys the values stored by the data
+	// structure are encrypted with, by their ID. Each key must be 16, 24
+	// or 32 bytes long, selecting AES-128, AES-192 or AES-256. Setting any
+	// key enables encryption.
+	EncryptionKeys map[uint32][]byte
+
+	// EncryptionKeyID is the ID of the key new values are encrypted
+	// with. Values encrypted with any of the other keys can still be read.
+	EncryptionKeyID uint32
+
+	// Checksums stores a CRC-32C checksum with every value stored by the
+	// data structure, which is verified each time the value is read. An
+	// item stored without a checksum is reported as corrupt.
+	Checksums bool
+
+	// AllowUnchecksummed reads items stored without a checksum, such as
+	// those stored before Checksums was enabled, without verifying them.
+	AllowUnchecksummed bool
+
+	// BlobThreshold is the size in bytes, as stored, above which values
+	// are written to separate blob files under the data directory, with
+	// only a reference to the file kept in LevelDB. Zero keeps every
+	// value in LevelDB. Once a data structure has stored values in blob
+	// files, it must keep being opened with a threshold set to read them.
+	BlobThreshold int
+
+	// Durability defines when writes are synced to stable storage.
+	Durability durability
+
+	// SyncInterval is how often pending writes are synced when using
+	// SyncPeriodic. It defaults to one second.
+	SyncInterval time.Duration
+
+	// MaxItems is the maximum number of items the data structure may
+	// hold. Zero means no limit.
+	MaxItems uint64
+
+	// MaxBytes is the maximum total size in bytes of the item values the
+	// data structure may hold. Zero means no limit.
+	MaxBytes uint64
+
+	// Overflow defines what happens when items are added to a Queue or
+	// PrefixQueue that is full. It is ignored by the other data
+	// structures.
+	Overflow overflowPolicy
+
+	// OnConsumeError is called with the error that stops the goroutine
+	// started by Consume, including a failure to put back the items that
+	// were dequeued but never received. Closing the data structure or
+	// cancelling the context is not reported.
+	OnConsumeError func(err error)
+
+	// OnDrop is called with each item dropped by the overflow policy. It
+	// is called once the data structure is unlocked, before the call that
+	// dropped the item returns and from the same goroutine, so it may call
+	// any of its methods. With GroupCommit, it is called by the Enqueue
+	// the item was dropped for.
+	OnDrop func(item *Item)
+
+	// CompactionThreshold is the number of items removed from a data
+	// structure after which the range of keys they were stored under is
+	// compacted in the background. Zero disables automatic compaction.
+	CompactionThreshold int
+
+	// GroupCommit gathers concurrent Queue enqueues into a single write,
+	// and a single sync when syncing every write. It is ignored by the
+	// other data structures.
+	GroupCommit bool
+
+	// GroupCommitSize is the maximum number of enqueues committed
+	// together. It defaults to 128.
+	GroupCommitSize int
+
+	// Codec encodes and decodes the values passed to the Value methods of
+	// the data structure. It defaults to GobCodec.
+	Codec Codec
+
+	// Reconcile rebuilds the stored size and queue bounds of a
+	// PrefixQueue from its items when it is opened, repairing data left
+	// inconsistent by a crash in versions that did not update it
+	// atomically. The items of a queue with missing IDs are renumbered to
+	// close the gaps, keeping their order. It is ignored by the other
+	// data structures.
+	Reconcile bool
+}
+
+// levelDBOptions returns the LevelDB options for the given options.
+func levelDBOptions(opts *Options) *opt.Options {
+	if opts == nil {
+		return nil
+	}
+
+	o := &opt.Options{
+		WriteBuffer:            opts.WriteBuffer,
+		BlockCacheCapacity:     opts.BlockCacheCapacity,
+		OpenFilesCacheCapacity: opts.OpenFilesCacheCapacity,
+	}
+	if opts.NoCompression {
+		o.Compression = opt.NoCompression
+	}
+
+	return o
+}
+
+// syncer applies the durability mode of a data structure to its writes.
+type syncer struct {
+	db      *keyspace
+	key     []byte
+	wo      *opt.WriteOptions
+	pending uint32
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newSyncer creates the syncer for the given database and options. When
+// syncing periodically, pending writes are synced by writing a marker
+// under the given internal key prefix.
+func newSyncer(db *keyspace, prefix []byte, opts *Options) *syncer {
+	s := &syncer{
+		db:  db,
+		key: append(append([]byte{}, prefix...), []byte("sync")...),
+	}
+
+	if opts == nil {
+		return s
+	}
+
+	switch opts.Durability {
+	case SyncEveryWrite:
+		s.wo = &opt.WriteOptions{Sync: true}
+	case SyncPeriodic:
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+
+		s.stop = make(chan struct{})
+		s.wg.Add(1)
+		go s.run(interval, s.stop)
+	}
+
+	return s
+}
+
+// options returns the write options to use for a write, marking it as
+// pending a sync.
+func (s *syncer) options() *opt.WriteOptions {
+	atomic.StoreUint32(&s.pending, 1)
+	return s.wo
+}
+
+// run syncs pending writes every interval until the given channel is
+// closed.
+func (s *syncer) run(interval time.Duration, stop <-chan struct{}) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.sync()
+		}
+	}
+}
+
+// sync syncs any pending writes to stable storage. A synced write also
+// syncs every write before it, so this writes a small marker record.
+func (s *syncer) sync() error {
+	if atomic.SwapUint32(&s.pending, 0) == 0 {
+		return nil
+	}
+
+	return s.db.Put(s.key, nil, &opt.WriteOptions{Sync: true})
+}
+
+// close stops syncing periodically and syncs any pending writes.
+func (s *syncer) close() error {
+	if s.stop == nil {
+		return nil
+	}
+
+	close(s.stop)
+	s.stop = nil
+	s.wg.Wait()
+
+	return s.sync()
+}
@@ -0,0 +1,86 @@
+package goque
+
+import (
+	"sync"
+)
+
+// overflow applies the overflow policy of a bounded data structure and
+// counts the items it drops. It relies on the lock of its owner, except
+// for passing the dropped items to the callback, which is done once the
+// owner is unlocked.
+type overflow struct {
+	policy  overflowPolicy
+	onDrop  func(item *Item)
+	dropped uint64
+	mu      sync.Mutex
+	pending []*Item
+}
+
+// newOverflow creates the overflow policy for the given options.
+func newOverflow(opts *Options) *overflow {
+	o := &overflow{}
+	if opts != nil {
+		o.policy = opts.Overflow
+		o.onDrop = opts.OnDrop
+	}
+
+	return o
+}
+
+// drop records that the given items were dropped, keeping them to be
+// passed to the callback by notify.
+func (o *overflow) drop(items []*Item) {
+	o.count(items)
+
+	if o.onDrop != nil && len(items) > 0 {
+		o.mu.Lock()
+		o.pending = append(o.pending, items...)
+		o.mu.Unlock()
+	}
+}
+
+// count records that the given items were dropped, leaving the caller to
+// pass them to the callback with pass.
+func (o *overflow) count(items []*Item) {
+	o.dropped += uint64(len(items))
+}
+
+// notify passes the items dropped so far to the callback. It must be
+// called once the lock of the owner is released, so the callback can use
+// the data structure.
+func (o *overflow) notify() {
+	if o.onDrop == nil {
+		return
+	}
+
+	o.mu.Lock()
+	items := o.pending
+	o.pending = nil
+	o.mu.Unlock()
+
+	o.pass(items)
+}
+
+// pass passes the given dropped items to the callback. Like notify, it
+// must be called once the lock of the owner is released.
+func (o *overflow) pass(items []*Item) {
+	if o.onDrop == nil {
+		return
+	}
+
+	for _, item := range items {
+		o.onDrop(item)
+	}
+}
+
+// dropValues drops the given values without adding them, returning them
+// as items with an ID of 0.
+func (o *overflow) dropValues(values [][]byte) []*Item {
+	items := make([]*Item, len(values))
+	for i, value := range values {
+		items[i] = &Item{Value: value}
+	}
+	o.drop(items)
+
+	return items
+}
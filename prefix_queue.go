@@ -2,14 +2,15 @@ package goque
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
-	"encoding/json"
-	"os"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // prefixDelimiter defines the delimiter used to separate a prefix from an
@@ -17,6 +18,10 @@ import (
 // a single byte, 0x00 (null), as the delimiter.
 const prefixDelimiter byte = '\x00'
 
+// prefixInternal is the key prefix of internal records kept alongside
+// the prefix queues, such as dead letters.
+var prefixInternal = []byte{prefixDelimiter, ':'}
+
 // queue defines the unique queue for a prefix.
 type queue struct {
 	Head uint64
@@ -32,47 +37,93 @@ func (q *queue) Length() uint64 {
 // each given prefix into its own queue.
 type PrefixQueue struct {
 	sync.RWMutex
-	DataDir string
-	db      *leveldb.DB
-	size    uint64
-	isOpen  bool
+	DataDir  string
+	db       *keyspace
+	codec    Codec
+	onError  func(err error)
+	size     uint64
+	sync     *syncer
+	compact  *compactor
+	cap      *capacity
+	overflow *overflow
+	dead     *deadLetters
+	corrupt  *quarantine
+	notify   *notifier
+	returned map[string]map[uint64]uint64
+	isOpen   bool
 }
 
 // OpenPrefixQueue opens a prefix queue if one exists at the given directory.
 // If one does not already exist, a new prefix queue is created.
 func OpenPrefixQueue(dataDir string) (*PrefixQueue, error) {
-	var err error
-
-	// Create a new Queue.
-	pq := &PrefixQueue{
-		DataDir: dataDir,
-		db:      &leveldb.DB{},
-		isOpen:  false,
-	}
+	return OpenPrefixQueueWithOptions(dataDir, nil)
+}
 
+// OpenPrefixQueueWithOptions opens a prefix queue like OpenPrefixQueue,
+// using the given options. If opts is nil, the default options are used.
+func OpenPrefixQueueWithOptions(dataDir string, opts *Options) (*PrefixQueue, error) {
 	// Open database for the prefix queue.
-	pq.db, err = leveldb.OpenFile(dataDir, nil)
+	db, err := openKeyspace(dataDir, goquePrefixQueue, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if this Goque type can open the requested data directory.
-	ok, err := checkGoqueType(dataDir, goquePrefixQueue)
-	if err != nil {
-		return nil, err
+	return openPrefixQueue(dataDir, db, opts)
+}
+
+// OpenPrefixQueueInMemory opens a new prefix queue that keeps its items in
+// memory only. They are lost once the prefix queue is closed.
+func OpenPrefixQueueInMemory() (*PrefixQueue, error) {
+	return OpenPrefixQueueWithStorage(NewMemoryStorage(), nil)
+}
+
+// OpenPrefixQueueWithStorage opens the prefix queue kept in the given
+// storage, using the given options. The prefix queue takes ownership of
+// the storage and closes it when the prefix queue is closed. The LevelDB
+// settings of the options are ignored.
+func OpenPrefixQueueWithStorage(storage Storage, opts *Options) (*PrefixQueue, error) {
+	return openPrefixQueue("", &keyspace{db: storage}, opts)
+}
+
+// openPrefixQueue opens the prefix queue stored in the given keyspace.
+func openPrefixQueue(dataDir string, db *keyspace, opts *Options) (*PrefixQueue, error) {
+	// Compress, encrypt and checksum the values of the data structure,
+	// and spill them to blob files, if enabled.
+	if err := db.setValueOptions(opts, isPrefixItemKey); err != nil {
+		db.Close()
+		return &PrefixQueue{DataDir: dataDir}, err
 	}
-	if !ok {
-		return nil, ErrIncompatibleType
+
+	// Create a new Queue.
+	pq := &PrefixQueue{
+		DataDir: dataDir,
+		db:      db,
+		codec:   codecOf(opts),
+		onError: consumeErrorOf(opts),
+		notify:  newNotifier(),
+		isOpen:  false,
 	}
+	pq.sync = newSyncer(pq.db, prefixInternal, opts)
+	pq.compact = newCompactor(pq.db, opts)
+	pq.cap = newCapacity(pq.db, prefixInternal, opts)
+	pq.overflow = newOverflow(opts)
+	pq.dead = newDeadLetters(pq.db, pq.sync, prefixInternal)
+	pq.corrupt = newQuarantine(pq.db, pq.sync, prefixInternal)
 
 	// Set isOpen and return.
 	pq.isOpen = true
-	return pq, pq.init()
+	return pq, pq.init(opts != nil && opts.Reconcile)
 }
 
 // Enqueue adds an item to the queue.
+//
+// If the prefix queue is full, its overflow policy decides whether
+// ErrFull is returned, the item is dropped and returned with an ID of 0,
+// or items are evicted from the head of the queue for the given prefix
+// to make space for it.
 func (pq *PrefixQueue) Enqueue(prefix, value []byte) (*Item, error) {
 	pq.Lock()
+	defer pq.overflow.notify()
 	defer pq.Unlock()
 
 	// Check if queue is closed.
@@ -80,39 +131,56 @@ func (pq *PrefixQueue) Enqueue(prefix, value []byte) (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Get the queue for this prefix.
-	q, err := pq.getOrCreateQueue(prefix)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create new Item.
-	item := &Item{
-		ID:    q.Tail + 1,
-		Key:   generateKeyPrefixID(prefix, q.Tail+1),
-		Value: value,
-	}
+	return pq.enqueue(prefix, value, pq.overflow.policy)
+}
 
-	// Add it to the queue.
-	if err := pq.db.Put(item.Key, item.Value, nil); err != nil {
-		return nil, err
+// EnqueueWait adds an item to the queue for the given prefix. If the
+// prefix queue is full, it blocks until enough items are removed to make
+// space for it, the given context is done or the prefix queue is closed.
+// The overflow policy is not applied.
+func (pq *PrefixQueue) EnqueueWait(ctx context.Context, prefix, value []byte) (*Item, error) {
+	for {
+		pq.Lock()
+
+		// Check if queue is closed.
+		if !pq.isOpen {
+			pq.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to enqueue the item. If it does not fit in an empty prefix
+		// queue, it never will.
+		item, err := pq.enqueue(prefix, value, OverflowReject)
+		if err != ErrFull || pq.size == 0 {
+			pq.Unlock()
+			return item, err
+		}
+
+		// Wait for space to be freed.
+		wait := pq.cap.wait()
+		pq.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	// Increment tail position and prefix queue size.
-	q.Tail++
-	pq.size++
-
-	// Save the queue.
-	if err := pq.saveQueue(prefix, q); err != nil {
-		return nil, err
-	}
+// EnqueueBatch adds the given values to the queue for the given prefix as
+// a single atomic write, along with the updated queue and prefix queue
+// size. Either every item is added or none are. If they do not fit in the
+// prefix queue, the overflow policy is applied to them together.
+func (pq *PrefixQueue) EnqueueBatch(prefix []byte, values [][]byte) ([]*Item, error) {
+	pq.Lock()
+	defer pq.overflow.notify()
+	defer pq.Unlock()
 
-	// Save main prefix queue data.
-	if err := pq.save(); err != nil {
-		return nil, err
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
 	}
 
-	return item, nil
+	return pq.enqueueBatch(prefix, values, pq.overflow.policy)
 }
 
 // EnqueueString is a helper function for Enqueue that accepts the prefix and
@@ -130,13 +198,12 @@ func (pq *PrefixQueue) EnqueueString(prefix, value string) (*Item, error) {
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (pq *PrefixQueue) EnqueueObject(prefix []byte, value interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(value); err != nil {
+	data, err := GobCodec.Encode(value)
+	if err != nil {
 		return nil, err
 	}
 
-	return pq.Enqueue(prefix, buffer.Bytes())
+	return pq.Enqueue(prefix, data)
 }
 
 // EnqueueObjectAsJSON is a helper function for Enqueue that accepts
@@ -145,12 +212,23 @@ func (pq *PrefixQueue) EnqueueObject(prefix []byte, value interface{}) (*Item, e
 //
 // Use this function to handle encoding of complex types.
 func (pq *PrefixQueue) EnqueueObjectAsJSON(prefix []byte, value interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(value)
+	data, err := JSONCodec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Enqueue(prefix, data)
+}
+
+// EnqueueValue is a helper function for Enqueue that accepts any value type,
+// which is then encoded into a byte slice using the codec of the prefix queue.
+func (pq *PrefixQueue) EnqueueValue(prefix []byte, value interface{}) (*Item, error) {
+	data, err := pq.codec.Encode(value)
 	if err != nil {
 		return nil, err
 	}
 
-	return pq.Enqueue(prefix, jsonBytes)
+	return pq.Enqueue(prefix, data)
 }
 
 // Dequeue removes the next item in the prefix queue and returns it.
@@ -163,44 +241,354 @@ func (pq *PrefixQueue) Dequeue(prefix []byte) (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
+	return pq.dequeue(prefix, nil)
+}
+
+// DequeueString is a helper function for Dequeue that accepts the prefix as a
+// string rather than a byte slice.
+func (pq *PrefixQueue) DequeueString(prefix string) (*Item, error) {
+	return pq.Dequeue([]byte(prefix))
+}
+
+// DequeueN removes up to n items from the head of the queue with the
+// given prefix and returns them. The items are read with a single
+// iterator and removed, along with the updated queue data, as a single
+// atomic write. If n is negative, every item in the queue is removed.
+func (pq *PrefixQueue) DequeueN(prefix []byte, n int) ([]*Item, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
 	// Get the queue for this prefix.
 	q, err := pq.getQueue(prefix)
 	if err != nil {
 		return nil, err
 	}
 
-	// Try to get the next item in the queue.
-	item, err := pq.getItemByPrefixID(prefix, q.Head+1)
+	// Check if queue is empty.
+	if q.Length() == 0 {
+		return nil, ErrEmpty
+	}
+
+	// Find how many items to remove.
+	count := q.Length()
+	if n >= 0 && uint64(n) < count {
+		count = uint64(n)
+	}
+
+	// Get the delivery attempts of the items.
+	start, limit := generateKeyPrefixID(prefix, q.Head+1), generateKeyPrefixID(prefix, q.Head+count+1)
+	attempts, err := pq.dead.attemptsRange(start, limit)
 	if err != nil {
 		return nil, err
 	}
 
-	// Remove this item from the queue.
-	if err := pq.db.Delete(item.Key, nil); err != nil {
+	// Get the items from the database.
+	iter := pq.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer iter.Release()
+
+	var items []*Item
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		items = append(items, &Item{
+			ID:       keyToID(key[len(key)-8:]),
+			Key:      key,
+			Value:    append([]byte{}, iter.Value()...),
+			Attempts: attempts[string(key)],
+		})
+
+		// Remove this item and its delivery attempts.
+		batch.Delete(key)
+		if attempts[string(key)] > 0 {
+			pq.dead.setAttempts(batch, key, 0)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// Add the updated queue and prefix queue size to the batch.
+	q.Head += uint64(len(items))
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
 		return nil, err
 	}
+	pq.batchSize(batch, pq.size-uint64(len(items)))
+	pq.cap.batch(batch, prefix, 0, itemsSize(items))
 
-	// Increment head position and decrement prefix queue size.
-	q.Head++
-	pq.size--
+	// Remove these items from the queue.
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Decrement prefix queue size.
+	pq.size -= uint64(len(items))
+	for _, item := range items {
+		pq.compact.consumed(item.Key)
+		pq.cap.removed(prefix, uint64(len(item.Value)))
+	}
+
+	return items, nil
+}
+
+// DequeueWait removes the next item in the given queue and returns it. If
+// the queue is empty, it blocks until an item is added to it, the given
+// context is done or the prefix queue is closed.
+func (pq *PrefixQueue) DequeueWait(ctx context.Context, prefix []byte) (*Item, error) {
+	for {
+		pq.Lock()
+
+		// Check if queue is closed.
+		if !pq.isOpen {
+			pq.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to dequeue the next item. A queue that has been emptied
+		// reports its head as out of bounds.
+		item, err := pq.dequeue(prefix, nil)
+		if err != ErrEmpty && err != ErrOutOfBounds {
+			pq.Unlock()
+			return item, err
+		}
+
+		// Wait for an item to be added.
+		wait := pq.notify.wait()
+		pq.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DequeueStringWait is a helper function for DequeueWait that accepts the
+// prefix as a string rather than a byte slice.
+func (pq *PrefixQueue) DequeueStringWait(ctx context.Context, prefix string) (*Item, error) {
+	return pq.DequeueWait(ctx, []byte(prefix))
+}
+
+// Fail reports that processing of the given item, which must have been
+// removed using Dequeue, has failed. The item is put back at the head of
+// the queue for its prefix with its delivery attempts incremented, or
+// moved to the dead letter list if it has failed more times than
+// allowed or the prefix queue is full.
+func (pq *PrefixQueue) Fail(item *Item) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.requeue(new(leveldb.Batch), item.Key, item.Value, item.Attempts)
+}
+
+// SetMaxAttempts sets the maximum number of failed delivery attempts
+// for an item before it is moved to the dead letter list. A value of 0,
+// the default, means items are never moved to the dead letter list.
+func (pq *PrefixQueue) SetMaxAttempts(max uint32) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	pq.dead.maxAttempts = max
+}
+
+// DeadLetters returns every item in the dead letter list of the prefix
+// queue.
+func (pq *PrefixQueue) DeadLetters() ([]*DeadLetter, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dead.list()
+}
+
+// PeekDeadLetter returns the item with the given ID from the dead letter
+// list without removing it.
+func (pq *PrefixQueue) PeekDeadLetter(id uint64) (*DeadLetter, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dead.get(id)
+}
+
+// RequeueDeadLetter moves the item with the given ID from the dead
+// letter list to the tail of the queue for its original prefix,
+// resetting its delivery attempts.
+func (pq *PrefixQueue) RequeueDeadLetter(id uint64) (*Item, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
 
-	// Save the queue.
-	if err := pq.saveQueue(prefix, q); err != nil {
+	// Get the dead letter.
+	dl, err := pq.dead.get(id)
+	if err != nil {
 		return nil, err
 	}
 
-	// Save main prefix queue data.
-	if err := pq.save(); err != nil {
+	// Check if the item fits in the prefix queue.
+	if !pq.cap.fits(pq.size, 1, uint64(len(dl.Value))) {
+		return nil, ErrFull
+	}
+
+	// Get the queue for the original prefix.
+	prefix := keyPrefix(dl.Key)
+	q, err := pq.getOrCreateQueue(prefix)
+	if err != nil {
 		return nil, err
 	}
 
+	// Create new Item.
+	item := &Item{
+		ID:    q.Tail + 1,
+		Key:   generateKeyPrefixID(prefix, q.Tail+1),
+		Value: dl.Value,
+	}
+
+	// Move it from the dead letter list to the queue, along with the
+	// updated queue and prefix queue size.
+	batch := new(leveldb.Batch)
+	pq.dead.remove(batch, id)
+	batch.Put(item.Key, item.Value)
+	q.Tail++
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
+		return nil, err
+	}
+	pq.batchSize(batch, pq.size+1)
+	pq.cap.batch(batch, prefix, uint64(len(item.Value)), 0)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+	pq.dead.commitRemove()
+
+	// Increment prefix queue size.
+	pq.size++
+	pq.cap.added(prefix, uint64(len(item.Value)))
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
 	return item, nil
 }
 
-// DequeueString is a helper function for Dequeue that accepts the prefix as a
-// string rather than a byte slice.
-func (pq *PrefixQueue) DequeueString(prefix string) (*Item, error) {
-	return pq.Dequeue([]byte(prefix))
+// DeleteDeadLetter removes the item with the given ID from the dead
+// letter list.
+func (pq *PrefixQueue) DeleteDeadLetter(id uint64) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the dead letter exists.
+	if _, err := pq.dead.get(id); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	pq.dead.remove(batch, id)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+	pq.dead.commitRemove()
+
+	return nil
+}
+
+// PurgeDeadLetters removes every item from the dead letter list.
+func (pq *PrefixQueue) PurgeDeadLetters() error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.dead.purge()
+}
+
+// DeadLetterLength returns the total number of items in the dead letter
+// list.
+func (pq *PrefixQueue) DeadLetterLength() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.dead.length
+}
+
+// Consume returns a channel that is fed items from the head of the queue
+// for the given prefix by a background goroutine as they become
+// available, holding up to bufferSize items that have been dequeued but
+// not yet received.
+//
+// The channel is closed once the given context is done, the prefix queue
+// is closed or an error occurs. When the context is done, any items that
+// were dequeued but not received are put back at the head of the queue.
+// When the prefix queue is closed, items still buffered in the channel
+// can be received after it is closed.
+//
+// The error that stops the goroutine, or that prevents the items from
+// being put back, is passed to the OnConsumeError callback of the
+// options, if any.
+func (pq *PrefixQueue) Consume(ctx context.Context, prefix []byte, bufferSize int) <-chan *Item {
+	ch := make(chan *Item, bufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			item, err := pq.DequeueWait(ctx, prefix)
+			if err == nil {
+				select {
+				case ch <- item:
+					continue
+				case <-ctx.Done():
+				}
+			}
+
+			// Put back the items that were dequeued but never received
+			// once the context is done, whether it was noticed while
+			// waiting for an item or while sending one.
+			if ctx.Err() != nil {
+				if items := drainItems(ch, item); len(items) > 0 {
+					reportConsumeError(pq.onError, pq.restore(prefix, items))
+				}
+			} else if err != ErrDBClosed {
+				reportConsumeError(pq.onError, err)
+			}
+			return
+		}
+	}()
+
+	return ch
+}
+
+// ConsumeString is a helper function for Consume that accepts the prefix
+// as a string rather than a byte slice.
+func (pq *PrefixQueue) ConsumeString(ctx context.Context, prefix string, bufferSize int) <-chan *Item {
+	return pq.Consume(ctx, []byte(prefix), bufferSize)
 }
 
 // Peek returns the next item in the given queue without removing it.
@@ -275,10 +663,25 @@ func (pq *PrefixQueue) Update(prefix []byte, id uint64, newValue []byte) (*Item,
 		Value: newValue,
 	}
 
+	// Check if the new value fits in the prefix queue.
+	oldValue, err := pq.db.Get(item.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	oldSize := uint64(len(oldValue))
+	if uint64(len(newValue)) > oldSize && !pq.cap.fits(0, 0, uint64(len(newValue))-oldSize) {
+		return nil, ErrFull
+	}
+
 	// Update this item in the queue.
-	if err := pq.db.Put(item.Key, item.Value, nil); err != nil {
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	pq.cap.batch(batch, prefix, uint64(len(newValue)), oldSize)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
 		return nil, err
 	}
+	pq.cap.removed(prefix, oldSize)
+	pq.cap.added(prefix, uint64(len(newValue)))
 
 	return item, nil
 }
@@ -298,12 +701,12 @@ func (pq *PrefixQueue) UpdateString(prefix string, id uint64, value string) (*It
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (pq *PrefixQueue) UpdateObject(prefix []byte, id uint64, newValue interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(newValue); err != nil {
+	data, err := GobCodec.Encode(newValue)
+	if err != nil {
 		return nil, err
 	}
-	return pq.Update(prefix, id, buffer.Bytes())
+
+	return pq.Update(prefix, id, data)
 }
 
 // UpdateObjectAsJSON is a helper function for Update that accepts
@@ -312,12 +715,39 @@ func (pq *PrefixQueue) UpdateObject(prefix []byte, id uint64, newValue interface
 //
 // Use this function to handle encoding of complex types.
 func (pq *PrefixQueue) UpdateObjectAsJSON(prefix []byte, id uint64, newValue interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(newValue)
+	data, err := JSONCodec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Update(prefix, id, data)
+}
+
+// UpdateValue is a helper function for Update that accepts any value
+// type, which is then encoded into a byte slice using the codec of the
+// prefix queue.
+func (pq *PrefixQueue) UpdateValue(prefix []byte, id uint64, newValue interface{}) (*Item, error) {
+	data, err := pq.codec.Encode(newValue)
 	if err != nil {
 		return nil, err
 	}
 
-	return pq.Update(prefix, id, jsonBytes)
+	return pq.Update(prefix, id, data)
+}
+
+// DecodeValue decodes the value of the given item into the value pointed
+// to by value, using the codec of the prefix queue.
+func (pq *PrefixQueue) DecodeValue(item *Item, value interface{}) error {
+	return pq.codec.Decode(item.Value, value)
+}
+
+// Dropped returns the number of items dropped by the overflow policy
+// since the prefix queue was opened.
+func (pq *PrefixQueue) Dropped() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.overflow.dropped
 }
 
 // Length returns the total number of items in the prefix queue.
@@ -325,6 +755,168 @@ func (pq *PrefixQueue) Length() uint64 {
 	return pq.size
 }
 
+// SizeBytes returns the total size in bytes of the item values in the
+// prefix queue.
+func (pq *PrefixQueue) SizeBytes() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.cap.bytes
+}
+
+// SizeBytesByPrefix returns the total size in bytes of the item values in
+// the queue for the given prefix.
+func (pq *PrefixQueue) SizeBytesByPrefix(prefix []byte) uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.cap.size(prefix)
+}
+
+// Quarantine removes the corrupt item reported by the given error from
+// the prefix queue without reading its value, keeping the data it was
+// stored as in the quarantine list. Only the item at the head of the
+// queue for its prefix can be quarantined, otherwise ErrOutOfBounds is
+// returned.
+func (pq *PrefixQueue) Quarantine(corruption *ErrCorrupt) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Get the queue for the prefix of the item.
+	key := corruption.Key
+	if !isPrefixItemKey(key) {
+		return ErrOutOfBounds
+	}
+	prefix := keyPrefix(key)
+	q, err := pq.getQueue(prefix)
+	if err == ErrEmpty {
+		return ErrOutOfBounds
+	} else if err != nil {
+		return err
+	}
+
+	// Check if the item is at the head of the queue.
+	if q.Head >= q.Tail || !bytes.Equal(key, generateKeyPrefixID(prefix, q.Head+1)) {
+		return ErrOutOfBounds
+	}
+
+	// Move the item to the quarantine list and remove its delivery
+	// attempts, along with the updated queue and prefix queue size.
+	batch := new(leveldb.Batch)
+	data, err := pq.corrupt.take(batch, key)
+	if err != nil {
+		return err
+	}
+	pq.dead.setAttempts(batch, key, 0)
+	q.Head++
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
+		return err
+	}
+	pq.batchSize(batch, pq.size-1)
+	pq.cap.batch(batch, prefix, 0, uint64(len(data)))
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+
+	// Decrement prefix queue size. The size of the item is estimated from
+	// the data it was stored as.
+	pq.size--
+	pq.compact.consumed(key)
+	pq.cap.removed(prefix, uint64(len(data)))
+
+	return nil
+}
+
+// Quarantined returns the items removed from the prefix queue by
+// Quarantine, holding the data they were stored as.
+func (pq *PrefixQueue) Quarantined() ([]*Item, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.corrupt.list()
+}
+
+// PurgeQuarantined deletes every item in the quarantine list.
+func (pq *PrefixQueue) PurgeQuarantined() error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.corrupt.purge()
+}
+
+// Verify deletes the blob files of the prefix queue that no item or record
+// refers to, which can be left behind by a crash while writing or
+// removing an item, and returns their paths. It does nothing unless blob
+// files are enabled.
+func (pq *PrefixQueue) Verify() ([]string, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.db.verify()
+}
+
+// Reencrypt rewrites every value of the prefix queue that is not encrypted
+// with the current encryption key, so the keys it was encrypted with
+// before can be retired. ErrNoEncryption is returned if the prefix queue was
+// opened without encryption keys.
+func (pq *PrefixQueue) Reencrypt() error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.db.reencrypt(pq.sync.options())
+}
+
+// CompressionStats returns the statistics of the values compressed by
+// the prefix queue since it was opened.
+func (pq *PrefixQueue) CompressionStats() CompressionStats {
+	return pq.db.comp.stats()
+}
+
+// Compact compacts the whole LevelDB database of the prefix queue,
+// reclaiming the space of removed items and speeding up iteration over
+// the keys they left behind.
+func (pq *PrefixQueue) Compact() error {
+	pq.RLock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		pq.RUnlock()
+		return ErrDBClosed
+	}
+
+	// Register the compaction so closing waits for it.
+	done := pq.compact.begin()
+	pq.RUnlock()
+	defer done()
+
+	return pq.compact.compact()
+}
+
 // Close closes the LevelDB database of the prefix queue.
 func (pq *PrefixQueue) Close() error {
 	pq.Lock()
@@ -335,25 +927,211 @@ func (pq *PrefixQueue) Close() error {
 		return nil
 	}
 
+	// Stop compacting and sync any pending writes.
+	pq.compact.close()
+	if err := pq.sync.close(); err != nil {
+		return err
+	}
+
 	// Close the LevelDB database.
 	if err := pq.db.Close(); err != nil {
 		return err
 	}
 
-	// Reset size and set isOpen to false.
+	// Reset size and dead letters and set isOpen to false.
 	pq.size = 0
+	pq.dead.reset()
+	pq.returned = nil
 	pq.isOpen = false
 
+	// Wake any goroutines waiting for an item or for space.
+	pq.notify.broadcast()
+	pq.cap.reset()
+
 	return nil
 }
 
-// Drop closes and deletes the LevelDB database of the prefix queue.
+// Drop closes and deletes the LevelDB database of the prefix queue, or only its
+// keys if it is hosted by a Store.
 func (pq *PrefixQueue) Drop() error {
 	if err := pq.Close(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(pq.DataDir)
+	return pq.db.drop()
+}
+
+// enqueue adds an item to the queue for the given prefix, applying the
+// given overflow policy if it does not fit.
+func (pq *PrefixQueue) enqueue(prefix, value []byte, policy overflowPolicy) (*Item, error) {
+	items, err := pq.enqueueBatch(prefix, [][]byte{value}, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+// enqueueBatch adds the given values to the queue for the given prefix as
+// a single atomic write, along with the updated queue and prefix queue
+// size, applying the given overflow policy if they do not fit.
+func (pq *PrefixQueue) enqueueBatch(prefix []byte, values [][]byte, policy overflowPolicy) ([]*Item, error) {
+	// Get the queue for this prefix.
+	q, err := pq.getOrCreateQueue(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := new(leveldb.Batch)
+
+	// Check if the items fit in the prefix queue.
+	var evicted []*Item
+	size := valuesSize(values)
+	if !pq.cap.fits(pq.size, uint64(len(values)), size) {
+		switch policy {
+		case OverflowDropNewest:
+			return pq.overflow.dropValues(values), nil
+		case OverflowDropOldest:
+			if evicted, err = pq.evict(batch, prefix, q, uint64(len(values)), size); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrFull
+		}
+	}
+
+	// Create new Items and add them to the batch.
+	items := make([]*Item, len(values))
+	for i, value := range values {
+		id := q.Tail + uint64(i) + 1
+		items[i] = &Item{
+			ID:    id,
+			Key:   generateKeyPrefixID(prefix, id),
+			Value: value,
+		}
+		batch.Put(items[i].Key, items[i].Value)
+	}
+
+	// Add the updated queue and prefix queue size to the batch.
+	q.Head += uint64(len(evicted))
+	q.Tail += uint64(len(items))
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
+		return nil, err
+	}
+	pq.batchSize(batch, pq.size-uint64(len(evicted))+uint64(len(items)))
+	pq.cap.batch(batch, prefix, size, itemsSize(evicted))
+
+	// Add them to the queue.
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Update prefix queue size.
+	pq.size -= uint64(len(evicted))
+	for _, item := range evicted {
+		pq.compact.consumed(item.Key)
+		pq.cap.removed(prefix, uint64(len(item.Value)))
+	}
+	pq.overflow.drop(evicted)
+
+	pq.size += uint64(len(items))
+	pq.cap.added(prefix, size)
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
+	return items, nil
+}
+
+// evict adds the removal of the items at the head of the given queue that
+// must be evicted for n items holding the given number of bytes to fit to
+// the batch, and returns them. It returns ErrFull if the items would not
+// fit even once every item of the queue has been evicted.
+func (pq *PrefixQueue) evict(batch *leveldb.Batch, prefix []byte, q *queue, n, size uint64) ([]*Item, error) {
+	if !pq.cap.fitsWhenEmpty(n, size) {
+		return nil, ErrFull
+	}
+
+	var items []*Item
+	var freed uint64
+	for !pq.cap.fitsAfterRemoving(pq.size, n, size, uint64(len(items)), freed) {
+		id := q.Head + uint64(len(items)) + 1
+		if id > q.Tail {
+			return nil, ErrFull
+		}
+
+		item, err := pq.getItemByPrefixID(prefix, id)
+		if err != nil {
+			return nil, err
+		}
+
+		batch.Delete(item.Key)
+		pq.dead.setAttempts(batch, item.Key, 0)
+		items = append(items, item)
+		freed += uint64(len(item.Value))
+	}
+
+	return items, nil
+}
+
+// dequeueChecked removes the next item in the given queue like Dequeue,
+// unless the given function returns an error for its value, in which
+// case the item is kept and returned along with the error.
+func (pq *PrefixQueue) dequeueChecked(prefix []byte, check func(value []byte) error) (*Item, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dequeue(prefix, check)
+}
+
+// dequeue removes the next item in the given queue and returns it, unless
+// the given function is not nil and returns an error for its value.
+func (pq *PrefixQueue) dequeue(prefix []byte, check func(value []byte) error) (*Item, error) {
+	// Get the queue for this prefix.
+	q, err := pq.getQueue(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item in the queue.
+	item, err := pq.getItemByPrefixID(prefix, q.Head+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the item if the given function rejects its value.
+	if check != nil {
+		if err := check(item.Value); err != nil {
+			return item, err
+		}
+	}
+
+	// Remove this item and its delivery attempts from the queue, along
+	// with the updated queue and prefix queue size.
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	pq.dead.setAttempts(batch, item.Key, 0)
+	q.Head++
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
+		return nil, err
+	}
+	pq.batchSize(batch, pq.size-1)
+	pq.cap.batch(batch, prefix, 0, uint64(len(item.Value)))
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Decrement prefix queue size.
+	pq.size--
+	pq.compact.consumed(item.Key)
+	pq.cap.removed(prefix, uint64(len(item.Value)))
+
+	return item, nil
 }
 
 // getQueue gets the unique queue for the given prefix.
@@ -391,8 +1169,9 @@ func (pq *PrefixQueue) getOrCreateQueue(prefix []byte) (*queue, error) {
 	return q, dec.Decode(q)
 }
 
-// savePrefixQueue saves the given queue for the given prefix.
-func (pq *PrefixQueue) saveQueue(prefix []byte, q *queue) error {
+// batchQueue adds saving the given queue for the given prefix to the
+// batch.
+func (pq *PrefixQueue) batchQueue(batch *leveldb.Batch, prefix []byte, q *queue) error {
 	// Encode the queue using gob.
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
@@ -400,15 +1179,16 @@ func (pq *PrefixQueue) saveQueue(prefix []byte, q *queue) error {
 		return err
 	}
 
-	// Save it to the database.
-	return pq.db.Put(generateKeyPrefixData(prefix), buffer.Bytes(), nil)
+	batch.Put(generateKeyPrefixData(prefix), buffer.Bytes())
+	return nil
 }
 
-// save saves the main prefix queue data.
-func (pq *PrefixQueue) save() error {
+// batchSize adds saving the main prefix queue data with the given size
+// to the batch.
+func (pq *PrefixQueue) batchSize(batch *leveldb.Batch, size uint64) {
 	val := make([]byte, 8)
-	binary.BigEndian.PutUint64(val, pq.size)
-	return pq.db.Put(pq.getDataKey(), val, nil)
+	binary.BigEndian.PutUint64(val, size)
+	batch.Put(pq.getDataKey(), val)
 }
 
 // getDataKey generates the main prefix queue data key.
@@ -446,11 +1226,158 @@ func (pq *PrefixQueue) getItemByPrefixID(prefix []byte, id uint64) (*Item, error
 		return nil, err
 	}
 
+	// Get its delivery attempts.
+	if item.Attempts, err = pq.dead.attempts(item.Key); err != nil {
+		return nil, err
+	}
+
 	return item, nil
 }
 
-// init initializes the prefix queue data.
-func (pq *PrefixQueue) init() error {
+// requeue puts the given item back at the head of the queue for its
+// prefix with its delivery attempts incremented, after any operations
+// already in the batch have been written along with it. If the item has
+// failed more times than allowed, or no longer fits in the prefix queue,
+// it is moved to the dead letter list instead.
+func (pq *PrefixQueue) requeue(batch *leveldb.Batch, key, value []byte, attempts uint32) error {
+	attempts++
+
+	// Move the item to the dead letter list.
+	if pq.dead.exceeded(attempts) || !pq.cap.fits(pq.size, 1, uint64(len(value))) {
+		id := pq.dead.add(batch, key, value, attempts)
+		if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+			return err
+		}
+		pq.dead.commitAdd(id)
+
+		return nil
+	}
+
+	return pq.putBack(batch, key, value, attempts)
+}
+
+// putBack adds the given item value that was dequeued from the given key
+// back at the head of the queue for its prefix with the given delivery
+// attempts, after any operations already in the batch have been written
+// along with it. The item is added after the items put back there that
+// were dequeued before it. If nothing has been dequeued from the queue,
+// it is added to the tail.
+func (pq *PrefixQueue) putBack(batch *leveldb.Batch, key, value []byte, attempts uint32) error {
+	// Get the queue for this prefix.
+	prefix := keyPrefix(key)
+	q, err := pq.getOrCreateQueue(prefix)
+	if err != nil {
+		return err
+	}
+
+	// Find the position for the item, moving the items that go before
+	// it down to make room.
+	from := keyToID(key[len(key)-8:])
+	returned := pq.returned[string(prefix)]
+
+	head := q.Head
+	atHead := head > 0
+	id := q.Tail + 1
+	if atHead {
+		id = head + returnedBefore(returned, head, q.Tail, from)
+
+		for next := head + 1; next <= id; next++ {
+			item, err := pq.getItemByPrefixID(prefix, next)
+			if err != nil {
+				return err
+			}
+			batch.Put(generateKeyPrefixID(prefix, next-1), item.Value)
+			pq.dead.setAttempts(batch, generateKeyPrefixID(prefix, next-1), item.Attempts)
+		}
+	}
+
+	// Update head or tail position.
+	if atHead {
+		q.Head--
+	} else {
+		q.Tail++
+	}
+
+	// Add the item and its delivery attempts to the queue, along with the
+	// updated queue and prefix queue size.
+	newKey := generateKeyPrefixID(prefix, id)
+	batch.Put(newKey, value)
+	pq.dead.setAttempts(batch, newKey, attempts)
+	if err := pq.batchQueue(batch, prefix, q); err != nil {
+		return err
+	}
+	pq.batchSize(batch, pq.size+1)
+	pq.cap.batch(batch, prefix, uint64(len(value)), 0)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+
+	// Record where the items at the head of the queue were dequeued
+	// from.
+	if atHead {
+		if returned == nil {
+			returned = make(map[uint64]uint64)
+			if pq.returned == nil {
+				pq.returned = make(map[string]map[uint64]uint64)
+			}
+			pq.returned[string(prefix)] = returned
+		}
+		for next := head; next < id; next++ {
+			returned[next] = returned[next+1]
+		}
+		returned[id] = from
+	} else {
+		delete(returned, id)
+	}
+
+	// Increment prefix queue size.
+	pq.size++
+	pq.cap.added(prefix, uint64(len(value)))
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
+	return nil
+}
+
+// restore puts the given dequeued items back at the head of the queue for
+// the given prefix, where the first item becomes the new head, without
+// changing their delivery attempts.
+func (pq *PrefixQueue) restore(prefix []byte, items []*Item) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := pq.putBack(new(leveldb.Batch), items[i].Key, items[i].Value, items[i].Attempts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// init initializes the prefix queue data, reconciling it with the stored
+// items if requested.
+func (pq *PrefixQueue) init(reconcile bool) error {
+	// Load the dead letter list.
+	if err := pq.dead.load(); err != nil {
+		return err
+	}
+
+	// Load the size of the stored items.
+	if err := pq.cap.load(nil, isPrefixItemKey, keyPrefix, reconcile); err != nil {
+		return err
+	}
+
+	if reconcile {
+		return pq.reconcile()
+	}
+
 	// Get the main prefix queue data.
 	val, err := pq.db.Get(pq.getDataKey(), nil)
 	if err == errors.ErrNotFound {
@@ -463,16 +1390,151 @@ func (pq *PrefixQueue) init() error {
 	return nil
 }
 
+// reconcile rebuilds the main prefix queue data and the queue for every
+// prefix from the item keys that exist in the database, saving them as a
+// single atomic write. The items of a queue with missing IDs are moved up
+// to its highest ID, so its length is the number of items it holds.
+func (pq *PrefixQueue) reconcile() error {
+	// bounds holds the lowest and highest item IDs found for a prefix,
+	// and the number of items found.
+	type bounds struct {
+		min, max, count uint64
+	}
+
+	stored := make(map[string]*queue)
+	found := make(map[string]*bounds)
+
+	iter := pq.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	var size uint64
+	for iter.Next() {
+		key := iter.Key()
+
+		switch {
+		// Skip internal records.
+		case bytes.HasPrefix(key, prefixInternal):
+
+		// Track the bounds of the items for each prefix.
+		case isPrefixItemKey(key):
+			prefix, id := string(key[:len(key)-9]), keyToID(key[len(key)-8:])
+			if b, ok := found[prefix]; !ok {
+				found[prefix] = &bounds{min: id, max: id, count: 1}
+			} else {
+				if id < b.min {
+					b.min = id
+				} else if id > b.max {
+					b.max = id
+				}
+				b.count++
+			}
+			size++
+
+		// Decode the stored queue for each prefix.
+		case bytes.HasSuffix(key, []byte(":data")):
+			q := &queue{}
+			dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+			if err := dec.Decode(q); err != nil {
+				return err
+			}
+			stored[string(key[:len(key)-5])] = q
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// Empty queues keep their tail so item IDs are not reused.
+	batch := new(leveldb.Batch)
+	for prefix, q := range stored {
+		if _, ok := found[prefix]; !ok {
+			if err := pq.batchQueue(batch, []byte(prefix), &queue{Head: q.Tail, Tail: q.Tail}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Queues with items end at their highest item, holding as many IDs
+	// as they have items.
+	for prefix, b := range found {
+		if b.count < b.max-b.min+1 {
+			if err := pq.renumber(batch, []byte(prefix), b.max); err != nil {
+				return err
+			}
+		}
+		if err := pq.batchQueue(batch, []byte(prefix), &queue{Head: b.max - b.count, Tail: b.max}); err != nil {
+			return err
+		}
+	}
+	pq.batchSize(batch, size)
+
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+
+	pq.size = size
+	return nil
+}
+
+// renumber adds the moves of the items of the queue for the given prefix
+// to consecutive IDs ending at the given highest ID to the batch, keeping
+// their order and delivery attempts. Every old key is deleted before the
+// new keys are written, as they may overlap.
+func (pq *PrefixQueue) renumber(batch *leveldb.Batch, prefix []byte, max uint64) error {
+	start, limit := generateKeyPrefixID(prefix, 0), generateKeyPrefixID(prefix, max+1)
+	attempts, err := pq.dead.attemptsRange(start, limit)
+	if err != nil {
+		return err
+	}
+
+	iter := pq.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer iter.Release()
+
+	var keys, values [][]byte
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+		values = append(values, append([]byte{}, iter.Value()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		batch.Delete(key)
+		pq.dead.setAttempts(batch, key, 0)
+	}
+	for i, key := range keys {
+		newKey := generateKeyPrefixID(prefix, max-uint64(len(keys)-1-i))
+		batch.Put(newKey, values[i])
+		pq.dead.setAttempts(batch, newKey, attempts[string(key)])
+	}
+
+	return nil
+}
+
 // generateKeyPrefixData generates a data key using the given prefix. This key
 // should be used to get the stored queue struct for the given prefix.
 func generateKeyPrefixData(prefix []byte) []byte {
-	return append(prefix, []byte(":data")...)
+	return append(append([]byte{}, prefix...), []byte(":data")...)
+}
+
+// keyPrefix returns a copy of the prefix of a key generated by
+// generateKeyPrefixID.
+func keyPrefix(key []byte) []byte {
+	return append([]byte{}, key[:len(key)-9]...)
+}
+
+// isPrefixItemKey returns whether the given key was generated by
+// generateKeyPrefixID.
+func isPrefixItemKey(key []byte) bool {
+	return !bytes.HasPrefix(key, prefixInternal) && len(key) >= 9 && key[len(key)-9] == prefixDelimiter
 }
 
 // generateKeyPrefixID generates a key using the given prefix and ID.
 func generateKeyPrefixID(prefix []byte, id uint64) []byte {
-	// Handle the prefix.
-	key := append(prefix, prefixDelimiter)
+	// Handle the prefix, copying it so keys never share the
+	// backing array of the given prefix.
+	key := append(append([]byte{}, prefix...), prefixDelimiter)
 
 	// Handle the item ID.
 	key = append(key, idToKey(id)...)
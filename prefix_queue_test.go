@@ -1,6 +1,7 @@
 package goque
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -52,6 +53,242 @@ func TestPrefixQueueDrop(t *testing.T) {
 	}
 }
 
+func TestPrefixQueueOpenWithOptions(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueueWithOptions(file, &Options{Durability: SyncEveryWrite})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString("prefix", "value"); err != nil {
+		t.Error(err)
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{Reconcile: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Close()
+
+	if pq.Length() != 1 {
+		t.Errorf("Expected prefix queue length of 1, got %d", pq.Length())
+	}
+}
+
+func TestPrefixQueueCompact(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueueWithOptions(file, &Options{CompactionThreshold: 10})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 30; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 20; i++ {
+		if _, err = pq.DequeueString("prefix"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = pq.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != "value for item 21" {
+		t.Errorf("Expected string to be 'value for item 21', got '%s'", deqItem.ToString())
+	}
+}
+
+func TestPrefixQueueMaxBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueueWithOptions(file, &Options{MaxBytes: 10})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString("prefix1", "12345"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("prefix2", "12345"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("prefix1", "1"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{MaxBytes: 10})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("prefix1", "1"); err != ErrFull {
+		t.Errorf("Expected to get full error after reopening, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.DequeueString("prefix2")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = pq.EnqueueWait(ctx, []byte("prefix1"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", pq.Length())
+	}
+}
+
+func TestPrefixQueueOverflowDropOldest(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueueWithOptions(file, &Options{MaxItems: 3, Overflow: OverflowDropOldest})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString("prefix1", "value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if _, err = pq.EnqueueString("prefix2", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if pq.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", pq.Length())
+	}
+
+	if pq.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped items, got %d", pq.Dropped())
+	}
+
+	deqItem, err := pq.DequeueString("prefix2")
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 3"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	if _, err = pq.EnqueueString("prefix3", "value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("prefix3", "value for item 2"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("prefix4", "value for item 1"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
+
+	peekItem, err := pq.PeekString("prefix3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for item 2"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{Reconcile: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if pq.Length() != 3 {
+		t.Errorf("Expected queue length of 3 after reconciling, got %d", pq.Length())
+	}
+}
+
+func TestPrefixQueueSizeBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = pq.EnqueueString("prefix1", "0123456789"); err != nil {
+			t.Error(err)
+		}
+		if _, err = pq.EnqueueString("prefix2", "01234"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = pq.DequeueString("prefix1"); err != nil {
+		t.Error(err)
+	}
+
+	// Close the database without closing the prefix queue, as if the
+	// process had crashed.
+	if err = pq.db.Close(); err != nil {
+		t.Error(err)
+	}
+	pq.isOpen = false
+
+	pq, err = OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if pq.SizeBytes() != 140 {
+		t.Errorf("Expected size of 140 bytes, got %d", pq.SizeBytes())
+	}
+
+	if pq.SizeBytesByPrefix([]byte("prefix1")) != 90 {
+		t.Errorf("Expected size of 90 bytes for prefix1, got %d", pq.SizeBytesByPrefix([]byte("prefix1")))
+	}
+
+	if pq.SizeBytesByPrefix([]byte("prefix2")) != 50 {
+		t.Errorf("Expected size of 50 bytes for prefix2, got %d", pq.SizeBytesByPrefix([]byte("prefix2")))
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{Reconcile: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if pq.SizeBytesByPrefix([]byte("prefix1")) != 90 {
+		t.Errorf("Expected size of 90 bytes for prefix1 after reconciling, got %d", pq.SizeBytesByPrefix([]byte("prefix1")))
+	}
+}
+
 func TestPrefixQueueIncompatibleType(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	prq, err := OpenPriorityQueue(file, ASC)
@@ -85,6 +322,48 @@ func TestPrefixQueueEnqueue(t *testing.T) {
 	}
 }
 
+func TestPrefixQueueEnqueueBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	values := [][]byte{[]byte("value for item 1"), []byte("value for item 2")}
+	items, err := pq.EnqueueBatch([]byte("prefix"), values)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 2 || items[0].ID != 1 || items[1].ID != 2 {
+		t.Errorf("Expected items with IDs 1 and 2, got %v", items)
+	}
+
+	pq.Close()
+	if pq, err = OpenPrefixQueue(file); err != nil {
+		t.Error(err)
+	}
+	defer pq.Close()
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", pq.Length())
+	}
+
+	for i := 1; i <= 2; i++ {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
 func TestPrefixQueueDequeue(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	pq, err := OpenPrefixQueue(file)
@@ -119,6 +398,192 @@ func TestPrefixQueueDequeue(t *testing.T) {
 	}
 }
 
+func TestPrefixQueueDequeueN(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = pq.EnqueueString("other", "value for other item"); err != nil {
+		t.Error(err)
+	}
+
+	items, err := pq.DequeueN([]byte("prefix"), 2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(items))
+	}
+
+	for i, item := range items {
+		compStr := fmt.Sprintf("value for item %d", i+1)
+
+		if item.ID != uint64(i+1) || item.ToString() != compStr {
+			t.Errorf("Expected item %d with string '%s', got item %d with '%s'", i+1, compStr, item.ID, item.ToString())
+		}
+	}
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected prefix queue length of 2, got %d", pq.Length())
+	}
+
+	items, err = pq.DequeueN([]byte("prefix"), 10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 1 || items[0].ToString() != "value for item 3" {
+		t.Errorf("Expected the remaining item, got %v", items)
+	}
+
+	if _, err = pq.DequeueN([]byte("prefix"), 1); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+
+	if _, err = pq.DequeueN([]byte("missing"), 1); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+
+	deqItem, err := pq.DequeueString("other")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != "value for other item" {
+		t.Errorf("Expected string to be 'value for other item', got '%s'", deqItem.ToString())
+	}
+}
+
+func TestPrefixQueueReconcile(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = pq.DequeueString("prefix"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.EnqueueString("other", "value for other item"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.DequeueString("other"); err != nil {
+		t.Error(err)
+	}
+
+	// Simulate a crash that wrote an item without updating the queue data,
+	// and a crash that removed an item without updating it.
+	if err = pq.db.Put(generateKeyPrefixID([]byte("prefix"), 4), []byte("value for item 4"), nil); err != nil {
+		t.Error(err)
+	}
+	if err = pq.db.Delete(generateKeyPrefixID([]byte("prefix"), 2), nil); err != nil {
+		t.Error(err)
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{Reconcile: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected prefix queue length of 2, got %d", pq.Length())
+	}
+
+	for i := 3; i <= 4; i++ {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ID != uint64(i) || deqItem.ToString() != compStr {
+			t.Errorf("Expected item %d with string '%s', got item %d with '%s'", i, compStr, deqItem.ID, deqItem.ToString())
+		}
+	}
+
+	item, err := pq.EnqueueString("other", "value for new item")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if item.ID != 2 {
+		t.Errorf("Expected new item ID of 2, got %d", item.ID)
+	}
+}
+
+func TestPrefixQueueReconcileMissingItems(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Simulate crashes that removed items from the middle of the queue
+	// without updating the queue data.
+	for _, id := range []uint64{2, 4} {
+		if err = pq.db.Delete(generateKeyPrefixID([]byte("prefix"), id), nil); err != nil {
+			t.Error(err)
+		}
+	}
+
+	pq.Close()
+
+	pq, err = OpenPrefixQueueWithOptions(file, &Options{Reconcile: true})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if pq.Length() != 3 {
+		t.Errorf("Expected prefix queue length of 3, got %d", pq.Length())
+	}
+
+	for _, i := range []int{1, 3, 5} {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+
+	if _, err = pq.DequeueString("prefix"); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+}
+
 func TestPrefixQueueEncodeDecodePointerJSON(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	pq, err := OpenPrefixQueue(file)
@@ -538,6 +1003,230 @@ func TestPrefixQueueOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestPrefixQueueFail(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = pq.Fail(deqItem); err != nil {
+		t.Error(err)
+	}
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", pq.Length())
+	}
+
+	peekItem, err := pq.PeekString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != deqItem.ToString() {
+		t.Errorf("Expected string to be '%s', got '%s'", deqItem.ToString(), peekItem.ToString())
+	}
+
+	if peekItem.Attempts != 1 {
+		t.Errorf("Expected item attempts of 1, got %d", peekItem.Attempts)
+	}
+}
+
+func TestPrefixQueueFailOrder(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 4; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var items []*Item
+	for i := 1; i <= 3; i++ {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+		items = append(items, deqItem)
+	}
+
+	// Failed items keep the order they were dequeued in, whatever order
+	// they fail in.
+	for _, i := range []int{0, 2, 1} {
+		if err = pq.Fail(items[i]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestPrefixQueueDeadLetter(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	pq.SetMaxAttempts(1)
+
+	if _, err = pq.EnqueueString("prefix", "value"); err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		deqItem, err := pq.DequeueString("prefix")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if err = pq.Fail(deqItem); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if pq.Length() != 0 {
+		t.Errorf("Expected queue length of 0, got %d", pq.Length())
+	}
+
+	letters, err := pq.DeadLetters()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(letters) != 1 || letters[0].ToString() != "value" {
+		t.Fatalf("Expected one dead letter 'value', got %v", letters)
+	}
+
+	if _, err = pq.RequeueDeadLetter(letters[0].ID); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.ToString() != "value" {
+		t.Errorf("Expected string to be 'value', got '%s'", deqItem.ToString())
+	}
+}
+
+func TestPrefixQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString("prefix", "value"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.DequeueString("prefix"); err != nil {
+		t.Error(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.EnqueueString("other", "other value")
+		pq.EnqueueString("prefix", "value for item")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deqItem, err := pq.DequeueStringWait(ctx, "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compStr := "value for item"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Close()
+	}()
+
+	if _, err = pq.DequeueStringWait(ctx, "prefix"); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestPrefixQueueConsume(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = pq.EnqueueString("other", "other value"); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := pq.ConsumeString(ctx, "prefix", 1)
+
+	item := <-ch
+
+	compStr := "value for item 1"
+
+	if item.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+	}
+
+	received := 1
+	cancel()
+	for range ch {
+		received++
+	}
+
+	if pq.Length() != uint64(4-received) {
+		t.Errorf("Expected queue length of %d, got %d", 4-received, pq.Length())
+	}
+}
+
 func BenchmarkPrefixQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
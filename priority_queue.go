@@ -2,10 +2,9 @@ package goque
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/json"
-	"os"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -24,10 +23,12 @@ const (
 )
 
 // priorityLevel holds the head and tail position of a priority
-// level within the queue.
+// level within the queue, and the IDs the items put back at its head
+// were dequeued from, by their current ID.
 type priorityLevel struct {
-	head uint64
-	tail uint64
+	head     uint64
+	tail     uint64
+	returned map[uint64]uint64
 }
 
 // length returns the total number of items in this priority level.
@@ -40,10 +41,19 @@ func (pl *priorityLevel) length() uint64 {
 type PriorityQueue struct {
 	sync.RWMutex
 	DataDir  string
-	db       *leveldb.DB
+	db       *keyspace
+	codec    Codec
+	onError  func(err error)
 	order    order
 	levels   [256]*priorityLevel
 	curLevel uint8
+	sync     *syncer
+	compact  *compactor
+	cap      *capacity
+	leases   *leaseTable
+	dead     *deadLetters
+	corrupt  *quarantine
+	notify   *notifier
 	isOpen   bool
 }
 
@@ -51,30 +61,61 @@ type PriorityQueue struct {
 // directory. If one does not already exist, a new priority queue is
 // created.
 func OpenPriorityQueue(dataDir string, order order) (*PriorityQueue, error) {
-	var err error
-
-	// Create a new PriorityQueue.
-	pq := &PriorityQueue{
-		DataDir: dataDir,
-		db:      &leveldb.DB{},
-		order:   order,
-		isOpen:  false,
-	}
+	return OpenPriorityQueueWithOptions(dataDir, order, nil)
+}
 
+// OpenPriorityQueueWithOptions opens a priority queue like
+// OpenPriorityQueue, using the given options. If opts is nil, the
+// default options are used.
+func OpenPriorityQueueWithOptions(dataDir string, order order, opts *Options) (*PriorityQueue, error) {
 	// Open database for the priority queue.
-	pq.db, err = leveldb.OpenFile(dataDir, nil)
+	db, err := openKeyspace(dataDir, goquePriorityQueue, opts)
 	if err != nil {
-		return pq, err
+		return &PriorityQueue{DataDir: dataDir, order: order}, err
 	}
 
-	// Check if this Goque type can open the requested data directory.
-	ok, err := checkGoqueType(dataDir, goquePriorityQueue)
-	if err != nil {
-		return pq, err
+	return openPriorityQueue(dataDir, db, order, opts)
+}
+
+// OpenPriorityQueueInMemory opens a new priority queue that keeps its
+// items in memory only. They are lost once the priority queue is closed.
+func OpenPriorityQueueInMemory(order order) (*PriorityQueue, error) {
+	return OpenPriorityQueueWithStorage(NewMemoryStorage(), order, nil)
+}
+
+// OpenPriorityQueueWithStorage opens the priority queue kept in the given
+// storage, using the given options. The priority queue takes ownership of
+// the storage and closes it when the priority queue is closed. The LevelDB
+// settings of the options are ignored.
+func OpenPriorityQueueWithStorage(storage Storage, order order, opts *Options) (*PriorityQueue, error) {
+	return openPriorityQueue("", &keyspace{db: storage}, order, opts)
+}
+
+// openPriorityQueue opens the priority queue stored in the given keyspace.
+func openPriorityQueue(dataDir string, db *keyspace, order order, opts *Options) (*PriorityQueue, error) {
+	// Compress, encrypt and checksum the values of the data structure,
+	// and spill them to blob files, if enabled.
+	if err := db.setValueOptions(opts, isItemKey); err != nil {
+		db.Close()
+		return &PriorityQueue{DataDir: dataDir}, err
 	}
-	if !ok {
-		return pq, ErrIncompatibleType
+
+	// Create a new PriorityQueue.
+	pq := &PriorityQueue{
+		DataDir: dataDir,
+		db:      db,
+		codec:   codecOf(opts),
+		onError: consumeErrorOf(opts),
+		order:   order,
+		notify:  newNotifier(),
+		isOpen:  false,
 	}
+	pq.sync = newSyncer(pq.db, internalPrefix, opts)
+	pq.compact = newCompactor(pq.db, opts)
+	pq.cap = newCapacity(pq.db, internalPrefix, opts)
+	pq.leases = newLeaseTable(pq.db, internalPrefix)
+	pq.dead = newDeadLetters(pq.db, pq.sync, internalPrefix)
+	pq.corrupt = newQuarantine(pq.db, pq.sync, internalPrefix)
 
 	// Set isOpen and return.
 	pq.isOpen = true
@@ -91,31 +132,93 @@ func (pq *PriorityQueue) Enqueue(priority uint8, value []byte) (*PriorityItem, e
 		return nil, ErrDBClosed
 	}
 
+	return pq.enqueue(priority, value)
+}
+
+// EnqueueWait adds an item to the priority queue. If the priority queue
+// is full, it blocks until enough items are removed to make space for
+// it, the given context is done or the priority queue is closed.
+func (pq *PriorityQueue) EnqueueWait(ctx context.Context, priority uint8, value []byte) (*PriorityItem, error) {
+	for {
+		pq.Lock()
+
+		// Check if queue is closed.
+		if !pq.isOpen {
+			pq.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to enqueue the item. If it does not fit in an empty
+		// priority queue, it never will.
+		item, err := pq.enqueue(priority, value)
+		if err != ErrFull || pq.length() == 0 {
+			pq.Unlock()
+			return item, err
+		}
+
+		// Wait for space to be freed.
+		wait := pq.cap.wait()
+		pq.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// EnqueueBatch adds the given values to the given priority level as a
+// single atomic write. Either every item is added or none are.
+func (pq *PriorityQueue) EnqueueBatch(priority uint8, values [][]byte) ([]*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if the items fit in the priority queue.
+	size := valuesSize(values)
+	if !pq.cap.fits(pq.length(), uint64(len(values)), size) {
+		return nil, ErrFull
+	}
+
 	// Get the priorityLevel.
 	level := pq.levels[priority]
 
-	// Create new PriorityItem.
-	item := &PriorityItem{
-		ID:       level.tail + 1,
-		Priority: priority,
-		Key:      pq.generateKey(priority, level.tail+1),
-		Value:    value,
+	// Create new PriorityItems and add them to the batch.
+	items := make([]*PriorityItem, len(values))
+	batch := new(leveldb.Batch)
+	for i, value := range values {
+		id := level.tail + uint64(i) + 1
+		items[i] = &PriorityItem{
+			ID:       id,
+			Priority: priority,
+			Key:      pq.generateKey(priority, id),
+			Value:    value,
+		}
+		batch.Put(items[i].Key, items[i].Value)
 	}
+	pq.cap.batch(batch, []byte{priority}, size, 0)
 
-	// Add it to the priority queue.
-	if err := pq.db.Put(item.Key, item.Value, nil); err != nil {
+	// Add them to the priority queue.
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
 		return nil, err
 	}
 
 	// Increment tail position.
-	level.tail++
+	level.tail += uint64(len(items))
+	pq.cap.added([]byte{priority}, size)
 
 	// If this priority level is more important than the curLevel.
-	if pq.cmpAsc(priority) || pq.cmpDesc(priority) {
+	if len(items) > 0 && (pq.cmpAsc(priority) || pq.cmpDesc(priority)) {
 		pq.curLevel = priority
 	}
 
-	return item, nil
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
+	return items, nil
 }
 
 // EnqueueString is a helper function for Enqueue that accepts a
@@ -133,13 +236,12 @@ func (pq *PriorityQueue) EnqueueString(priority uint8, value string) (*PriorityI
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (pq *PriorityQueue) EnqueueObject(priority uint8, value interface{}) (*PriorityItem, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(value); err != nil {
+	data, err := GobCodec.Encode(value)
+	if err != nil {
 		return nil, err
 	}
 
-	return pq.Enqueue(priority, buffer.Bytes())
+	return pq.Enqueue(priority, data)
 }
 
 // EnqueueObjectAsJSON is a helper function for Enqueue that accepts
@@ -148,12 +250,23 @@ func (pq *PriorityQueue) EnqueueObject(priority uint8, value interface{}) (*Prio
 //
 // Use this function to handle encoding of complex types.
 func (pq *PriorityQueue) EnqueueObjectAsJSON(priority uint8, value interface{}) (*PriorityItem, error) {
-	jsonBytes, err := json.Marshal(value)
+	data, err := JSONCodec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Enqueue(priority, data)
+}
+
+// EnqueueValue is a helper function for Enqueue that accepts any value type,
+// which is then encoded into a byte slice using the codec of the priority queue.
+func (pq *PriorityQueue) EnqueueValue(priority uint8, value interface{}) (*PriorityItem, error) {
+	data, err := pq.codec.Encode(value)
 	if err != nil {
 		return nil, err
 	}
 
-	return pq.Enqueue(priority, jsonBytes)
+	return pq.Enqueue(priority, data)
 }
 
 // Dequeue removes the next item in the priority queue and returns it.
@@ -166,26 +279,97 @@ func (pq *PriorityQueue) Dequeue() (*PriorityItem, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Try to get the next item.
-	item, err := pq.getNextItem()
+	return pq.dequeue(nil)
+}
+
+// DequeueWait removes the next item in the priority queue and returns
+// it. If the priority queue is empty, it blocks until an item is added,
+// the given context is done or the priority queue is closed.
+func (pq *PriorityQueue) DequeueWait(ctx context.Context) (*PriorityItem, error) {
+	for {
+		pq.Lock()
+
+		// Check if queue is closed.
+		if !pq.isOpen {
+			pq.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to dequeue the next item.
+		item, err := pq.dequeue(nil)
+		if err != ErrEmpty {
+			pq.Unlock()
+			return item, err
+		}
+
+		// Wait for an item to be added or a lease to expire.
+		wait, deadline := pq.notify.wait(), pq.leases.nextDeadline()
+		pq.Unlock()
+
+		if err := waitFor(ctx, wait, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DequeueByPriority removes the next item in the given priority level
+// and returns it.
+func (pq *PriorityQueue) DequeueByPriority(priority uint8) (*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dequeueByPriority(priority, nil)
+}
+
+// dequeueByPriority removes the next item in the given priority level
+// and returns it, unless the given function is not nil and returns an
+// error for its value.
+func (pq *PriorityQueue) dequeueByPriority(priority uint8, check func(value []byte) error) (*PriorityItem, error) {
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item in the given priority level.
+	item, err := pq.getItemByPriorityID(priority, pq.levels[priority].head+1)
 	if err != nil {
 		return nil, err
 	}
 
-	// Remove this item from the priority queue.
-	if err = pq.db.Delete(item.Key, nil); err != nil {
+	// Keep the item if the given function rejects its value.
+	if check != nil {
+		if err := check(item.Value); err != nil {
+			return item, err
+		}
+	}
+
+	// Remove this item and its delivery attempts from the priority queue.
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	pq.dead.setAttempts(batch, item.Key, 0)
+	pq.cap.batch(batch, []byte{item.Priority}, 0, uint64(len(item.Value)))
+	if err = pq.db.Write(batch, pq.sync.options()); err != nil {
 		return nil, err
 	}
 
 	// Increment head position.
-	pq.levels[pq.curLevel].head++
+	pq.levels[priority].head++
+	pq.compact.consumed(item.Key)
+	pq.cap.removed([]byte{priority}, uint64(len(item.Value)))
 
 	return item, nil
 }
 
-// DequeueByPriority removes the next item in the given priority level
-// and returns it.
-func (pq *PriorityQueue) DequeueByPriority(priority uint8) (*PriorityItem, error) {
+// DequeueN removes up to n items from the priority queue, following the
+// priority order across levels, and returns them. The items are read with
+// a single iterator and removed as a single atomic write. If n is
+// negative, every item in the priority queue is removed.
+func (pq *PriorityQueue) DequeueN(n int) ([]*PriorityItem, error) {
 	pq.Lock()
 	defer pq.Unlock()
 
@@ -194,23 +378,434 @@ func (pq *PriorityQueue) DequeueByPriority(priority uint8) (*PriorityItem, error
 		return nil, ErrDBClosed
 	}
 
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Check if queue is empty.
+	if pq.length() == 0 {
+		return nil, ErrEmpty
+	}
+
+	// Find how many items to remove.
+	remaining := pq.length()
+	if n >= 0 && uint64(n) < remaining {
+		remaining = uint64(n)
+	}
+
+	iter := pq.db.NewIterator(itemRange(), nil)
+	defer iter.Release()
+
+	// Get the items from each priority level in order.
+	var items []*PriorityItem
+	var removed, sizes [256]uint64
+	batch := new(leveldb.Batch)
+	for i := 0; i <= 255 && remaining > 0; i++ {
+		priority := uint8(i)
+		if pq.order == DESC {
+			priority = uint8(255 - i)
+		}
+
+		level := pq.levels[priority]
+		count := level.length()
+		if count == 0 {
+			continue
+		} else if count > remaining {
+			count = remaining
+		}
+
+		// Get the delivery attempts of the items in this level.
+		start, limit := pq.generateKey(priority, level.head+1), pq.generateKey(priority, level.head+count+1)
+		attempts, err := pq.dead.attemptsRange(start, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		ok := iter.Seek(start)
+		for ; ok && removed[priority] < count; ok = iter.Next() {
+			key := append([]byte{}, iter.Key()...)
+			items = append(items, &PriorityItem{
+				ID:       keyToID(key[2:]),
+				Priority: priority,
+				Key:      key,
+				Value:    append([]byte{}, iter.Value()...),
+				Attempts: attempts[string(key)],
+			})
+
+			// Remove this item and its delivery attempts.
+			batch.Delete(key)
+			if attempts[string(key)] > 0 {
+				pq.dead.setAttempts(batch, key, 0)
+			}
+			removed[priority]++
+			sizes[priority] += uint64(len(iter.Value()))
+		}
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+
+		remaining -= removed[priority]
+	}
+
+	// Add the sizes of the priority levels items were removed from to the
+	// batch.
+	var size uint64
+	for i, s := range sizes {
+		if removed[i] > 0 {
+			pq.cap.batchGroup(batch, []byte{uint8(i)}, 0, s)
+			size += s
+		}
+	}
+	pq.cap.batchTotal(batch, 0, size)
+
+	// Remove these items from the priority queue.
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment head positions.
+	for i, count := range removed {
+		pq.levels[uint8(i)].head += count
+	}
+	for _, item := range items {
+		pq.compact.consumed(item.Key)
+		pq.cap.removed([]byte{item.Priority}, uint64(len(item.Value)))
+	}
+
+	return items, nil
+}
+
+// Consume returns a channel that is fed items from the priority queue,
+// in priority order, by a background goroutine as they become available,
+// holding up to bufferSize items that have been dequeued but not yet
+// received.
+//
+// The channel is closed once the given context is done, the priority
+// queue is closed or an error occurs. When the context is done, any
+// items that were dequeued but not received are put back at the head of
+// their priority levels. When the priority queue is closed, items still
+// buffered in the channel can be received after it is closed.
+//
+// The error that stops the goroutine, or that prevents the items from
+// being put back, is passed to the OnConsumeError callback of the
+// options, if any.
+func (pq *PriorityQueue) Consume(ctx context.Context, bufferSize int) <-chan *PriorityItem {
+	ch := make(chan *PriorityItem, bufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			item, err := pq.DequeueWait(ctx)
+			if err == nil {
+				select {
+				case ch <- item:
+					continue
+				case <-ctx.Done():
+				}
+			}
+
+			// Put back the items that were dequeued but never received
+			// once the context is done, whether it was noticed while
+			// waiting for an item or while sending one.
+			if ctx.Err() != nil {
+				if items := drainPriorityItems(ch, item); len(items) > 0 {
+					reportConsumeError(pq.onError, pq.restore(items))
+				}
+			} else if err != ErrDBClosed {
+				reportConsumeError(pq.onError, err)
+			}
+			return
+		}
+	}()
+
+	return ch
+}
+
+// DequeueLease removes the next item in the priority queue and returns
+// it along with a lease token. The item is kept in the database until
+// the lease is acknowledged using Ack. If the lease is returned using
+// Nack, or is not acknowledged before the given timeout, the item is put
+// back into its original priority level at its original position ahead
+// of every item enqueued after it, unless it has failed more times than
+// allowed by SetMaxAttempts, in which case it is moved to the dead
+// letter list.
+//
+// Leases still outstanding when the priority queue is closed are put
+// back into their priority levels the next time it is opened.
+func (pq *PriorityQueue) DequeueLease(timeout time.Duration) (*PriorityItem, LeaseToken, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, 0, ErrDBClosed
+	}
+
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, 0, err
+	}
+
+	// Try to get the next item.
+	item, err := pq.getNextItem()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Lease this item.
+	token, err := pq.lease(item, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return item, token, nil
+}
+
+// DequeueByPriorityLease removes the next item in the given priority
+// level and returns it along with a lease token. The lease behaves the
+// same as one returned by DequeueLease.
+func (pq *PriorityQueue) DequeueByPriorityLease(priority uint8, timeout time.Duration) (*PriorityItem, LeaseToken, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, 0, ErrDBClosed
+	}
+
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, 0, err
+	}
+
 	// Try to get the next item in the given priority level.
 	item, err := pq.getItemByPriorityID(priority, pq.levels[priority].head+1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Lease this item.
+	token, err := pq.lease(item, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return item, token, nil
+}
+
+// Ack acknowledges the lease with the given token, permanently removing
+// the leased item.
+func (pq *PriorityQueue) Ack(token LeaseToken) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the lease is still valid.
+	if _, err := pq.leases.get(token); err != nil {
+		return err
+	}
+
+	// Remove the lease record.
+	if err := pq.db.Delete(pq.leases.key(token), pq.sync.options()); err != nil {
+		return err
+	}
+	pq.leases.release(token)
+
+	return nil
+}
+
+// Nack returns the item of the lease with the given token to the head of
+// its priority level, after any items returned there that were dequeued
+// before it, so returned items keep their order. If the item has failed
+// more times than allowed, or the priority queue is full, it is moved to
+// the dead letter list instead.
+func (pq *PriorityQueue) Nack(token LeaseToken) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the lease is still valid.
+	l, err := pq.leases.get(token)
+	if err != nil {
+		return err
+	}
+
+	return pq.requeueLease(token, pq.levels[l.key[0]].head > 0)
+}
+
+// Fail reports that processing of the given item, which must have been
+// removed using Dequeue or DequeueByPriority, has failed. The item is
+// put back at the head of its priority level with its delivery attempts
+// incremented, or moved to the dead letter list if it has failed more
+// times than allowed or the priority queue is full.
+func (pq *PriorityQueue) Fail(item *PriorityItem) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.requeue(new(leveldb.Batch), item.Priority, item.Key, item.Value, item.Attempts, pq.levels[item.Priority].head > 0)
+}
+
+// SetMaxAttempts sets the maximum number of failed delivery attempts
+// for an item before it is moved to the dead letter list. A value of 0,
+// the default, means items are never moved to the dead letter list.
+func (pq *PriorityQueue) SetMaxAttempts(max uint32) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	pq.dead.maxAttempts = max
+}
+
+// DeadLetters returns every item in the dead letter list of the
+// priority queue.
+func (pq *PriorityQueue) DeadLetters() ([]*DeadLetter, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dead.list()
+}
+
+// PeekDeadLetter returns the item with the given ID from the dead letter
+// list without removing it.
+func (pq *PriorityQueue) PeekDeadLetter(id uint64) (*DeadLetter, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dead.get(id)
+}
+
+// RequeueDeadLetter moves the item with the given ID from the dead
+// letter list to the tail of its original priority level, resetting its
+// delivery attempts.
+func (pq *PriorityQueue) RequeueDeadLetter(id uint64) (*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Get the dead letter.
+	dl, err := pq.dead.get(id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Remove this item from the priority queue.
-	if err = pq.db.Delete(item.Key, nil); err != nil {
+	// Check if the item fits in the priority queue.
+	if !pq.cap.fits(pq.length(), 1, uint64(len(dl.Value))) {
+		return nil, ErrFull
+	}
+
+	// Get the priorityLevel from the original key.
+	priority := dl.Key[0]
+	level := pq.levels[priority]
+
+	// Create new PriorityItem.
+	item := &PriorityItem{
+		ID:       level.tail + 1,
+		Priority: priority,
+		Key:      pq.generateKey(priority, level.tail+1),
+		Value:    dl.Value,
+	}
+
+	// Move it from the dead letter list to the priority queue.
+	batch := new(leveldb.Batch)
+	pq.dead.remove(batch, id)
+	batch.Put(item.Key, item.Value)
+	pq.cap.batch(batch, []byte{item.Priority}, uint64(len(item.Value)), 0)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
 		return nil, err
 	}
+	pq.dead.commitRemove()
 
-	// Increment head position.
-	pq.levels[priority].head++
+	// Increment tail position.
+	level.tail++
+	pq.cap.added([]byte{item.Priority}, uint64(len(item.Value)))
+
+	// If this priority level is more important than the curLevel.
+	if pq.cmpAsc(priority) || pq.cmpDesc(priority) {
+		pq.curLevel = priority
+	}
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
 
 	return item, nil
 }
 
+// DeleteDeadLetter removes the item with the given ID from the dead
+// letter list.
+func (pq *PriorityQueue) DeleteDeadLetter(id uint64) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the dead letter exists.
+	if _, err := pq.dead.get(id); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	pq.dead.remove(batch, id)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+	pq.dead.commitRemove()
+
+	return nil
+}
+
+// PurgeDeadLetters removes every item from the dead letter list.
+func (pq *PriorityQueue) PurgeDeadLetters() error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	return pq.dead.purge()
+}
+
+// DeadLetterLength returns the total number of items in the dead letter
+// list.
+func (pq *PriorityQueue) DeadLetterLength() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.dead.length
+}
+
 // Peek returns the next item in the priority queue without removing it.
 func (pq *PriorityQueue) Peek() (*PriorityItem, error) {
 	pq.RLock()
@@ -235,22 +830,211 @@ func (pq *PriorityQueue) PeekByOffset(offset uint64) (*PriorityItem, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Check if queue is empty.
-	if pq.Length() == 0 {
-		return nil, ErrEmpty
+	// Check if queue is empty.
+	if pq.Length() == 0 {
+		return nil, ErrEmpty
+	}
+
+	// If the offset is within the current priority level.
+	if pq.levels[pq.curLevel].length() >= offset+1 {
+		return pq.getItemByPriorityID(pq.curLevel, pq.levels[pq.curLevel].head+offset+1)
+	}
+
+	return pq.findOffset(offset)
+}
+
+// PeekByPriorityID returns the item with the given ID and priority without
+// removing it.
+func (pq *PriorityQueue) PeekByPriorityID(priority uint8, id uint64) (*PriorityItem, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.getItemByPriorityID(priority, id)
+}
+
+// Update updates an item in the priority queue without changing its
+// position.
+func (pq *PriorityQueue) Update(priority uint8, id uint64, newValue []byte) (*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if item exists in queue.
+	if id <= pq.levels[priority].head || id > pq.levels[priority].tail {
+		return nil, ErrOutOfBounds
+	}
+
+	// Create new PriorityItem.
+	item := &PriorityItem{
+		ID:       id,
+		Priority: priority,
+		Key:      pq.generateKey(priority, id),
+		Value:    newValue,
+	}
+
+	// Check if the new value fits in the queue.
+	oldValue, err := pq.db.Get(item.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	oldSize := uint64(len(oldValue))
+	if uint64(len(newValue)) > oldSize && !pq.cap.fits(0, 0, uint64(len(newValue))-oldSize) {
+		return nil, ErrFull
+	}
+
+	// Update this item in the queue.
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	pq.cap.batch(batch, []byte{priority}, uint64(len(newValue)), oldSize)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+	pq.cap.removed([]byte{priority}, oldSize)
+	pq.cap.added([]byte{priority}, uint64(len(newValue)))
+
+	return item, nil
+}
+
+// UpdateString is a helper function for Update that accepts a value
+// as a string rather than a byte slice.
+func (pq *PriorityQueue) UpdateString(priority uint8, id uint64, newValue string) (*PriorityItem, error) {
+	return pq.Update(priority, id, []byte(newValue))
+}
+
+// UpdateObject is a helper function for Update that accepts any
+// value type, which is then encoded into a byte slice using
+// encoding/gob.
+//
+// Objects containing pointers with zero values will decode to nil
+// when using this function. This is due to how the encoding/gob
+// package works. Because of this, you should only use this function
+// to encode simple types.
+func (pq *PriorityQueue) UpdateObject(priority uint8, id uint64, newValue interface{}) (*PriorityItem, error) {
+	data, err := GobCodec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Update(priority, id, data)
+}
+
+// UpdateObjectAsJSON is a helper function for Update that accepts
+// any value type, which is then encoded into a JSON byte slice using
+// encoding/json.
+//
+// Use this function to handle encoding of complex types.
+func (pq *PriorityQueue) UpdateObjectAsJSON(priority uint8, id uint64, newValue interface{}) (*PriorityItem, error) {
+	data, err := JSONCodec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Update(priority, id, data)
+}
+
+// UpdateValue is a helper function for Update that accepts any value
+// type, which is then encoded into a byte slice using the codec of the
+// priority queue.
+func (pq *PriorityQueue) UpdateValue(priority uint8, id uint64, newValue interface{}) (*PriorityItem, error) {
+	data, err := pq.codec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return pq.Update(priority, id, data)
+}
+
+// DecodeValue decodes the value of the given item into the value pointed
+// to by value, using the codec of the priority queue.
+func (pq *PriorityQueue) DecodeValue(item *PriorityItem, value interface{}) error {
+	return pq.codec.Decode(item.Value, value)
+}
+
+// Length returns the total number of items in the priority queue.
+func (pq *PriorityQueue) Length() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.length()
+}
+
+// SizeBytes returns the total size in bytes of the item values in the
+// priority queue.
+func (pq *PriorityQueue) SizeBytes() uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.cap.bytes
+}
+
+// SizeBytesByPriority returns the total size in bytes of the item values
+// in the given priority level.
+func (pq *PriorityQueue) SizeBytesByPriority(priority uint8) uint64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	return pq.cap.size([]byte{priority})
+}
+
+// Quarantine removes the corrupt item reported by the given error from
+// the priority queue without reading its value, keeping the data it was
+// stored as in the quarantine list. Only the item at the head of its
+// priority level can be quarantined, otherwise ErrOutOfBounds is
+// returned.
+func (pq *PriorityQueue) Quarantine(corruption *ErrCorrupt) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the item is at the head of its priority level.
+	key := corruption.Key
+	if len(key) != 10 || !isItemKey(key) {
+		return ErrOutOfBounds
+	}
+	priority := key[0]
+	level := pq.levels[priority]
+	if level.length() == 0 || !bytes.Equal(key, pq.generateKey(priority, level.head+1)) {
+		return ErrOutOfBounds
+	}
+
+	// Move the item to the quarantine list and remove its delivery
+	// attempts.
+	batch := new(leveldb.Batch)
+	data, err := pq.corrupt.take(batch, key)
+	if err != nil {
+		return err
 	}
-
-	// If the offset is within the current priority level.
-	if pq.levels[pq.curLevel].length() >= offset+1 {
-		return pq.getItemByPriorityID(pq.curLevel, pq.levels[pq.curLevel].head+offset+1)
+	pq.dead.setAttempts(batch, key, 0)
+	pq.cap.batch(batch, []byte{priority}, 0, uint64(len(data)))
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
 	}
 
-	return pq.findOffset(offset)
+	// Increment head position. The size of the item is estimated from
+	// the data it was stored as.
+	level.head++
+	pq.compact.consumed(key)
+	pq.cap.removed([]byte{priority}, uint64(len(data)))
+
+	return nil
 }
 
-// PeekByPriorityID returns the item with the given ID and priority without
-// removing it.
-func (pq *PriorityQueue) PeekByPriorityID(priority uint8, id uint64) (*PriorityItem, error) {
+// Quarantined returns the items removed from the priority queue by
+// Quarantine, holding the data they were stored as.
+func (pq *PriorityQueue) Quarantined() ([]*Item, error) {
 	pq.RLock()
 	defer pq.RUnlock()
 
@@ -259,89 +1043,78 @@ func (pq *PriorityQueue) PeekByPriorityID(priority uint8, id uint64) (*PriorityI
 		return nil, ErrDBClosed
 	}
 
-	return pq.getItemByPriorityID(priority, id)
+	return pq.corrupt.list()
 }
 
-// Update updates an item in the priority queue without changing its
-// position.
-func (pq *PriorityQueue) Update(priority uint8, id uint64, newValue []byte) (*PriorityItem, error) {
+// PurgeQuarantined deletes every item in the quarantine list.
+func (pq *PriorityQueue) PurgeQuarantined() error {
 	pq.Lock()
 	defer pq.Unlock()
 
 	// Check if queue is closed.
 	if !pq.isOpen {
-		return nil, ErrDBClosed
+		return ErrDBClosed
 	}
 
-	// Check if item exists in queue.
-	if id <= pq.levels[priority].head || id > pq.levels[priority].tail {
-		return nil, ErrOutOfBounds
-	}
+	return pq.corrupt.purge()
+}
 
-	// Create new PriorityItem.
-	item := &PriorityItem{
-		ID:       id,
-		Priority: priority,
-		Key:      pq.generateKey(priority, id),
-		Value:    newValue,
-	}
+// Verify deletes the blob files of the priority queue that no item or record
+// refers to, which can be left behind by a crash while writing or
+// removing an item, and returns their paths. It does nothing unless blob
+// files are enabled.
+func (pq *PriorityQueue) Verify() ([]string, error) {
+	pq.Lock()
+	defer pq.Unlock()
 
-	// Update this item in the queue.
-	if err := pq.db.Put(item.Key, item.Value, nil); err != nil {
-		return nil, err
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
 	}
 
-	return item, nil
+	return pq.db.verify()
 }
 
-// UpdateString is a helper function for Update that accepts a value
-// as a string rather than a byte slice.
-func (pq *PriorityQueue) UpdateString(priority uint8, id uint64, newValue string) (*PriorityItem, error) {
-	return pq.Update(priority, id, []byte(newValue))
-}
+// Reencrypt rewrites every value of the priority queue that is not encrypted
+// with the current encryption key, so the keys it was encrypted with
+// before can be retired. ErrNoEncryption is returned if the priority queue was
+// opened without encryption keys.
+func (pq *PriorityQueue) Reencrypt() error {
+	pq.Lock()
+	defer pq.Unlock()
 
-// UpdateObject is a helper function for Update that accepts any
-// value type, which is then encoded into a byte slice using
-// encoding/gob.
-//
-// Objects containing pointers with zero values will decode to nil
-// when using this function. This is due to how the encoding/gob
-// package works. Because of this, you should only use this function
-// to encode simple types.
-func (pq *PriorityQueue) UpdateObject(priority uint8, id uint64, newValue interface{}) (*PriorityItem, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(newValue); err != nil {
-		return nil, err
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
 	}
-	return pq.Update(priority, id, buffer.Bytes())
-}
 
-// UpdateObjectAsJSON is a helper function for Update that accepts
-// any value type, which is then encoded into a JSON byte slice using
-// encoding/json.
-//
-// Use this function to handle encoding of complex types.
-func (pq *PriorityQueue) UpdateObjectAsJSON(priority uint8, id uint64, newValue interface{}) (*PriorityItem, error) {
-	jsonBytes, err := json.Marshal(newValue)
-	if err != nil {
-		return nil, err
-	}
+	return pq.db.reencrypt(pq.sync.options())
+}
 
-	return pq.Update(priority, id, jsonBytes)
+// CompressionStats returns the statistics of the values compressed by
+// the priority queue since it was opened.
+func (pq *PriorityQueue) CompressionStats() CompressionStats {
+	return pq.db.comp.stats()
 }
 
-// Length returns the total number of items in the priority queue.
-func (pq *PriorityQueue) Length() uint64 {
+// Compact compacts the whole LevelDB database of the priority queue,
+// reclaiming the space of removed items and speeding up iteration over
+// the keys they left behind.
+func (pq *PriorityQueue) Compact() error {
 	pq.RLock()
-	defer pq.RUnlock()
 
-	var length uint64
-	for _, v := range pq.levels {
-		length += v.length()
+	// Check if queue is closed.
+	if !pq.isOpen {
+		pq.RUnlock()
+		return ErrDBClosed
 	}
 
-	return length
+	// Register the compaction so closing waits for it.
+	done := pq.compact.begin()
+	pq.RUnlock()
+	defer done()
+
+	return pq.compact.compact()
 }
 
 // Close closes the LevelDB database of the priority queue.
@@ -354,29 +1127,53 @@ func (pq *PriorityQueue) Close() error {
 		return nil
 	}
 
+	// Stop compacting and sync any pending writes.
+	pq.compact.close()
+	if err := pq.sync.close(); err != nil {
+		return err
+	}
+
 	// Close the LevelDB database.
 	if err := pq.db.Close(); err != nil {
 		return err
 	}
 
-	// Reset head and tail of each priority level
-	// and set isOpen to false.
+	// Reset head and tail of each priority level, the
+	// leases and the dead letters and set isOpen to false.
 	for i := 0; i <= 255; i++ {
 		pq.levels[uint8(i)].head = 0
 		pq.levels[uint8(i)].tail = 0
+		pq.levels[uint8(i)].returned = nil
 	}
+	pq.leases.reset()
+	pq.dead.reset()
 	pq.isOpen = false
 
+	// Wake any goroutines waiting for an item or for space.
+	pq.notify.broadcast()
+	pq.cap.reset()
+
 	return nil
 }
 
-// Drop closes and deletes the LevelDB database of the priority queue.
+// Drop closes and deletes the LevelDB database of the priority queue, or only its
+// keys if it is hosted by a Store.
 func (pq *PriorityQueue) Drop() error {
 	if err := pq.Close(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(pq.DataDir)
+	return pq.db.drop()
+}
+
+// length returns the total number of items in the priority queue.
+func (pq *PriorityQueue) length() uint64 {
+	var length uint64
+	for _, v := range pq.levels {
+		length += v.length()
+	}
+
+	return length
 }
 
 // cmpAsc returns wehther the given priority level is higher than the
@@ -457,6 +1254,117 @@ func (pq *PriorityQueue) findOffset(offset uint64) (*PriorityItem, error) {
 	return nil, ErrOutOfBounds
 }
 
+// enqueue adds an item to the priority queue.
+func (pq *PriorityQueue) enqueue(priority uint8, value []byte) (*PriorityItem, error) {
+	// Check if the item fits in the priority queue.
+	if !pq.cap.fits(pq.length(), 1, uint64(len(value))) {
+		return nil, ErrFull
+	}
+
+	// Get the priorityLevel.
+	level := pq.levels[priority]
+
+	// Create new PriorityItem.
+	item := &PriorityItem{
+		ID:       level.tail + 1,
+		Priority: priority,
+		Key:      pq.generateKey(priority, level.tail+1),
+		Value:    value,
+	}
+
+	// Add it to the priority queue.
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	pq.cap.batch(batch, []byte{priority}, uint64(len(value)), 0)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment tail position.
+	level.tail++
+	pq.cap.added([]byte{priority}, uint64(len(value)))
+
+	// If this priority level is more important than the curLevel.
+	if pq.cmpAsc(priority) || pq.cmpDesc(priority) {
+		pq.curLevel = priority
+	}
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
+	return item, nil
+}
+
+// dequeueChecked removes the next item in the priority queue like
+// Dequeue, unless the given function returns an error for its value, in
+// which case the item is kept and returned along with the error.
+func (pq *PriorityQueue) dequeueChecked(check func(value []byte) error) (*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dequeue(check)
+}
+
+// dequeueByPriorityChecked removes the next item in the given priority
+// level like DequeueByPriority, unless the given function returns an
+// error for its value, in which case the item is kept and returned along
+// with the error.
+func (pq *PriorityQueue) dequeueByPriorityChecked(priority uint8, check func(value []byte) error) (*PriorityItem, error) {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return pq.dequeueByPriority(priority, check)
+}
+
+// dequeue removes the next item in the priority queue and returns it,
+// unless the given function is not nil and returns an error for its
+// value.
+func (pq *PriorityQueue) dequeue(check func(value []byte) error) (*PriorityItem, error) {
+	// Return any expired leases to the priority queue.
+	if err := pq.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item.
+	item, err := pq.getNextItem()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the item if the given function rejects its value.
+	if check != nil {
+		if err := check(item.Value); err != nil {
+			return item, err
+		}
+	}
+
+	// Remove this item and its delivery attempts from the priority queue.
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	pq.dead.setAttempts(batch, item.Key, 0)
+	pq.cap.batch(batch, []byte{item.Priority}, 0, uint64(len(item.Value)))
+	if err = pq.db.Write(batch, pq.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment head position.
+	pq.levels[pq.curLevel].head++
+	pq.compact.consumed(item.Key)
+	pq.cap.removed([]byte{item.Priority}, uint64(len(item.Value)))
+
+	return item, nil
+}
+
 // getNextItem returns the next item in the priority queue, updating
 // the current priority level of the queue if necessary.
 func (pq *PriorityQueue) getNextItem() (*PriorityItem, error) {
@@ -498,9 +1406,209 @@ func (pq *PriorityQueue) getItemByPriorityID(priority uint8, id uint64) (*Priori
 		return nil, err
 	}
 
+	// Get its delivery attempts.
+	if item.Attempts, err = pq.dead.attempts(item.Key); err != nil {
+		return nil, err
+	}
+
 	return item, nil
 }
 
+// lease moves the given item, which must be at the head of its priority
+// level, to a new lease record lasting for the given timeout.
+func (pq *PriorityQueue) lease(item *PriorityItem, timeout time.Duration) (LeaseToken, error) {
+	l := &lease{key: item.Key, attempts: item.Attempts, deadline: time.Now().Add(timeout)}
+	batch := new(leveldb.Batch)
+	token := pq.leases.grant(batch, l, item.Value)
+	pq.dead.setAttempts(batch, item.Key, 0)
+	pq.cap.batch(batch, []byte{item.Priority}, 0, uint64(len(item.Value)))
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return 0, err
+	}
+	pq.leases.commit(token, l)
+
+	// Increment head position.
+	pq.levels[item.Priority].head++
+	pq.compact.consumed(item.Key)
+	pq.cap.removed([]byte{item.Priority}, uint64(len(item.Value)))
+
+	return token, nil
+}
+
+// requeue puts the given item back into the given priority level with
+// its delivery attempts incremented, after any operations already in the
+// batch have been written along with it. The item is added to the head
+// of the priority level if atHead is true, otherwise it is added to the
+// tail. If the item has failed more times than allowed, or no longer fits
+// in the priority queue, it is moved to the dead letter list instead.
+func (pq *PriorityQueue) requeue(batch *leveldb.Batch, priority uint8, key, value []byte, attempts uint32, atHead bool) error {
+	attempts++
+
+	// Move the item to the dead letter list.
+	if pq.dead.exceeded(attempts) || !pq.cap.fits(pq.length(), 1, uint64(len(value))) {
+		id := pq.dead.add(batch, key, value, attempts)
+		if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+			return err
+		}
+		pq.dead.commitAdd(id)
+
+		return nil
+	}
+
+	return pq.putBack(batch, priority, key, value, attempts, atHead)
+}
+
+// putBack adds the given item value that was dequeued from the given key
+// back into the given priority level with the given delivery attempts,
+// after any operations already in the batch have been written along with
+// it. The item is added to the head of the priority level if atHead is
+// true, after the items put back there that were dequeued before it,
+// otherwise it is added to the tail.
+func (pq *PriorityQueue) putBack(batch *leveldb.Batch, priority uint8, key, value []byte, attempts uint32, atHead bool) error {
+	// Find the position for the item, moving the items that go before
+	// it down to make room.
+	var from uint64
+	if len(key) == 10 && key[0] == priority {
+		from = keyToID(key[2:])
+	}
+
+	level := pq.levels[priority]
+	id := level.tail + 1
+	if atHead {
+		id = level.head + returnedBefore(level.returned, level.head, level.tail, from)
+
+		for next := level.head + 1; next <= id; next++ {
+			item, err := pq.getItemByPriorityID(priority, next)
+			if err != nil {
+				return err
+			}
+			batch.Put(pq.generateKey(priority, next-1), item.Value)
+			pq.dead.setAttempts(batch, pq.generateKey(priority, next-1), item.Attempts)
+		}
+	}
+
+	// Add the item and its delivery attempts to the priority queue.
+	newKey := pq.generateKey(priority, id)
+	batch.Put(newKey, value)
+	pq.dead.setAttempts(batch, newKey, attempts)
+	pq.cap.batch(batch, []byte{priority}, uint64(len(value)), 0)
+	if err := pq.db.Write(batch, pq.sync.options()); err != nil {
+		return err
+	}
+
+	// Update head or tail position.
+	if atHead {
+		if level.returned == nil {
+			level.returned = make(map[uint64]uint64)
+		}
+		for next := level.head; next < id; next++ {
+			level.returned[next] = level.returned[next+1]
+		}
+		level.returned[id] = from
+		level.head--
+	} else {
+		delete(level.returned, id)
+		level.tail++
+	}
+	pq.cap.added([]byte{priority}, uint64(len(value)))
+
+	// If this priority level is more important than the curLevel.
+	if pq.cmpAsc(priority) || pq.cmpDesc(priority) {
+		pq.curLevel = priority
+	}
+
+	// Wake any goroutines waiting for an item.
+	pq.notify.broadcast()
+
+	return nil
+}
+
+// restore puts the given dequeued items back at the head of their
+// priority levels, in the order they were dequeued, without changing
+// their delivery attempts.
+func (pq *PriorityQueue) restore(items []*PriorityItem) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return ErrDBClosed
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if err := pq.putBack(new(leveldb.Batch), item.Priority, item.Key, item.Value, item.Attempts, pq.levels[item.Priority].head > 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requeueLease puts the item of the lease with the given token back
+// into its priority level and removes the lease.
+func (pq *PriorityQueue) requeueLease(token LeaseToken, atHead bool) error {
+	// Get the leased item value.
+	value, err := pq.leases.value(token)
+	if err != nil {
+		return err
+	}
+
+	// Move the lease record back to the priority queue.
+	l := pq.leases.leases[token]
+	batch := new(leveldb.Batch)
+	batch.Delete(pq.leases.key(token))
+	if err := pq.requeue(batch, l.key[0], l.key, value, l.attempts, atHead); err != nil {
+		return err
+	}
+	pq.leases.release(token)
+
+	return nil
+}
+
+// requeueExpired puts the items of all expired leases back at the head
+// of their priority levels, keeping the order they were leased in. If a
+// priority level does not have enough room below its head, such as after
+// reopening a priority queue that was fully leased out, its items are
+// added to the tail instead.
+func (pq *PriorityQueue) requeueExpired() error {
+	tokens := pq.leases.expired()
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// Find which priority levels have room below their head.
+	var counts [256]uint64
+	for _, token := range tokens {
+		counts[pq.leases.leases[token].key[0]]++
+	}
+
+	var atHead [256]bool
+	for i := 0; i <= 255; i++ {
+		atHead[i] = pq.levels[i].head >= counts[i]
+	}
+
+	// Add to the head in reverse lease order.
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if atHead[pq.leases.leases[tokens[i]].key[0]] {
+			if err := pq.requeueLease(tokens[i], true); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Add the rest to the tail in lease order.
+	for _, token := range tokens {
+		if l, ok := pq.leases.leases[token]; ok && !atHead[l.key[0]] {
+			if err := pq.requeueLease(token, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // generatePrefix creates the key prefix for the given priority level.
 func (pq *PriorityQueue) generatePrefix(level uint8) []byte {
 	// priority + prefixSep = 1 + 1 = 2
@@ -519,6 +1627,12 @@ func (pq *PriorityQueue) generateKey(priority uint8, id uint64) []byte {
 	return key
 }
 
+// priorityGroup returns the priority level of the given item key, which
+// is used to group item sizes.
+func priorityGroup(key []byte) []byte {
+	return key[:1]
+}
+
 // init initializes the priority queue data.
 func (pq *PriorityQueue) init() error {
 	// Set starting value for curLevel.
@@ -559,5 +1673,22 @@ func (pq *PriorityQueue) init() error {
 		iter.Release()
 	}
 
-	return nil
+	// Load the size of the items.
+	if err := pq.cap.load(itemRange(), nil, priorityGroup, false); err != nil {
+		return err
+	}
+
+	// Load the dead letter list.
+	if err := pq.dead.load(); err != nil {
+		return err
+	}
+
+	// Return leases left over from a previous process to the priority
+	// queue.
+	if err := pq.leases.load(); err != nil {
+		return err
+	}
+	pq.leases.expireAll()
+
+	return pq.requeueExpired()
 }
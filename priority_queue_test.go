@@ -1,6 +1,7 @@
 package goque
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -57,6 +58,145 @@ func TestPriorityQueueDrop(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueOpenWithOptions(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueueWithOptions(file, DESC, &Options{Durability: SyncPeriodic, SyncInterval: time.Hour})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString(1, "value"); err != nil {
+		t.Error(err)
+	}
+
+	// Closing syncs the pending write.
+	if err = pq.Close(); err != nil {
+		t.Error(err)
+	}
+
+	pq, err = OpenPriorityQueueWithOptions(file, DESC, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Close()
+
+	if pq.Length() != 1 {
+		t.Errorf("Expected priority queue length of 1, got %d", pq.Length())
+	}
+}
+
+func TestPriorityQueueCompact(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueueWithOptions(file, ASC, &Options{CompactionThreshold: 10})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 2; p++ {
+		for i := 1; i <= 10; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	if _, err = pq.DequeueN(25); err != nil {
+		t.Error(err)
+	}
+
+	if err = pq.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.Priority != 2 || deqItem.ToString() != "value for item 6" {
+		t.Errorf("Expected item 'value for item 6' with priority 2, got '%s' with priority %d", deqItem.ToString(), deqItem.Priority)
+	}
+}
+
+func TestPriorityQueueEnqueueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueueWithOptions(file, ASC, &Options{MaxItems: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 1; p++ {
+		if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = pq.EnqueueString(2, "value for item 2"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Dequeue()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = pq.EnqueueWait(ctx, 2, []byte("value for item 2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if pq.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", pq.Length())
+	}
+}
+
+func TestPriorityQueueSizeBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 2; p++ {
+		for i := 1; i <= 10; i++ {
+			if _, err = pq.EnqueueString(uint8(p), "0123456789"); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	if _, err = pq.DequeueN(15); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = pq.UpdateString(2, 10, "01234"); err != nil {
+		t.Error(err)
+	}
+
+	pq.Close()
+
+	pq, err = OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if pq.SizeBytes() != 145 {
+		t.Errorf("Expected size of 145 bytes, got %d", pq.SizeBytes())
+	}
+
+	for p, size := range []uint64{0, 50, 95, 0} {
+		if pq.SizeBytesByPriority(uint8(p)) != size {
+			t.Errorf("Expected size of %d bytes for priority level %d, got %d", size, p, pq.SizeBytesByPriority(uint8(p)))
+		}
+	}
+}
+
 func TestPriorityQueueIncompatibleType(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	q, err := OpenQueue(file)
@@ -92,6 +232,44 @@ func TestPriorityQueueEnqueue(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueEnqueueBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.EnqueueString(5, "value for priority 5"); err != nil {
+		t.Error(err)
+	}
+
+	values := [][]byte{[]byte("value for item 1"), []byte("value for item 2")}
+	items, err := pq.EnqueueBatch(2, values)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 2 || items[1].ID != 2 || items[1].Priority != 2 {
+		t.Errorf("Expected second item with ID 2 and priority 2, got %v", items)
+	}
+
+	if pq.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", pq.Length())
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
 func TestPriorityQueueDequeueAsc(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	pq, err := OpenPriorityQueue(file, ASC)
@@ -212,6 +390,76 @@ func TestPriorityQueueDequeueByPriority(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueDequeueN(t *testing.T) {
+	for _, order := range []order{ASC, DESC} {
+		file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+		pq, err := OpenPriorityQueue(file, order)
+		if err != nil {
+			t.Error(err)
+		}
+		defer pq.Drop()
+
+		for p := 0; p <= 2; p++ {
+			for i := 1; i <= 2; i++ {
+				if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+
+		items, err := pq.DequeueN(3)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(items) != 3 {
+			t.Fatalf("Expected 3 items, got %d", len(items))
+		}
+
+		first, second := uint8(0), uint8(1)
+		if order == DESC {
+			first, second = 2, 1
+		}
+
+		expected := []struct {
+			priority uint8
+			value    string
+		}{
+			{first, "value for item 1"},
+			{first, "value for item 2"},
+			{second, "value for item 1"},
+		}
+
+		for i, item := range items {
+			if item.Priority != expected[i].priority || item.ToString() != expected[i].value {
+				t.Errorf("Expected item '%s' with priority %d, got '%s' with priority %d", expected[i].value, expected[i].priority, item.ToString(), item.Priority)
+			}
+		}
+
+		deqItem, err := pq.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if deqItem.Priority != second || deqItem.ToString() != "value for item 2" {
+			t.Errorf("Expected item 'value for item 2' with priority %d, got '%s' with priority %d", second, deqItem.ToString(), deqItem.Priority)
+		}
+
+		items, err = pq.DequeueN(10)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(items) != 2 {
+			t.Errorf("Expected 2 items, got %d", len(items))
+		}
+
+		if _, err = pq.DequeueN(1); err != ErrEmpty {
+			t.Errorf("Expected to get empty error, got %v", err)
+		}
+	}
+}
+
 func TestPriorityQueueEncodeDecodePointerJSON(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	pq, err := OpenPriorityQueue(file, DESC)
@@ -1056,6 +1304,341 @@ func TestPriorityQueueOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueDequeueLeaseNackOrder(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = pq.EnqueueString(0, fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var tokens []LeaseToken
+	for i := 1; i <= 2; i++ {
+		_, token, err := pq.DequeueLease(time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	for _, token := range tokens {
+		if err = pq.Nack(token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		deqItem, err := pq.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ID != uint64(i) || deqItem.ToString() != compStr {
+			t.Errorf("Expected item %d with string '%s', got item %d with '%s'", i, compStr, deqItem.ID, deqItem.ToString())
+		}
+	}
+}
+
+func TestPriorityQueueDequeueLeaseAck(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 1; p++ {
+		if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for priority %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, token, err := pq.DequeueByPriorityLease(1, time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if item.Priority != 1 {
+		t.Errorf("Expected item priority of 1, got %d", item.Priority)
+	}
+
+	if err = pq.Ack(token); err != nil {
+		t.Error(err)
+	}
+
+	if err = pq.Nack(token); err != ErrInvalidLease {
+		t.Errorf("Expected to get invalid lease error, got %v", err)
+	}
+
+	pq.Close()
+	if pq, err = OpenPriorityQueue(file, ASC); err != nil {
+		t.Error(err)
+	}
+	defer pq.Close()
+
+	if pq.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", pq.Length())
+	}
+}
+
+func TestPriorityQueueDequeueLeaseExpired(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 1; p++ {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	item, _, err := pq.DequeueLease(10 * time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if deqItem.Priority != item.Priority || deqItem.ID != item.ID {
+		t.Errorf("Expected item %d with priority %d, got item %d with priority %d", item.ID, item.Priority, deqItem.ID, deqItem.Priority)
+	}
+
+	if deqItem.Attempts != 1 {
+		t.Errorf("Expected item attempts of 1, got %d", deqItem.Attempts)
+	}
+}
+
+func TestPriorityQueueDequeueLeaseReopen(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, DESC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 1; p++ {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		if _, _, err = pq.DequeueLease(time.Minute); err != nil {
+			t.Error(err)
+		}
+	}
+
+	pq.Close()
+	if pq, err = OpenPriorityQueue(file, DESC); err != nil {
+		t.Error(err)
+	}
+	defer pq.Close()
+
+	if pq.Length() != 4 {
+		t.Errorf("Expected queue length of 4, got %d", pq.Length())
+	}
+
+	for _, p := range []uint8{1, 1, 0, 0} {
+		deqItem, err := pq.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if deqItem.Priority != p {
+			t.Errorf("Expected item priority of %d, got %d", p, deqItem.Priority)
+		}
+	}
+}
+
+func TestPriorityQueueFail(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 1; p++ {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = pq.Fail(deqItem); err != nil {
+		t.Error(err)
+	}
+
+	peekItem, err := pq.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.Priority != 0 || peekItem.ToString() != deqItem.ToString() {
+		t.Errorf("Expected priority 0 item '%s', got priority %d item '%s'", deqItem.ToString(), peekItem.Priority, peekItem.ToString())
+	}
+
+	if peekItem.Attempts != 1 {
+		t.Errorf("Expected item attempts of 1, got %d", peekItem.Attempts)
+	}
+}
+
+func TestPriorityQueueDeadLetter(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	pq.SetMaxAttempts(1)
+
+	for p := 0; p <= 1; p++ {
+		if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for priority %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		deqItem, err := pq.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if err = pq.Fail(deqItem); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if pq.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", pq.Length())
+	}
+
+	letters, err := pq.DeadLetters()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(letters) != 1 || letters[0].Attempts != 2 {
+		t.Fatalf("Expected one dead letter with 2 attempts, got %v", letters)
+	}
+
+	item, err := pq.RequeueDeadLetter(letters[0].ID)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if item.Priority != 0 {
+		t.Errorf("Expected requeued item priority of 0, got %d", item.Priority)
+	}
+
+	if pq.DeadLetterLength() != 0 {
+		t.Errorf("Expected dead letter length of 0, got %d", pq.DeadLetterLength())
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for priority 0"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestPriorityQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.EnqueueString(3, "value for item")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deqItem, err := pq.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deqItem.Priority != 3 {
+		t.Errorf("Expected item priority of 3, got %d", deqItem.Priority)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Close()
+	}()
+
+	if _, err = pq.DequeueWait(ctx); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestPriorityQueueConsume(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 2; p >= 0; p-- {
+		if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for priority %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ch := pq.Consume(context.Background(), 0)
+
+	for p := 0; p <= 2; p++ {
+		item := <-ch
+		if item.Priority != uint8(p) {
+			t.Errorf("Expected item priority of %d, got %d", p, item.Priority)
+		}
+	}
+
+	pq.Close()
+
+	if _, ok := <-ch; ok {
+		t.Error("Expected channel to be closed")
+	}
+}
+
 func BenchmarkPriorityQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
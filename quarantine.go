@@ -0,0 +1,81 @@
+package goque
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// quarantine keeps the stored data of the corrupt items removed from a
+// data structure, so they can be inspected later. It is not goroutine
+// safe and relies on the lock of its owner.
+type quarantine struct {
+	db     *keyspace
+	sync   *syncer
+	prefix []byte
+}
+
+// newQuarantine creates the quarantine for the given database, writing
+// with the given syncer and storing its records under the given internal
+// key prefix.
+func newQuarantine(db *keyspace, sync *syncer, prefix []byte) *quarantine {
+	return &quarantine{
+		db:     db,
+		sync:   sync,
+		prefix: prefix,
+	}
+}
+
+// keyPrefix returns the key prefix for quarantined items.
+func (qt *quarantine) keyPrefix() []byte {
+	return append(append([]byte{}, qt.prefix...), []byte("quarantine:")...)
+}
+
+// take returns the stored data of the corrupt item with the given key,
+// adding its removal from the data structure and its addition to the
+// quarantine to the batch.
+func (qt *quarantine) take(batch *leveldb.Batch, key []byte) ([]byte, error) {
+	data, err := qt.db.getRaw(key)
+	if err != nil {
+		return nil, err
+	}
+
+	batch.Delete(key)
+	batch.Put(append(qt.keyPrefix(), key...), data)
+
+	return data, nil
+}
+
+// list returns every quarantined item, with the data it was stored as.
+func (qt *quarantine) list() ([]*Item, error) {
+	prefix := qt.keyPrefix()
+	iter := qt.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	var items []*Item
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()[len(prefix):]...)
+		items = append(items, &Item{
+			ID:    keyToID(key[len(key)-8:]),
+			Key:   key,
+			Value: append([]byte{}, iter.Value()...),
+		})
+	}
+
+	return items, iter.Error()
+}
+
+// purge deletes every quarantined item.
+func (qt *quarantine) purge() error {
+	iter := qt.db.NewIterator(util.BytesPrefix(qt.keyPrefix()), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return qt.db.Write(batch, qt.sync.options())
+}
@@ -2,51 +2,99 @@ package goque
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/json"
-	"os"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Queue is a standard FIFO (first in, first out) queue.
 type Queue struct {
 	sync.RWMutex
-	DataDir string
-	db      *leveldb.DB
-	head    uint64
-	tail    uint64
-	isOpen  bool
+	DataDir  string
+	db       *keyspace
+	codec    Codec
+	onError  func(err error)
+	head     uint64
+	tail     uint64
+	sync     *syncer
+	compact  *compactor
+	group    *groupCommitter
+	cap      *capacity
+	overflow *overflow
+	leases   *leaseTable
+	dead     *deadLetters
+	corrupt  *quarantine
+	notify   *notifier
+	returned map[uint64]uint64
+	isOpen   bool
 }
 
 // OpenQueue opens a queue if one exists at the given directory. If one
 // does not already exist, a new queue is created.
 func OpenQueue(dataDir string) (*Queue, error) {
-	var err error
+	return OpenQueueWithOptions(dataDir, nil)
+}
+
+// OpenQueueWithOptions opens a queue like OpenQueue, using the given
+// options. If opts is nil, the default options are used.
+func OpenQueueWithOptions(dataDir string, opts *Options) (*Queue, error) {
+	// Open database for the queue.
+	db, err := openKeyspace(dataDir, goqueQueue, opts)
+	if err != nil {
+		return &Queue{DataDir: dataDir}, err
+	}
+
+	return openQueue(dataDir, db, opts)
+}
+
+// OpenQueueInMemory opens a new queue that keeps its items in memory only.
+// They are lost once the queue is closed.
+func OpenQueueInMemory() (*Queue, error) {
+	return OpenQueueWithStorage(NewMemoryStorage(), nil)
+}
+
+// OpenQueueWithStorage opens the queue kept in the given storage, using
+// the given options. The queue takes ownership of the storage and closes
+// it when the queue is closed. The LevelDB settings of the options are
+// ignored.
+func OpenQueueWithStorage(storage Storage, opts *Options) (*Queue, error) {
+	return openQueue("", &keyspace{db: storage}, opts)
+}
+
+// openQueue opens the queue stored in the given keyspace.
+func openQueue(dataDir string, db *keyspace, opts *Options) (*Queue, error) {
+	// Compress, encrypt and checksum the values of the data structure,
+	// and spill them to blob files, if enabled.
+	if err := db.setValueOptions(opts, isItemKey); err != nil {
+		db.Close()
+		return &Queue{DataDir: dataDir}, err
+	}
 
 	// Create a new Queue.
 	q := &Queue{
 		DataDir: dataDir,
-		db:      &leveldb.DB{},
+		db:      db,
+		codec:   codecOf(opts),
+		onError: consumeErrorOf(opts),
 		head:    0,
 		tail:    0,
+		notify:  newNotifier(),
 		isOpen:  false,
 	}
+	q.sync = newSyncer(q.db, internalPrefix, opts)
+	q.compact = newCompactor(q.db, opts)
+	q.cap = newCapacity(q.db, internalPrefix, opts)
+	q.overflow = newOverflow(opts)
+	q.leases = newLeaseTable(q.db, internalPrefix)
+	q.dead = newDeadLetters(q.db, q.sync, internalPrefix)
+	q.corrupt = newQuarantine(q.db, q.sync, internalPrefix)
 
-	// Open database for the queue.
-	q.db, err = leveldb.OpenFile(dataDir, nil)
-	if err != nil {
-		return q, err
-	}
-
-	// Check if this Goque type can open the requested data directory.
-	ok, err := checkGoqueType(dataDir, goqueQueue)
-	if err != nil {
-		return q, err
-	}
-	if !ok {
-		return q, ErrIncompatibleType
+	// Start group committing enqueues if enabled.
+	if opts != nil && opts.GroupCommit {
+		q.group = newGroupCommitter(opts.GroupCommitSize, q.commitGroup)
 	}
 
 	// Set isOpen and return.
@@ -55,8 +103,26 @@ func OpenQueue(dataDir string) (*Queue, error) {
 }
 
 // Enqueue adds an item to the queue.
+//
+// If the queue is full, its overflow policy decides whether ErrFull is
+// returned, the item is dropped and returned with an ID of 0, or items
+// are evicted from the head of the queue to make space for it.
+//
+// If the queue was opened with group commit enabled, concurrent calls
+// are gathered into a single write and each returns once the write its
+// item was added in has been committed.
 func (q *Queue) Enqueue(value []byte) (*Item, error) {
+	// Hand the value to the group committer, and pass the items dropped
+	// for it to the callback from this goroutine rather than the group
+	// committer's, so the callback can enqueue.
+	if q.group != nil {
+		item, dropped, err := q.group.submit(value)
+		q.overflow.pass(dropped)
+		return item, err
+	}
+
 	q.Lock()
+	defer q.overflow.notify()
 	defer q.Unlock()
 
 	// Check if queue is closed.
@@ -64,22 +130,54 @@ func (q *Queue) Enqueue(value []byte) (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Create new Item.
-	item := &Item{
-		ID:    q.tail + 1,
-		Key:   idToKey(q.tail + 1),
-		Value: value,
-	}
+	return q.enqueue(value, q.overflow.policy)
+}
 
-	// Add it to the queue.
-	if err := q.db.Put(item.Key, item.Value, nil); err != nil {
-		return nil, err
+// EnqueueWait adds an item to the queue. If the queue is full, it blocks
+// until enough items are removed to make space for it, the given context
+// is done or the queue is closed. The overflow policy is not applied.
+func (q *Queue) EnqueueWait(ctx context.Context, value []byte) (*Item, error) {
+	for {
+		q.Lock()
+
+		// Check if queue is closed.
+		if !q.isOpen {
+			q.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to enqueue the item. If it does not fit in an empty queue,
+		// it never will.
+		item, err := q.enqueue(value, OverflowReject)
+		if err != ErrFull || q.Length() == 0 {
+			q.Unlock()
+			return item, err
+		}
+
+		// Wait for space to be freed.
+		wait := q.cap.wait()
+		q.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	// Increment tail position.
-	q.tail++
+// EnqueueBatch adds the given values to the queue as a single atomic
+// write. Either every item is added or none are. If they do not fit in
+// the queue, the overflow policy is applied to them together.
+func (q *Queue) EnqueueBatch(values [][]byte) ([]*Item, error) {
+	q.Lock()
+	defer q.overflow.notify()
+	defer q.Unlock()
 
-	return item, nil
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.enqueueBatch(values, q.overflow.policy)
 }
 
 // EnqueueString is a helper function for Enqueue that accepts a
@@ -97,13 +195,12 @@ func (q *Queue) EnqueueString(value string) (*Item, error) {
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (q *Queue) EnqueueObject(value interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(value); err != nil {
+	data, err := GobCodec.Encode(value)
+	if err != nil {
 		return nil, err
 	}
 
-	return q.Enqueue(buffer.Bytes())
+	return q.Enqueue(data)
 }
 
 // EnqueueObjectAsJSON is a helper function for Enqueue that accepts
@@ -112,12 +209,23 @@ func (q *Queue) EnqueueObject(value interface{}) (*Item, error) {
 //
 // Use this function to handle encoding of complex types.
 func (q *Queue) EnqueueObjectAsJSON(value interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(value)
+	data, err := JSONCodec.Encode(value)
 	if err != nil {
 		return nil, err
 	}
 
-	return q.Enqueue(jsonBytes)
+	return q.Enqueue(data)
+}
+
+// EnqueueValue is a helper function for Enqueue that accepts any value type,
+// which is then encoded into a byte slice using the codec of the queue.
+func (q *Queue) EnqueueValue(value interface{}) (*Item, error) {
+	data, err := q.codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Enqueue(data)
 }
 
 // Dequeue removes the next item in the queue and returns it.
@@ -130,23 +238,391 @@ func (q *Queue) Dequeue() (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Try to get the next item in the queue.
-	item, err := q.getItemByID(q.head + 1)
+	return q.dequeue(nil)
+}
+
+// DequeueN removes up to n items from the head of the queue and returns
+// them, reading them with a single iterator and removing them as a
+// single atomic write. If n is negative, every item in the queue is
+// removed.
+func (q *Queue) DequeueN(n int) ([]*Item, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Return any expired leases to the queue.
+	if err := q.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Check if queue is empty.
+	if q.Length() == 0 {
+		return nil, ErrEmpty
+	}
+
+	// Find how many items to remove.
+	count := q.Length()
+	if n >= 0 && uint64(n) < count {
+		count = uint64(n)
+	}
+
+	// Get the items from the database.
+	start, limit := idToKey(q.head+1), idToKey(q.head+count+1)
+	items, err := q.getItemRange(start, limit)
 	if err != nil {
 		return nil, err
 	}
 
-	// Remove this item from the queue.
-	if err := q.db.Delete(item.Key, nil); err != nil {
+	// Remove these items and their delivery attempts from the queue.
+	batch := new(leveldb.Batch)
+	for _, item := range items {
+		batch.Delete(item.Key)
+		if item.Attempts > 0 {
+			q.dead.setAttempts(batch, item.Key, 0)
+		}
+	}
+	q.cap.batch(batch, nil, 0, itemsSize(items))
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
 		return nil, err
 	}
 
+	// Increment head position.
+	q.head += uint64(len(items))
+	for _, item := range items {
+		q.compact.consumed(item.Key)
+		q.cap.removed(nil, uint64(len(item.Value)))
+	}
+
+	return items, nil
+}
+
+// DequeueWait removes the next item in the queue and returns it. If the
+// queue is empty, it blocks until an item is added, the given context is
+// done or the queue is closed.
+func (q *Queue) DequeueWait(ctx context.Context) (*Item, error) {
+	for {
+		q.Lock()
+
+		// Check if queue is closed.
+		if !q.isOpen {
+			q.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to dequeue the next item.
+		item, err := q.dequeue(nil)
+		if err != ErrEmpty {
+			q.Unlock()
+			return item, err
+		}
+
+		// Wait for an item to be added or a lease to expire.
+		wait, deadline := q.notify.wait(), q.leases.nextDeadline()
+		q.Unlock()
+
+		if err := waitFor(ctx, wait, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Consume returns a channel that is fed items from the head of the
+// queue by a background goroutine as they become available, holding up
+// to bufferSize items that have been dequeued but not yet received.
+//
+// The channel is closed once the given context is done, the queue is
+// closed or an error occurs. When the context is done, any items that
+// were dequeued but not received are put back at the head of the queue.
+// When the queue is closed, items still buffered in the channel can be
+// received after it is closed.
+//
+// The error that stops the goroutine, or that prevents the items from
+// being put back, is passed to the OnConsumeError callback of the
+// options, if any.
+func (q *Queue) Consume(ctx context.Context, bufferSize int) <-chan *Item {
+	ch := make(chan *Item, bufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			item, err := q.DequeueWait(ctx)
+			if err == nil {
+				select {
+				case ch <- item:
+					continue
+				case <-ctx.Done():
+				}
+			}
+
+			// Put back the items that were dequeued but never received
+			// once the context is done, whether it was noticed while
+			// waiting for an item or while sending one.
+			if ctx.Err() != nil {
+				if items := drainItems(ch, item); len(items) > 0 {
+					reportConsumeError(q.onError, q.restore(items))
+				}
+			} else if err != ErrDBClosed {
+				reportConsumeError(q.onError, err)
+			}
+			return
+		}
+	}()
+
+	return ch
+}
+
+// DequeueLease removes the next item in the queue and returns it along
+// with a lease token. The item is kept in the database until the lease
+// is acknowledged using Ack. If the lease is returned using Nack, or is
+// not acknowledged before the given timeout, the item is put back at
+// the head of the queue to be delivered again, unless it has failed
+// more times than allowed by SetMaxAttempts, in which case it is moved
+// to the dead letter list.
+//
+// Leases still outstanding when the queue is closed are put back at
+// the head of the queue the next time it is opened.
+func (q *Queue) DequeueLease(timeout time.Duration) (*Item, LeaseToken, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, 0, ErrDBClosed
+	}
+
+	// Return any expired leases to the queue.
+	if err := q.requeueExpired(); err != nil {
+		return nil, 0, err
+	}
+
+	// Try to get the next item in the queue.
+	item, err := q.getItemByID(q.head + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Move this item from the queue to a lease record.
+	l := &lease{key: item.Key, attempts: item.Attempts, deadline: time.Now().Add(timeout)}
+	batch := new(leveldb.Batch)
+	token := q.leases.grant(batch, l, item.Value)
+	q.dead.setAttempts(batch, item.Key, 0)
+	q.cap.batch(batch, nil, 0, uint64(len(item.Value)))
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return nil, 0, err
+	}
+	q.leases.commit(token, l)
+
 	// Increment head position.
 	q.head++
+	q.compact.consumed(item.Key)
+	q.cap.removed(nil, uint64(len(item.Value)))
+
+	return item, token, nil
+}
+
+// Ack acknowledges the lease with the given token, permanently removing
+// the leased item.
+func (q *Queue) Ack(token LeaseToken) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the lease is still valid.
+	if _, err := q.leases.get(token); err != nil {
+		return err
+	}
+
+	// Remove the lease record.
+	if err := q.db.Delete(q.leases.key(token), q.sync.options()); err != nil {
+		return err
+	}
+	q.leases.release(token)
+
+	return nil
+}
+
+// Nack returns the item of the lease with the given token to the head
+// of the queue, after any items returned there that were dequeued before
+// it, so returned items keep their order. If the item has failed more
+// times than allowed, or the queue is full, it is moved to the dead
+// letter list instead.
+func (q *Queue) Nack(token LeaseToken) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the lease is still valid.
+	if _, err := q.leases.get(token); err != nil {
+		return err
+	}
+
+	return q.requeueLease(token, q.head > 0)
+}
+
+// Fail reports that processing of the given item, which must have been
+// removed using Dequeue, has failed. The item is put back at the head
+// of the queue with its delivery attempts incremented, or moved to the
+// dead letter list if it has failed more times than allowed or the queue
+// is full.
+func (q *Queue) Fail(item *Item) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	return q.requeue(new(leveldb.Batch), item.Key, item.Value, item.Attempts, q.head > 0)
+}
+
+// SetMaxAttempts sets the maximum number of failed delivery attempts
+// for an item before it is moved to the dead letter list. A value of 0,
+// the default, means items are never moved to the dead letter list.
+func (q *Queue) SetMaxAttempts(max uint32) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.dead.maxAttempts = max
+}
+
+// DeadLetters returns every item in the dead letter list of the queue.
+func (q *Queue) DeadLetters() ([]*DeadLetter, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.dead.list()
+}
+
+// PeekDeadLetter returns the item with the given ID from the dead letter
+// list without removing it.
+func (q *Queue) PeekDeadLetter(id uint64) (*DeadLetter, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.dead.get(id)
+}
+
+// RequeueDeadLetter moves the item with the given ID from the dead
+// letter list to the tail of the queue, resetting its delivery attempts.
+func (q *Queue) RequeueDeadLetter(id uint64) (*Item, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Get the dead letter.
+	dl, err := q.dead.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the item fits in the queue.
+	if !q.cap.fits(q.Length(), 1, uint64(len(dl.Value))) {
+		return nil, ErrFull
+	}
+
+	// Create new Item.
+	item := &Item{
+		ID:    q.tail + 1,
+		Key:   idToKey(q.tail + 1),
+		Value: dl.Value,
+	}
+
+	// Move it from the dead letter list to the queue.
+	batch := new(leveldb.Batch)
+	q.dead.remove(batch, id)
+	batch.Put(item.Key, item.Value)
+	q.cap.batch(batch, nil, uint64(len(item.Value)), 0)
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return nil, err
+	}
+	q.dead.commitRemove()
+
+	// Increment tail position.
+	q.tail++
+	q.cap.added(nil, uint64(len(item.Value)))
+
+	// Wake any goroutines waiting for an item.
+	q.notify.broadcast()
 
 	return item, nil
 }
 
+// DeleteDeadLetter removes the item with the given ID from the dead
+// letter list.
+func (q *Queue) DeleteDeadLetter(id uint64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the dead letter exists.
+	if _, err := q.dead.get(id); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	q.dead.remove(batch, id)
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return err
+	}
+	q.dead.commitRemove()
+
+	return nil
+}
+
+// PurgeDeadLetters removes every item from the dead letter list.
+func (q *Queue) PurgeDeadLetters() error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	return q.dead.purge()
+}
+
+// DeadLetterLength returns the total number of items in the dead letter
+// list.
+func (q *Queue) DeadLetterLength() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.dead.length
+}
+
 // Peek returns the next item in the queue without removing it.
 func (q *Queue) Peek() (*Item, error) {
 	q.RLock()
@@ -209,10 +685,25 @@ func (q *Queue) Update(id uint64, newValue []byte) (*Item, error) {
 		Value: newValue,
 	}
 
+	// Check if the new value fits in the queue.
+	oldValue, err := q.db.Get(item.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	oldSize := uint64(len(oldValue))
+	if uint64(len(newValue)) > oldSize && !q.cap.fits(0, 0, uint64(len(newValue))-oldSize) {
+		return nil, ErrFull
+	}
+
 	// Update this item in the queue.
-	if err := q.db.Put(item.Key, item.Value, nil); err != nil {
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	q.cap.batch(batch, nil, uint64(len(newValue)), oldSize)
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
 		return nil, err
 	}
+	q.cap.removed(nil, oldSize)
+	q.cap.added(nil, uint64(len(newValue)))
 
 	return item, nil
 }
@@ -232,12 +723,12 @@ func (q *Queue) UpdateString(id uint64, newValue string) (*Item, error) {
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (q *Queue) UpdateObject(id uint64, newValue interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(newValue); err != nil {
+	data, err := GobCodec.Encode(newValue)
+	if err != nil {
 		return nil, err
 	}
-	return q.Update(id, buffer.Bytes())
+
+	return q.Update(id, data)
 }
 
 // UpdateObjectAsJSON is a helper function for Update that accepts
@@ -246,12 +737,39 @@ func (q *Queue) UpdateObject(id uint64, newValue interface{}) (*Item, error) {
 //
 // Use this function to handle encoding of complex types.
 func (q *Queue) UpdateObjectAsJSON(id uint64, newValue interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(newValue)
+	data, err := JSONCodec.Encode(newValue)
 	if err != nil {
 		return nil, err
 	}
 
-	return q.Update(id, jsonBytes)
+	return q.Update(id, data)
+}
+
+// UpdateValue is a helper function for Update that accepts any value
+// type, which is then encoded into a byte slice using the codec of the
+// queue.
+func (q *Queue) UpdateValue(id uint64, newValue interface{}) (*Item, error) {
+	data, err := q.codec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Update(id, data)
+}
+
+// DecodeValue decodes the value of the given item into the value pointed
+// to by value, using the codec of the queue.
+func (q *Queue) DecodeValue(item *Item, value interface{}) error {
+	return q.codec.Decode(item.Value, value)
+}
+
+// Dropped returns the number of items dropped by the overflow policy
+// since the queue was opened.
+func (q *Queue) Dropped() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.overflow.dropped
 }
 
 // Length returns the total number of items in the queue.
@@ -259,6 +777,140 @@ func (q *Queue) Length() uint64 {
 	return q.tail - q.head
 }
 
+// SizeBytes returns the total size in bytes of the item values in the
+// queue.
+func (q *Queue) SizeBytes() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.cap.bytes
+}
+
+// Quarantine removes the corrupt item reported by the given error from
+// the queue without reading its value, keeping the data it was stored as
+// in the quarantine list. Only the item at the head of the queue can be
+// quarantined, otherwise ErrOutOfBounds is returned.
+func (q *Queue) Quarantine(corruption *ErrCorrupt) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the item is at the head of the queue.
+	if q.Length() == 0 || !bytes.Equal(corruption.Key, idToKey(q.head+1)) {
+		return ErrOutOfBounds
+	}
+
+	// Move the item to the quarantine list and remove its delivery
+	// attempts.
+	batch := new(leveldb.Batch)
+	data, err := q.corrupt.take(batch, corruption.Key)
+	if err != nil {
+		return err
+	}
+	q.dead.setAttempts(batch, corruption.Key, 0)
+	q.cap.batch(batch, nil, 0, uint64(len(data)))
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return err
+	}
+
+	// Increment head position. The size of the item is estimated from
+	// the data it was stored as.
+	q.head++
+	q.compact.consumed(corruption.Key)
+	q.cap.removed(nil, uint64(len(data)))
+
+	return nil
+}
+
+// Quarantined returns the items removed from the queue by Quarantine,
+// holding the data they were stored as.
+func (q *Queue) Quarantined() ([]*Item, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.corrupt.list()
+}
+
+// PurgeQuarantined deletes every item in the quarantine list.
+func (q *Queue) PurgeQuarantined() error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	return q.corrupt.purge()
+}
+
+// Verify deletes the blob files of the queue that no item or record
+// refers to, which can be left behind by a crash while writing or
+// removing an item, and returns their paths. It does nothing unless blob
+// files are enabled.
+func (q *Queue) Verify() ([]string, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.db.verify()
+}
+
+// Reencrypt rewrites every value of the queue that is not encrypted
+// with the current encryption key, so the keys it was encrypted with
+// before can be retired. ErrNoEncryption is returned if the queue was
+// opened without encryption keys.
+func (q *Queue) Reencrypt() error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	return q.db.reencrypt(q.sync.options())
+}
+
+// CompressionStats returns the statistics of the values compressed by
+// the queue since it was opened.
+func (q *Queue) CompressionStats() CompressionStats {
+	return q.db.comp.stats()
+}
+
+// Compact compacts the whole LevelDB database of the queue, reclaiming
+// the space of removed items and speeding up iteration over the keys
+// they left behind.
+func (q *Queue) Compact() error {
+	q.RLock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		q.RUnlock()
+		return ErrDBClosed
+	}
+
+	// Register the compaction so closing waits for it.
+	done := q.compact.begin()
+	q.RUnlock()
+	defer done()
+
+	return q.compact.compact()
+}
+
 // Close closes the LevelDB database of the queue.
 func (q *Queue) Close() error {
 	q.Lock()
@@ -269,27 +921,192 @@ func (q *Queue) Close() error {
 		return nil
 	}
 
+	// Stop group committing and compacting, and sync any pending writes.
+	if q.group != nil {
+		q.group.close()
+	}
+	q.compact.close()
+	if err := q.sync.close(); err != nil {
+		return err
+	}
+
 	// Close the LevelDB database.
 	if err := q.db.Close(); err != nil {
 		return err
 	}
 
-	// Reset queue head and tail and set
-	// isOpen to false.
+	// Reset queue head, tail, leases and dead
+	// letters and set isOpen to false.
 	q.head = 0
 	q.tail = 0
+	q.returned = nil
+	q.leases.reset()
+	q.dead.reset()
 	q.isOpen = false
 
+	// Wake any goroutines waiting for an item or for space.
+	q.notify.broadcast()
+	q.cap.reset()
+
 	return nil
 }
 
-// Drop closes and deletes the LevelDB database of the queue.
+// Drop closes and deletes the LevelDB database of the queue, or only its
+// keys if it is hosted by a Store.
 func (q *Queue) Drop() error {
 	if err := q.Close(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(q.DataDir)
+	return q.db.drop()
+}
+
+// enqueue adds an item to the queue, applying the given overflow policy
+// if it does not fit.
+func (q *Queue) enqueue(value []byte, policy overflowPolicy) (*Item, error) {
+	items, err := q.enqueueBatch([][]byte{value}, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+// enqueueBatch adds the given values to the queue as a single atomic
+// write, applying the given overflow policy if they do not fit.
+func (q *Queue) enqueueBatch(values [][]byte, policy overflowPolicy) ([]*Item, error) {
+	batch := new(leveldb.Batch)
+
+	// Check if the items fit in the queue.
+	var evicted []*Item
+	size := valuesSize(values)
+	if !q.cap.fits(q.Length(), uint64(len(values)), size) {
+		switch policy {
+		case OverflowDropNewest:
+			return q.overflow.dropValues(values), nil
+		case OverflowDropOldest:
+			var err error
+			if evicted, err = q.evict(batch, uint64(len(values)), size); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrFull
+		}
+	}
+
+	// Create new Items and add them to the batch.
+	items := make([]*Item, len(values))
+	for i, value := range values {
+		id := q.tail + uint64(i) + 1
+		items[i] = &Item{
+			ID:    id,
+			Key:   idToKey(id),
+			Value: value,
+		}
+		batch.Put(items[i].Key, items[i].Value)
+	}
+	q.cap.batch(batch, nil, size, itemsSize(evicted))
+
+	// Add them to the queue.
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment head position past any evicted items.
+	q.head += uint64(len(evicted))
+	for _, item := range evicted {
+		q.compact.consumed(item.Key)
+		q.cap.removed(nil, uint64(len(item.Value)))
+	}
+	q.overflow.drop(evicted)
+
+	// Increment tail position.
+	q.tail += uint64(len(items))
+	q.cap.added(nil, size)
+
+	// Wake any goroutines waiting for an item.
+	q.notify.broadcast()
+
+	return items, nil
+}
+
+// evict adds the removal of the items at the head of the queue that must
+// be evicted for n items holding the given number of bytes to fit to the
+// batch, and returns them. It returns ErrFull if the items would not fit
+// even in an empty queue.
+func (q *Queue) evict(batch *leveldb.Batch, n, size uint64) ([]*Item, error) {
+	if !q.cap.fitsWhenEmpty(n, size) {
+		return nil, ErrFull
+	}
+
+	var items []*Item
+	var freed uint64
+	for !q.cap.fitsAfterRemoving(q.Length(), n, size, uint64(len(items)), freed) {
+		item, err := q.getItemByID(q.head + uint64(len(items)) + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		batch.Delete(item.Key)
+		q.dead.setAttempts(batch, item.Key, 0)
+		items = append(items, item)
+		freed += uint64(len(item.Value))
+	}
+
+	return items, nil
+}
+
+// dequeueChecked removes the next item in the queue like Dequeue, unless
+// the given function returns an error for its value, in which case the
+// item is kept and returned along with the error.
+func (q *Queue) dequeueChecked(check func(value []byte) error) (*Item, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return q.dequeue(check)
+}
+
+// dequeue removes the next item in the queue and returns it, unless the
+// given function is not nil and returns an error for its value.
+func (q *Queue) dequeue(check func(value []byte) error) (*Item, error) {
+	// Return any expired leases to the queue.
+	if err := q.requeueExpired(); err != nil {
+		return nil, err
+	}
+
+	// Try to get the next item in the queue.
+	item, err := q.getItemByID(q.head + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the item if the given function rejects its value.
+	if check != nil {
+		if err := check(item.Value); err != nil {
+			return item, err
+		}
+	}
+
+	// Remove this item and its delivery attempts from the queue.
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	q.dead.setAttempts(batch, item.Key, 0)
+	q.cap.batch(batch, nil, 0, uint64(len(item.Value)))
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment head position.
+	q.head++
+	q.compact.consumed(item.Key)
+	q.cap.removed(nil, uint64(len(item.Value)))
+
+	return item, nil
 }
 
 // getItemByID returns an item, if found, for the given ID.
@@ -308,13 +1125,315 @@ func (q *Queue) getItemByID(id uint64) (*Item, error) {
 		return nil, err
 	}
 
+	// Get its delivery attempts.
+	if item.Attempts, err = q.dead.attempts(item.Key); err != nil {
+		return nil, err
+	}
+
 	return item, nil
 }
 
+// requeue puts the given item back into the queue with its delivery
+// attempts incremented, after any operations already in the batch have
+// been written along with it. The item is added to the head of the
+// queue if atHead is true, otherwise it is added to the tail. If the
+// item has failed more times than allowed, or no longer fits in the
+// queue, it is moved to the dead letter list instead.
+func (q *Queue) requeue(batch *leveldb.Batch, key, value []byte, attempts uint32, atHead bool) error {
+	attempts++
+
+	// Move the item to the dead letter list.
+	if q.dead.exceeded(attempts) || !q.cap.fits(q.Length(), 1, uint64(len(value))) {
+		id := q.dead.add(batch, key, value, attempts)
+		if err := q.db.Write(batch, q.sync.options()); err != nil {
+			return err
+		}
+		q.dead.commitAdd(id)
+
+		return nil
+	}
+
+	return q.putBack(batch, key, value, attempts, atHead)
+}
+
+// putBack adds the given item value that was dequeued from the given key
+// back into the queue with the given delivery attempts, after any
+// operations already in the batch have been written along with it. The
+// item is added to the head of the queue if atHead is true, after the
+// items put back there that were dequeued before it, otherwise it is
+// added to the tail.
+func (q *Queue) putBack(batch *leveldb.Batch, key, value []byte, attempts uint32, atHead bool) error {
+	// Find the position for the item, moving the items that go before
+	// it down to make room.
+	var from uint64
+	if len(key) == 8 {
+		from = keyToID(key)
+	}
+
+	id := q.tail + 1
+	if atHead {
+		id = q.head + returnedBefore(q.returned, q.head, q.tail, from)
+
+		for next := q.head + 1; next <= id; next++ {
+			item, err := q.getItemByID(next)
+			if err != nil {
+				return err
+			}
+			batch.Put(idToKey(next-1), item.Value)
+			q.dead.setAttempts(batch, idToKey(next-1), item.Attempts)
+		}
+	}
+
+	// Add the item and its delivery attempts to the queue.
+	newKey := idToKey(id)
+	batch.Put(newKey, value)
+	q.dead.setAttempts(batch, newKey, attempts)
+	q.cap.batch(batch, nil, uint64(len(value)), 0)
+	if err := q.db.Write(batch, q.sync.options()); err != nil {
+		return err
+	}
+
+	// Update head or tail position.
+	if atHead {
+		if q.returned == nil {
+			q.returned = make(map[uint64]uint64)
+		}
+		for next := q.head; next < id; next++ {
+			q.returned[next] = q.returned[next+1]
+		}
+		q.returned[id] = from
+		q.head--
+	} else {
+		delete(q.returned, id)
+		q.tail++
+	}
+	q.cap.added(nil, uint64(len(value)))
+
+	// Wake any goroutines waiting for an item.
+	q.notify.broadcast()
+
+	return nil
+}
+
+// restore puts the given dequeued items back at the head of the queue,
+// where the first item becomes the new head, without changing their
+// delivery attempts.
+func (q *Queue) restore(items []*Item) error {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := q.putBack(new(leveldb.Batch), items[i].Key, items[i].Value, items[i].Attempts, q.head > 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requeueLease puts the item of the lease with the given token back
+// into the queue and removes the lease.
+func (q *Queue) requeueLease(token LeaseToken, atHead bool) error {
+	// Get the leased item value.
+	value, err := q.leases.value(token)
+	if err != nil {
+		return err
+	}
+
+	// Move the lease record back to the queue.
+	l := q.leases.leases[token]
+	batch := new(leveldb.Batch)
+	batch.Delete(q.leases.key(token))
+	if err := q.requeue(batch, l.key, value, l.attempts, atHead); err != nil {
+		return err
+	}
+	q.leases.release(token)
+
+	return nil
+}
+
+// requeueExpired puts the items of all expired leases back at the head
+// of the queue, keeping the order they were leased in. If there is not
+// enough room below the head, such as after reopening a queue that was
+// fully leased out, they are added to the tail instead.
+func (q *Queue) requeueExpired() error {
+	tokens := q.leases.expired()
+
+	// Add to the tail in lease order.
+	if q.head < uint64(len(tokens)) {
+		for _, token := range tokens {
+			if err := q.requeueLease(token, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Add to the head in reverse lease order.
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if err := q.requeueLease(tokens[i], true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitGroup adds the values of the given group commit requests to the
+// queue as a single write, setting the item or error of each request and
+// the items dropped to make space for it.
+func (q *Queue) commitGroup(reqs []*commitRequest) {
+	q.Lock()
+	defer q.Unlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		for _, req := range reqs {
+			req.err = ErrDBClosed
+		}
+		return
+	}
+
+	// Apply the overflow policy to each value in turn, as if it was added
+	// after the values before it, keeping the request each drop was made
+	// for.
+	var added, dropped, droppedFor []*commitRequest
+	var evicted []*Item
+	var evictedFor []*commitRequest
+	var size, freed uint64
+	for _, req := range reqs {
+		fits := func() bool {
+			return q.cap.fitsAfterRemoving(q.Length()+uint64(len(added)), 1, size+uint64(len(req.value)), uint64(len(evicted)), freed)
+		}
+
+		// Evict the items at the head of the queue, followed by the oldest
+		// values of this group, until the value fits.
+		for q.overflow.policy == OverflowDropOldest && q.cap.fitsWhenEmpty(1, uint64(len(req.value))) && !fits() {
+			if uint64(len(evicted)) < q.Length() {
+				item, err := q.getItemByID(q.head + uint64(len(evicted)) + 1)
+				if err != nil {
+					for _, req := range reqs {
+						req.err = err
+					}
+					return
+				}
+				evicted = append(evicted, item)
+				evictedFor = append(evictedFor, req)
+				freed += uint64(len(item.Value))
+			} else {
+				dropped = append(dropped, added[0])
+				droppedFor = append(droppedFor, req)
+				size -= uint64(len(added[0].value))
+				added = added[1:]
+			}
+		}
+
+		switch {
+		case fits():
+			added = append(added, req)
+			size += uint64(len(req.value))
+		case q.overflow.policy == OverflowDropNewest:
+			dropped = append(dropped, req)
+			droppedFor = append(droppedFor, req)
+		default:
+			req.err = ErrFull
+		}
+	}
+
+	// Add the removal of the evicted items and the new Items for the
+	// added values to the batch.
+	batch := new(leveldb.Batch)
+	for _, item := range evicted {
+		batch.Delete(item.Key)
+		q.dead.setAttempts(batch, item.Key, 0)
+	}
+	for i, req := range added {
+		id := q.tail + uint64(i) + 1
+		req.item = &Item{
+			ID:    id,
+			Key:   idToKey(id),
+			Value: req.value,
+		}
+		batch.Put(req.item.Key, req.item.Value)
+	}
+
+	// Write them to the queue.
+	if batch.Len() > 0 {
+		q.cap.batch(batch, nil, size, itemsSize(evicted))
+		if err := q.db.Write(batch, q.sync.options()); err != nil {
+			for _, req := range append(added, dropped...) {
+				req.item, req.err = nil, err
+			}
+			return
+		}
+	}
+
+	// Increment head position past any evicted items.
+	q.head += uint64(len(evicted))
+	for _, item := range evicted {
+		q.compact.consumed(item.Key)
+		q.cap.removed(nil, uint64(len(item.Value)))
+	}
+
+	// Drop the evicted items and the values that were not added, leaving
+	// them to be passed to the callback by the requests they were dropped
+	// for.
+	for i, item := range evicted {
+		evictedFor[i].dropped = append(evictedFor[i].dropped, item)
+	}
+	for i, req := range dropped {
+		req.item = &Item{Value: req.value}
+		droppedFor[i].dropped = append(droppedFor[i].dropped, req.item)
+		evicted = append(evicted, req.item)
+	}
+	q.overflow.count(evicted)
+	if len(added) == 0 {
+		return
+	}
+
+	// Increment tail position.
+	q.tail += uint64(len(added))
+	q.cap.added(nil, size)
+
+	// Wake any goroutines waiting for an item.
+	q.notify.broadcast()
+}
+
+// getItemRange returns every item with a key in the given range.
+func (q *Queue) getItemRange(start, limit []byte) ([]*Item, error) {
+	// Get the delivery attempts of the items.
+	attempts, err := q.dead.attemptsRange(start, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get items from database.
+	iter := q.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer iter.Release()
+
+	var items []*Item
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		items = append(items, &Item{
+			ID:       keyToID(key),
+			Key:      key,
+			Value:    append([]byte{}, iter.Value()...),
+			Attempts: attempts[string(key)],
+		})
+	}
+
+	return items, iter.Error()
+}
+
 // init initializes the queue data.
 func (q *Queue) init() error {
 	// Create a new LevelDB Iterator.
-	iter := q.db.NewIterator(nil, nil)
+	iter := q.db.NewIterator(itemRange(), nil)
 	defer iter.Release()
 
 	// Set queue head to the first item.
@@ -327,5 +1446,25 @@ func (q *Queue) init() error {
 		q.tail = keyToID(iter.Key())
 	}
 
-	return iter.Error()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// Load the size of the items.
+	if err := q.cap.load(itemRange(), nil, nil, false); err != nil {
+		return err
+	}
+
+	// Load the dead letter list.
+	if err := q.dead.load(); err != nil {
+		return err
+	}
+
+	// Return leases left over from a previous process to the queue.
+	if err := q.leases.load(); err != nil {
+		return err
+	}
+	q.leases.expireAll()
+
+	return q.requeueExpired()
 }
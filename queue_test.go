@@ -1,8 +1,12 @@
 package goque
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -52,464 +56,678 @@ func TestQueueDrop(t *testing.T) {
 	}
 }
 
-func TestQueueIncompatibleType(t *testing.T) {
+func TestQueueOpenWithOptions(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	pq, err := OpenPriorityQueue(file, ASC)
+	opts := &Options{
+		WriteBuffer:            1 << 20,
+		BlockCacheCapacity:     1 << 20,
+		OpenFilesCacheCapacity: 16,
+		NoCompression:          true,
+		Durability:             SyncEveryWrite,
+	}
+	q, err := OpenQueueWithOptions(file, opts)
 	if err != nil {
 		t.Error(err)
 	}
-	defer pq.Drop()
-	pq.Close()
+	defer q.Drop()
 
-	if _, err = OpenQueue(file); err != ErrIncompatibleType {
-		t.Error("Expected priority queue to return ErrIncompatibleTypes when opening goquePriorityQueue")
+	if _, err = q.EnqueueString("value"); err != nil {
+		t.Error(err)
 	}
-}
 
-func TestQueueEnqueue(t *testing.T) {
-	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q.Close()
+
+	q, err = OpenQueueWithOptions(file, opts)
 	if err != nil {
 		t.Error(err)
 	}
-	defer q.Drop()
+	defer q.Close()
 
-	for i := 1; i <= 10; i++ {
-		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
-			t.Error(err)
-		}
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
 	}
 
-	if q.Length() != 10 {
-		t.Errorf("Expected queue size of 10, got %d", q.Length())
+	if deqItem.ToString() != "value" {
+		t.Errorf("Expected string to be 'value', got '%s'", deqItem.ToString())
 	}
 }
 
-func TestQueueDequeue(t *testing.T) {
+func TestQueueSyncPeriodic(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{Durability: SyncPeriodic, SyncInterval: 10 * time.Millisecond})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	for i := 1; i <= 10; i++ {
-		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
-			t.Error(err)
-		}
+	if _, err = q.EnqueueString("value"); err != nil {
+		t.Error(err)
 	}
 
-	if q.Length() != 10 {
-		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	// Wait for the pending write to be synced.
+	for i := 0; i < 100 && atomic.LoadUint32(&q.sync.pending) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
 
-	deqItem, err := q.Dequeue()
-	if err != nil {
-		t.Error(err)
+	if atomic.LoadUint32(&q.sync.pending) != 0 {
+		t.Error("Expected pending write to have been synced")
 	}
 
-	if q.Length() != 9 {
-		t.Errorf("Expected queue length of 9, got %d", q.Length())
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
 	}
 
-	compStr := "value for item 1"
-
-	if deqItem.ToString() != compStr {
-		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	if err = q.Close(); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestQueueEncodeDecodePointerJSON(t *testing.T) {
+func TestQueueSyncPeriodicDefaultInterval(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{Durability: SyncPeriodic})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	type subObject struct {
-		Value *int
+	if q.sync.stop == nil {
+		t.Error("Expected pending writes to be synced periodically without an interval")
 	}
+}
 
-	type object struct {
-		Value     int
-		SubObject subObject
+func TestQueueGroupCommit(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{GroupCommit: true, GroupCommitSize: 8, Durability: SyncEveryWrite})
+	if err != nil {
+		t.Error(err)
 	}
+	defer q.Drop()
 
-	val := 0
-	obj := object{
-		Value: 0,
-		SubObject: subObject{
-			Value: &val,
-		},
-	}
+	var wg sync.WaitGroup
+	ids := make([]uint64, 50)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
 
-	if _, err = q.EnqueueObjectAsJSON(obj); err != nil {
-		t.Error(err)
+			item, err := q.EnqueueString(fmt.Sprintf("value for item %d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = item.ID
+		}(i)
 	}
+	wg.Wait()
 
-	item, err := q.Dequeue()
-	if err != nil {
-		t.Error(err)
+	if q.Length() != 50 {
+		t.Errorf("Expected queue length of 50, got %d", q.Length())
 	}
 
-	var itemObj object
-	if err := item.ToObjectFromJSON(&itemObj); err != nil {
-		t.Error(err)
+	// Every item should have been given its own ID.
+	for i, id := range ids {
+		peekItem, err := q.PeekByID(id)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if peekItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+		}
 	}
 
-	if *itemObj.SubObject.Value != 0 {
-		t.Errorf("Expected object subobject value to be '0', got '%v'", *itemObj.SubObject.Value)
+	q.Close()
+
+	if _, err = q.EnqueueString("value"); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
 	}
 }
 
-func TestQueuePeek(t *testing.T) {
+func TestQueueCompact(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{CompactionThreshold: 10})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	compStr := "value for item"
+	for i := 1; i <= 50; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
 
-	if _, err = q.EnqueueString(compStr); err != nil {
+	for i := 1; i <= 25; i++ {
+		if _, err = q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = q.DequeueN(10); err != nil {
 		t.Error(err)
 	}
 
-	peekItem, err := q.Peek()
+	if err = q.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q.Dequeue()
 	if err != nil {
 		t.Error(err)
 	}
 
-	if peekItem.ToString() != compStr {
-		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	if deqItem.ToString() != "value for item 36" {
+		t.Errorf("Expected string to be 'value for item 36', got '%s'", deqItem.ToString())
 	}
 
-	if q.Length() != 1 {
-		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	q.Close()
+
+	if err = q.Compact(); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
 	}
 }
 
-func TestQueuePeekByOffset(t *testing.T) {
+func TestQueueMaxItems(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{MaxItems: 5})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	for i := 1; i <= 10; i++ {
+	for i := 1; i <= 5; i++ {
 		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 
-	compStrFirst := "value for item 1"
-	compStrLast := "value for item 10"
-	compStr := "value for item 4"
+	if _, err = q.EnqueueString("value for item 6"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
 
-	peekFirstItem, err := q.PeekByOffset(0)
-	if err != nil {
+	if _, err = q.Dequeue(); err != nil {
 		t.Error(err)
 	}
 
-	if peekFirstItem.ToString() != compStrFirst {
-		t.Errorf("Expected string to be '%s', got '%s'", compStrFirst, peekFirstItem.ToString())
+	if _, err = q.EnqueueBatch([][]byte{[]byte("value for item 6"), []byte("value for item 7")}); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
 	}
 
-	peekLastItem, err := q.PeekByOffset(9)
-	if err != nil {
+	if _, err = q.EnqueueString("value for item 6"); err != nil {
 		t.Error(err)
 	}
 
-	if peekLastItem.ToString() != compStrLast {
-		t.Errorf("Expected string to be '%s', got '%s'", compStrLast, peekLastItem.ToString())
+	if q.Length() != 5 {
+		t.Errorf("Expected queue length of 5, got %d", q.Length())
 	}
+}
 
-	peekItem, err := q.PeekByOffset(3)
+func TestQueueMaxBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{MaxBytes: 10})
 	if err != nil {
 		t.Error(err)
 	}
+	defer q.Drop()
 
-	if peekItem.ToString() != compStr {
-		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	if _, err = q.EnqueueString("12345"); err != nil {
+		t.Error(err)
 	}
 
-	if q.Length() != 10 {
-		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	if _, err = q.EnqueueString("123456"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
 	}
-}
 
-func TestQueuePeekByID(t *testing.T) {
-	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
-	if err != nil {
+	if _, err = q.UpdateString(1, "1234567890"); err != nil {
 		t.Error(err)
 	}
-	defer q.Drop()
 
-	for i := 1; i <= 10; i++ {
-		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
-			t.Error(err)
-		}
+	if _, err = q.UpdateString(1, "12345678901"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
 	}
 
-	compStr := "value for item 3"
+	if _, err = q.UpdateString(1, "12345"); err != nil {
+		t.Error(err)
+	}
 
-	peekItem, err := q.PeekByID(3)
+	q.Close()
+
+	q, err = OpenQueueWithOptions(file, &Options{MaxBytes: 10})
 	if err != nil {
 		t.Error(err)
 	}
 
-	if peekItem.ToString() != compStr {
-		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	if _, err = q.EnqueueString("123456"); err != ErrFull {
+		t.Errorf("Expected to get full error after reopening, got %v", err)
 	}
 
-	if q.Length() != 10 {
-		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	if _, err = q.EnqueueString("12345"); err != nil {
+		t.Error(err)
 	}
 }
 
-func TestQueueUpdate(t *testing.T) {
+func TestQueueEnqueueWait(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{MaxItems: 1})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	for i := 1; i <= 10; i++ {
-		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
-			t.Error(err)
-		}
-	}
-
-	item, err := q.PeekByID(3)
-	if err != nil {
+	if _, err = q.EnqueueString("value for item 1"); err != nil {
 		t.Error(err)
 	}
 
-	oldCompStr := "value for item 3"
-	newCompStr := "new value for item 3"
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Dequeue()
+	}()
 
-	if item.ToString() != oldCompStr {
-		t.Errorf("Expected string to be '%s', got '%s'", oldCompStr, item.ToString())
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 
-	updatedItem, err := q.Update(item.ID, []byte(newCompStr))
+	item, err := q.EnqueueWait(ctx, []byte("value for item 2"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	if updatedItem.ToString() != newCompStr {
-		t.Errorf("Expected current item value to be '%s', got '%s'", newCompStr, item.ToString())
+	if item.ID != 2 {
+		t.Errorf("Expected item ID to be 2, got %d", item.ID)
 	}
 
-	newItem, err := q.PeekByID(3)
-	if err != nil {
-		t.Error(err)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+
+	if _, err = q.EnqueueWait(shortCtx, []byte("value for item 3")); err != context.DeadlineExceeded {
+		t.Errorf("Expected to get deadline exceeded error, got %v", err)
 	}
 
-	if newItem.ToString() != newCompStr {
-		t.Errorf("Expected new item value to be '%s', got '%s'", newCompStr, item.ToString())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+
+	if _, err = q.EnqueueWait(ctx, []byte("value for item 3")); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
 	}
 }
 
-func TestQueueUpdateString(t *testing.T) {
+func TestQueueOverflowDropNewest(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{MaxItems: 3, Overflow: OverflowDropNewest})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	for i := 1; i <= 10; i++ {
+	for i := 1; i <= 5; i++ {
 		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 
-	item, err := q.PeekByID(3)
+	item, err := q.EnqueueString("value for item 6")
 	if err != nil {
 		t.Error(err)
 	}
 
-	oldCompStr := "value for item 3"
-	newCompStr := "new value for item 3"
-
-	if item.ToString() != oldCompStr {
-		t.Errorf("Expected string to be '%s', got '%s'", oldCompStr, item.ToString())
+	if item.ID != 0 {
+		t.Errorf("Expected dropped item ID to be 0, got %d", item.ID)
 	}
 
-	updatedItem, err := q.UpdateString(item.ID, newCompStr)
-	if err != nil {
-		t.Error(err)
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
 	}
 
-	if updatedItem.ToString() != newCompStr {
-		t.Errorf("Expected current item value to be '%s', got '%s'", newCompStr, item.ToString())
+	if q.Dropped() != 3 {
+		t.Errorf("Expected 3 dropped items, got %d", q.Dropped())
 	}
 
-	newItem, err := q.PeekByID(3)
+	deqItem, err := q.Dequeue()
 	if err != nil {
 		t.Error(err)
 	}
 
-	if newItem.ToString() != newCompStr {
-		t.Errorf("Expected new item value to be '%s', got '%s'", newCompStr, item.ToString())
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
 	}
 }
 
-func TestQueueUpdateObject(t *testing.T) {
+func TestQueueOverflowOnDropUsesQueue(t *testing.T) {
+	var q *Queue
+	var lengths []uint64
+
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{
+		MaxItems: 2,
+		Overflow: OverflowDropOldest,
+		OnDrop: func(item *Item) {
+			// The queue is unlocked, so its methods can be called.
+			if _, err := q.Peek(); err != nil {
+				t.Error(err)
+			}
+			lengths = append(lengths, q.Length())
+		},
+	})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	type object struct {
-		Value int
-	}
-
-	for i := 1; i <= 10; i++ {
-		if _, err = q.EnqueueObject(object{i}); err != nil {
+	for i := 1; i <= 4; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
 			t.Error(err)
 		}
 	}
 
-	item, err := q.PeekByID(3)
+	if len(lengths) != 2 || lengths[0] != 2 || lengths[1] != 2 {
+		t.Errorf("Expected callback to see a queue length of 2 twice, got %v", lengths)
+	}
+}
+
+func TestQueueOverflowDropOldest(t *testing.T) {
+	var dropped []string
+
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	opts := &Options{
+		MaxItems: 3,
+		Overflow: OverflowDropOldest,
+		OnDrop: func(item *Item) {
+			dropped = append(dropped, item.ToString())
+		},
+	}
+	q, err := OpenQueueWithOptions(file, opts)
 	if err != nil {
 		t.Error(err)
 	}
+	defer q.Drop()
 
-	oldCompObj := object{3}
-	newCompObj := object{33}
+	for i := 1; i <= 5; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
 
-	var obj object
-	if err := item.ToObject(&obj); err != nil {
+	if _, err = q.EnqueueBatch([][]byte{[]byte("value for item 6"), []byte("value for item 7")}); err != nil {
 		t.Error(err)
 	}
 
-	if obj != oldCompObj {
-		t.Errorf("Expected object to be '%+v', got '%+v'", oldCompObj, obj)
+	if _, err = q.EnqueueBatch([][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")}); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
 	}
 
-	updatedItem, err := q.UpdateObject(item.ID, newCompObj)
-	if err != nil {
-		t.Error(err)
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
 	}
 
-	if err := updatedItem.ToObject(&obj); err != nil {
-		t.Error(err)
+	if q.Dropped() != 4 {
+		t.Errorf("Expected 4 dropped items, got %d", q.Dropped())
 	}
 
-	if obj != newCompObj {
-		t.Errorf("Expected current object to be '%+v', got '%+v'", newCompObj, obj)
+	for i, value := range dropped {
+		compStr := fmt.Sprintf("value for item %d", i+1)
+
+		if value != compStr {
+			t.Errorf("Expected dropped string to be '%s', got '%s'", compStr, value)
+		}
 	}
 
-	newItem, err := q.PeekByID(3)
+	q.Close()
+
+	q, err = OpenQueueWithOptions(file, opts)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if err := newItem.ToObject(&obj); err != nil {
-		t.Error(err)
-	}
+	for i := 5; i <= 7; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
 
-	if obj != newCompObj {
-		t.Errorf("Expected new object to be '%+v', got '%+v'", newCompObj, obj)
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
 	}
 }
 
-func TestQueueUpdateObjectAsJSON(t *testing.T) {
+func TestQueueGroupCommitOverflow(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
-	q, err := OpenQueue(file)
+	q, err := OpenQueueWithOptions(file, &Options{
+		MaxBytes:    100,
+		Overflow:    OverflowDropOldest,
+		GroupCommit: true,
+	})
 	if err != nil {
 		t.Error(err)
 	}
 	defer q.Drop()
 
-	type subObject struct {
-		Value *int
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.Enqueue([]byte("0123456789")); err != nil {
+				t.Error(err)
+			}
+		}()
 	}
+	wg.Wait()
 
-	type object struct {
-		Value     int
-		SubObject subObject
+	if q.Length() != 10 {
+		t.Errorf("Expected queue length of 10, got %d", q.Length())
 	}
 
-	for i := 1; i <= 10; i++ {
-		obj := object{
-			Value: i,
-			SubObject: subObject{
-				Value: &i,
-			},
+	if q.Dropped() != 90 {
+		t.Errorf("Expected 90 dropped items, got %d", q.Dropped())
+	}
+}
+
+func TestQueueGroupCommitOnDropEnqueues(t *testing.T) {
+	var q *Queue
+	var dropped []string
+
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{
+		MaxItems:    1,
+		Overflow:    OverflowDropOldest,
+		GroupCommit: true,
+		OnDrop: func(item *Item) {
+			dropped = append(dropped, item.ToString())
+
+			// The callback runs outside of the group committer, so it can
+			// enqueue.
+			if len(dropped) == 1 {
+				if _, err := q.EnqueueString("value for item 3"); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 2; i++ {
+			if _, err := q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
 		}
+	}()
 
-		if _, err = q.EnqueueObjectAsJSON(obj); err != nil {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected enqueue to return, but it blocked")
+	}
+
+	if len(dropped) != 2 || dropped[0] != "value for item 1" || dropped[1] != "value for item 2" {
+		t.Errorf("Expected items 1 and 2 to be dropped, got %v", dropped)
+	}
+
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 3"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+}
+
+func TestQueueSizeBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString("0123456789"); err != nil {
 			t.Error(err)
 		}
 	}
 
-	item, err := q.PeekByID(3)
+	if _, err = q.UpdateString(10, "01234"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.Dequeue(); err != nil {
+		t.Error(err)
+	}
+
+	if q.SizeBytes() != 85 {
+		t.Errorf("Expected size of 85 bytes, got %d", q.SizeBytes())
+	}
+
+	q.Close()
+
+	q, err = OpenQueue(file)
 	if err != nil {
 		t.Error(err)
 	}
 
-	oldCompObjVal := 3
-	oldCompObj := object{
-		Value: 3,
-		SubObject: subObject{
-			Value: &oldCompObjVal,
-		},
+	if q.SizeBytes() != 85 {
+		t.Errorf("Expected size of 85 bytes after reopening, got %d", q.SizeBytes())
 	}
-	newCompObjVal := 33
-	newCompObj := object{
-		Value: 33,
-		SubObject: subObject{
-			Value: &newCompObjVal,
-		},
+
+	if _, err = q.EnqueueString("01234"); err != nil {
+		t.Error(err)
 	}
 
-	var obj object
-	if err := item.ToObjectFromJSON(&obj); err != nil {
+	// The sizes are saved along with every write.
+	rec, err := q.db.Get(q.cap.key, nil)
+	if err != nil || !bytes.Equal(rec, idToKey(90)) {
+		t.Errorf("Expected saved size of 90 bytes, got '%x' and %v", rec, err)
+	}
+
+	// Close the database without closing the queue, as if the process
+	// had crashed.
+	if err = q.db.Close(); err != nil {
 		t.Error(err)
 	}
+	q.isOpen = false
 
-	if *obj.SubObject.Value != *oldCompObj.SubObject.Value {
-		t.Errorf("Expected object subobject value to be '%+v', got '%+v'", *oldCompObj.SubObject.Value, *obj.SubObject.Value)
+	q, err = OpenQueue(file)
+	if err != nil {
+		t.Error(err)
 	}
 
-	updatedItem, err := q.UpdateObjectAsJSON(item.ID, newCompObj)
+	if q.SizeBytes() != 90 {
+		t.Errorf("Expected size of 90 bytes after a crash, got %d", q.SizeBytes())
+	}
+}
+
+func TestQueueIncompatibleType(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, ASC)
 	if err != nil {
 		t.Error(err)
 	}
+	defer pq.Drop()
+	pq.Close()
 
-	if err := updatedItem.ToObjectFromJSON(&obj); err != nil {
+	if _, err = OpenQueue(file); err != ErrIncompatibleType {
+		t.Error("Expected priority queue to return ErrIncompatibleTypes when opening goquePriorityQueue")
+	}
+}
+
+func TestQueueEnqueue(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
 		t.Error(err)
 	}
+	defer q.Drop()
 
-	if *obj.SubObject.Value != *newCompObj.SubObject.Value {
-		t.Errorf("Expected current object subobject value to be '%+v', got '%+v'", *newCompObj.SubObject.Value, *obj.SubObject.Value)
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
 	}
 
-	newItem, err := q.PeekByID(3)
+	if q.Length() != 10 {
+		t.Errorf("Expected queue size of 10, got %d", q.Length())
+	}
+}
+
+func TestQueueEnqueueBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
 	if err != nil {
 		t.Error(err)
 	}
+	defer q.Drop()
 
-	if err := newItem.ToObjectFromJSON(&obj); err != nil {
+	if _, err = q.EnqueueString("value for item 1"); err != nil {
 		t.Error(err)
 	}
 
-	if *obj.SubObject.Value != *newCompObj.SubObject.Value {
-		t.Errorf("Expected current object subobject value to be '%+v', got '%+v'", *newCompObj.SubObject.Value, *obj.SubObject.Value)
+	values := [][]byte{[]byte("value for item 2"), []byte("value for item 3")}
+	items, err := q.EnqueueBatch(values)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 2 || items[0].ID != 2 || items[1].ID != 3 {
+		t.Errorf("Expected items with IDs 2 and 3, got %v", items)
+	}
+
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
+	}
+
+	for i := 1; i <= 3; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
 	}
 }
 
-func TestQueueUpdateOutOfBounds(t *testing.T) {
+func TestQueueDequeue(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	q, err := OpenQueue(file)
 	if err != nil {
@@ -536,16 +754,76 @@ func TestQueueUpdateOutOfBounds(t *testing.T) {
 		t.Errorf("Expected queue length of 9, got %d", q.Length())
 	}
 
-	if _, err = q.Update(deqItem.ID, []byte(`new value`)); err != ErrOutOfBounds {
-		t.Errorf("Expected to get queue out of bounds error, got %s", err.Error())
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
 	}
+}
 
-	if _, err = q.Update(deqItem.ID+1, []byte(`new value`)); err != nil {
+func TestQueueDequeueN(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 5; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Fail the head item so it has a delivery attempt.
+	item, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+	if err = q.Fail(item); err != nil {
+		t.Error(err)
+	}
+
+	items, err := q.DequeueN(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(items))
+	}
+
+	for i, item := range items {
+		compStr := fmt.Sprintf("value for item %d", i+1)
+
+		if item.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+		}
+	}
+
+	if items[0].Attempts != 1 {
+		t.Errorf("Expected attempts of 1, got %d", items[0].Attempts)
+	}
+
+	if q.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", q.Length())
+	}
+
+	items, err = q.DequeueN(10)
+	if err != nil {
 		t.Error(err)
 	}
+
+	if len(items) != 2 || items[1].ToString() != "value for item 5" {
+		t.Errorf("Expected the remaining 2 items, got %v", items)
+	}
+
+	if _, err = q.DequeueN(1); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
 }
 
-func TestQueueEmpty(t *testing.T) {
+func TestQueueEncodeDecodePointerJSON(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	q, err := OpenQueue(file)
 	if err != nil {
@@ -553,23 +831,71 @@ func TestQueueEmpty(t *testing.T) {
 	}
 	defer q.Drop()
 
-	_, err = q.EnqueueString("value for item")
+	type subObject struct {
+		Value *int
+	}
+
+	type object struct {
+		Value     int
+		SubObject subObject
+	}
+
+	val := 0
+	obj := object{
+		Value: 0,
+		SubObject: subObject{
+			Value: &val,
+		},
+	}
+
+	if _, err = q.EnqueueObjectAsJSON(obj); err != nil {
+		t.Error(err)
+	}
+
+	item, err := q.Dequeue()
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, err = q.Dequeue()
+	var itemObj object
+	if err := item.ToObjectFromJSON(&itemObj); err != nil {
+		t.Error(err)
+	}
+
+	if *itemObj.SubObject.Value != 0 {
+		t.Errorf("Expected object subobject value to be '0', got '%v'", *itemObj.SubObject.Value)
+	}
+}
+
+func TestQueuePeek(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
 	if err != nil {
 		t.Error(err)
 	}
+	defer q.Drop()
 
-	_, err = q.Dequeue()
-	if err != ErrEmpty {
-		t.Errorf("Expected to get empty error, got %s", err.Error())
+	compStr := "value for item"
+
+	if _, err = q.EnqueueString(compStr); err != nil {
+		t.Error(err)
+	}
+
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
 	}
 }
 
-func TestQueueOutOfBounds(t *testing.T) {
+func TestQueuePeekByOffset(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	q, err := OpenQueue(file)
 	if err != nil {
@@ -577,14 +903,1002 @@ func TestQueueOutOfBounds(t *testing.T) {
 	}
 	defer q.Drop()
 
-	_, err = q.EnqueueString("value for item")
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	compStrFirst := "value for item 1"
+	compStrLast := "value for item 10"
+	compStr := "value for item 4"
+
+	peekFirstItem, err := q.PeekByOffset(0)
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, err = q.PeekByOffset(2)
-	if err != ErrOutOfBounds {
-		t.Errorf("Expected to get queue out of bounds error, got %s", err.Error())
+	if peekFirstItem.ToString() != compStrFirst {
+		t.Errorf("Expected string to be '%s', got '%s'", compStrFirst, peekFirstItem.ToString())
+	}
+
+	peekLastItem, err := q.PeekByOffset(9)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekLastItem.ToString() != compStrLast {
+		t.Errorf("Expected string to be '%s', got '%s'", compStrLast, peekLastItem.ToString())
+	}
+
+	peekItem, err := q.PeekByOffset(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	if q.Length() != 10 {
+		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	}
+}
+
+func TestQueuePeekByID(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	compStr := "value for item 3"
+
+	peekItem, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	if q.Length() != 10 {
+		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	}
+}
+
+func TestQueueUpdate(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	oldCompStr := "value for item 3"
+	newCompStr := "new value for item 3"
+
+	if item.ToString() != oldCompStr {
+		t.Errorf("Expected string to be '%s', got '%s'", oldCompStr, item.ToString())
+	}
+
+	updatedItem, err := q.Update(item.ID, []byte(newCompStr))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if updatedItem.ToString() != newCompStr {
+		t.Errorf("Expected current item value to be '%s', got '%s'", newCompStr, item.ToString())
+	}
+
+	newItem, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if newItem.ToString() != newCompStr {
+		t.Errorf("Expected new item value to be '%s', got '%s'", newCompStr, item.ToString())
+	}
+}
+
+func TestQueueUpdateString(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	oldCompStr := "value for item 3"
+	newCompStr := "new value for item 3"
+
+	if item.ToString() != oldCompStr {
+		t.Errorf("Expected string to be '%s', got '%s'", oldCompStr, item.ToString())
+	}
+
+	updatedItem, err := q.UpdateString(item.ID, newCompStr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if updatedItem.ToString() != newCompStr {
+		t.Errorf("Expected current item value to be '%s', got '%s'", newCompStr, item.ToString())
+	}
+
+	newItem, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if newItem.ToString() != newCompStr {
+		t.Errorf("Expected new item value to be '%s', got '%s'", newCompStr, item.ToString())
+	}
+}
+
+func TestQueueUpdateObject(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	type object struct {
+		Value int
+	}
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueObject(object{i}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	oldCompObj := object{3}
+	newCompObj := object{33}
+
+	var obj object
+	if err := item.ToObject(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if obj != oldCompObj {
+		t.Errorf("Expected object to be '%+v', got '%+v'", oldCompObj, obj)
+	}
+
+	updatedItem, err := q.UpdateObject(item.ID, newCompObj)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := updatedItem.ToObject(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if obj != newCompObj {
+		t.Errorf("Expected current object to be '%+v', got '%+v'", newCompObj, obj)
+	}
+
+	newItem, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := newItem.ToObject(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if obj != newCompObj {
+		t.Errorf("Expected new object to be '%+v', got '%+v'", newCompObj, obj)
+	}
+}
+
+func TestQueueUpdateObjectAsJSON(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	type subObject struct {
+		Value *int
+	}
+
+	type object struct {
+		Value     int
+		SubObject subObject
+	}
+
+	for i := 1; i <= 10; i++ {
+		obj := object{
+			Value: i,
+			SubObject: subObject{
+				Value: &i,
+			},
+		}
+
+		if _, err = q.EnqueueObjectAsJSON(obj); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	oldCompObjVal := 3
+	oldCompObj := object{
+		Value: 3,
+		SubObject: subObject{
+			Value: &oldCompObjVal,
+		},
+	}
+	newCompObjVal := 33
+	newCompObj := object{
+		Value: 33,
+		SubObject: subObject{
+			Value: &newCompObjVal,
+		},
+	}
+
+	var obj object
+	if err := item.ToObjectFromJSON(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if *obj.SubObject.Value != *oldCompObj.SubObject.Value {
+		t.Errorf("Expected object subobject value to be '%+v', got '%+v'", *oldCompObj.SubObject.Value, *obj.SubObject.Value)
+	}
+
+	updatedItem, err := q.UpdateObjectAsJSON(item.ID, newCompObj)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := updatedItem.ToObjectFromJSON(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if *obj.SubObject.Value != *newCompObj.SubObject.Value {
+		t.Errorf("Expected current object subobject value to be '%+v', got '%+v'", *newCompObj.SubObject.Value, *obj.SubObject.Value)
+	}
+
+	newItem, err := q.PeekByID(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := newItem.ToObjectFromJSON(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if *obj.SubObject.Value != *newCompObj.SubObject.Value {
+		t.Errorf("Expected current object subobject value to be '%+v', got '%+v'", *newCompObj.SubObject.Value, *obj.SubObject.Value)
+	}
+}
+
+func TestQueueUpdateOutOfBounds(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if q.Length() != 10 {
+		t.Errorf("Expected queue length of 10, got %d", q.Length())
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if q.Length() != 9 {
+		t.Errorf("Expected queue length of 9, got %d", q.Length())
+	}
+
+	if _, err = q.Update(deqItem.ID, []byte(`new value`)); err != ErrOutOfBounds {
+		t.Errorf("Expected to get queue out of bounds error, got %s", err.Error())
+	}
+
+	if _, err = q.Update(deqItem.ID+1, []byte(`new value`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueueEmpty(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.EnqueueString("value for item")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = q.Dequeue()
+	if err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %s", err.Error())
+	}
+}
+
+func TestQueueOutOfBounds(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.EnqueueString("value for item")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = q.PeekByOffset(2)
+	if err != ErrOutOfBounds {
+		t.Errorf("Expected to get queue out of bounds error, got %s", err.Error())
+	}
+}
+
+func TestQueueDequeueLeaseAck(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	item, token, err := q.DequeueLease(time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if item.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+	}
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	}
+
+	if err = q.Ack(token); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Ack(token); err != ErrInvalidLease {
+		t.Errorf("Expected to get invalid lease error, got %v", err)
+	}
+
+	q.Close()
+	if q, err = OpenQueue(file); err != nil {
+		t.Error(err)
+	}
+	defer q.Close()
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	}
+}
+
+func TestQueueDequeueLeaseNack(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, token, err := q.DequeueLease(time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Nack(token); err != nil {
+		t.Error(err)
+	}
+
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestQueueDequeueLeaseNackOrder(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 4; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var tokens []LeaseToken
+	for i := 1; i <= 3; i++ {
+		_, token, err := q.DequeueLease(time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	// Returned items keep the order they were dequeued in, whatever
+	// order they are returned in.
+	for _, i := range []int{0, 2, 1} {
+		if err = q.Nack(tokens[i]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ID != uint64(i) || deqItem.ToString() != compStr {
+			t.Errorf("Expected item %d with string '%s', got item %d with '%s'", i, compStr, deqItem.ID, deqItem.ToString())
+		}
+	}
+}
+
+func TestQueueDequeueLeaseNackFull(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueueWithOptions(file, &Options{MaxItems: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, token, err := q.DequeueLease(time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value for item 3"); err != nil {
+		t.Error(err)
+	}
+
+	// The queue is full, so the returned item is moved to the dead letter
+	// list.
+	if err = q.Nack(token); err != nil {
+		t.Error(err)
+	}
+
+	if q.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", q.Length())
+	}
+
+	letters, err := q.DeadLetters()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if len(letters) != 1 || letters[0].ToString() != compStr {
+		t.Fatalf("Expected item 1 to be a dead letter, got %d dead letters", len(letters))
+	}
+}
+
+func TestQueueDequeueLeaseExpired(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, token, err := q.DequeueLease(10 * time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err = q.Ack(token); err != ErrInvalidLease {
+		t.Errorf("Expected to get invalid lease error, got %v", err)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	}
+}
+
+func TestQueueDequeueLeaseReopen(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		if _, _, err = q.DequeueLease(time.Minute); err != nil {
+			t.Error(err)
+		}
+	}
+
+	q.Close()
+	if q, err = OpenQueue(file); err != nil {
+		t.Error(err)
+	}
+	defer q.Close()
+
+	if q.Length() != 2 {
+		t.Errorf("Expected queue length of 2, got %d", q.Length())
+	}
+
+	for i := 1; i <= 2; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.EnqueueString("value for item")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deqItem, err := q.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compStr := "value for item"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+
+	if _, err = q.DequeueWait(shortCtx); err != context.DeadlineExceeded {
+		t.Errorf("Expected to get deadline exceeded error, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+
+	if _, err = q.DequeueWait(ctx); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestQueueDequeueWaitLeaseExpired(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	if _, err = q.EnqueueString("value for item"); err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err = q.DequeueLease(10 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deqItem, err := q.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deqItem.Attempts != 1 {
+		t.Errorf("Expected item attempts of 1, got %d", deqItem.Attempts)
+	}
+}
+
+func TestQueueConsume(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 5; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := q.Consume(ctx, 2)
+
+	received := 0
+	item := <-ch
+	received++
+
+	compStr := "value for item 1"
+
+	if item.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+	}
+
+	cancel()
+	for range ch {
+		received++
+	}
+
+	if q.Length() != uint64(5-received) {
+		t.Errorf("Expected queue length of %d, got %d", 5-received, q.Length())
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = fmt.Sprintf("value for item %d", received+1)
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestQueueConsumeCancelWaiting(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	var consumeErr error
+	q, err := OpenQueueWithOptions(file, &Options{
+		OnConsumeError: func(err error) { consumeErr = err },
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 3; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := q.Consume(ctx, 4)
+
+	// Wait for every item to be buffered, leaving the goroutine waiting
+	// for another item.
+	for {
+		if _, err = q.Peek(); err == ErrEmpty {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Wait for the buffered items to be put back before receiving.
+	cancel()
+	for i := 0; i < 1000; i++ {
+		if _, err = q.Peek(); err != ErrEmpty {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for range ch {
+		t.Error("Expected no items to be received after cancelling")
+	}
+
+	if consumeErr != nil {
+		t.Error(consumeErr)
+	}
+
+	if q.Length() != 3 {
+		t.Errorf("Expected queue length of 3, got %d", q.Length())
+	}
+
+	for i := 1; i <= 3; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestQueueFail(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Fail(deqItem); err != nil {
+		t.Error(err)
+	}
+
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.ToString() != deqItem.ToString() {
+		t.Errorf("Expected string to be '%s', got '%s'", deqItem.ToString(), peekItem.ToString())
+	}
+
+	if peekItem.Attempts != 1 {
+		t.Errorf("Expected item attempts of 1, got %d", peekItem.Attempts)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.SetMaxAttempts(1)
+
+	for i := 1; i <= 2; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		_, token, err := q.DequeueLease(time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if err = q.Nack(token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if q.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", q.Length())
+	}
+
+	if q.DeadLetterLength() != 1 {
+		t.Errorf("Expected dead letter length of 1, got %d", q.DeadLetterLength())
+	}
+
+	letters, err := q.DeadLetters()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if len(letters) != 1 || letters[0].ToString() != compStr || letters[0].Attempts != 2 {
+		t.Fatalf("Expected one dead letter '%s' with 2 attempts, got %v", compStr, letters)
+	}
+
+	if _, err = q.RequeueDeadLetter(letters[0].ID); err != nil {
+		t.Error(err)
+	}
+
+	if q.DeadLetterLength() != 0 {
+		t.Errorf("Expected dead letter length of 0, got %d", q.DeadLetterLength())
+	}
+
+	if _, err = q.PeekDeadLetter(letters[0].ID); err != ErrOutOfBounds {
+		t.Errorf("Expected to get out of bounds error, got %v", err)
+	}
+
+	for _, compStr := range []string{"value for item 2", "value for item 1"} {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+
+		if deqItem.Attempts != 0 {
+			t.Errorf("Expected item attempts of 0, got %d", deqItem.Attempts)
+		}
+	}
+}
+
+func TestQueuePurgeDeadLetters(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.SetMaxAttempts(1)
+
+	for i := 1; i <= 3; i++ {
+		item, err := q.EnqueueString(fmt.Sprintf("value for item %d", i))
+		if err != nil {
+			t.Error(err)
+		}
+
+		item.Attempts = 1
+		if _, err = q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+
+		if err = q.Fail(item); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if q.DeadLetterLength() != 3 {
+		t.Errorf("Expected dead letter length of 3, got %d", q.DeadLetterLength())
+	}
+
+	if err = q.DeleteDeadLetter(1); err != nil {
+		t.Error(err)
+	}
+
+	q.Close()
+	if q, err = OpenQueue(file); err != nil {
+		t.Error(err)
+	}
+	defer q.Close()
+
+	if q.DeadLetterLength() != 2 {
+		t.Errorf("Expected dead letter length of 2, got %d", q.DeadLetterLength())
+	}
+
+	if err = q.PurgeDeadLetters(); err != nil {
+		t.Error(err)
+	}
+
+	if q.DeadLetterLength() != 0 {
+		t.Errorf("Expected dead letter length of 0, got %d", q.DeadLetterLength())
 	}
 }
 
@@ -0,0 +1,808 @@
+package goque
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// defaultSegmentSize is the size of segment files when none is given.
+const defaultSegmentSize = 32 << 20
+
+// segmentHeaderSize is the size of the header of a record frame, made of
+// the payload length and its CRC-32C checksum.
+const segmentHeaderSize = 8
+
+// The kinds of operations in a record frame.
+const (
+	segmentDelete byte = iota
+	segmentPut
+)
+
+// segmentIndexFile is the name of the file holding the number of the
+// first and last segment files.
+const segmentIndexFile = "SEGMENTS"
+
+// errSegmentCorrupt is returned when a segment file other than the last
+// one holds a record that cannot be read.
+var errSegmentCorrupt = errors.New("goque: Segment file is corrupt")
+
+// segmentCRC is the CRC-32C table used to checksum record frames.
+var segmentCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentLoc is the location of a value in the segment files.
+type segmentLoc struct {
+	seg  uint64
+	off  int64
+	size int
+}
+
+// segmentEntry is a live key and the location of its value.
+type segmentEntry struct {
+	key []byte
+	loc segmentLoc
+}
+
+// segment is an open segment file.
+type segment struct {
+	f    *os.File
+	size int64
+	live int64
+}
+
+// segmentStorage is a Storage that appends every write as a framed record
+// to fixed-size segment files, and keeps the location of every live key
+// in memory. Segments are deleted from the oldest once all their records
+// are consumed, or once so few are live that they are cheaper to append
+// again, so FIFO workloads never rewrite the items they store.
+//
+// Internal keys, which sort after every item key and are rewritten often,
+// are kept in a map instead of the sorted entries, so writing them never
+// moves the entries. The directory is locked while the storage is open.
+type segmentStorage struct {
+	mu       sync.RWMutex
+	dir      string
+	lock     storage.Storage
+	segSize  int64
+	head     uint64
+	tail     uint64
+	segments map[uint64]*segment
+	entries  []segmentEntry
+	internal map[string]segmentLoc
+	isOpen   bool
+}
+
+// OpenSegmentStorage opens the segment file storage at the given
+// directory, creating it if it does not exist yet. Segment files are
+// started once the current one would grow past segmentSize bytes, which
+// defaults to 32 MiB if it is 0 or less.
+//
+// The storage is designed for queues and stacks. Taking a snapshot of it
+// copies every key into memory. The directory is locked until the storage
+// is closed, so opening it again in the meantime fails.
+func OpenSegmentStorage(dataDir string, segmentSize int64) (Storage, error) {
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	// Lock the directory, creating it if needed.
+	lock, err := storage.OpenFile(dataDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segmentStorage{
+		dir:      dataDir,
+		lock:     lock,
+		segSize:  segmentSize,
+		head:     1,
+		tail:     1,
+		segments: make(map[uint64]*segment),
+		internal: make(map[string]segmentLoc),
+	}
+
+	if err := s.init(); err != nil {
+		s.closeFiles()
+		lock.Close()
+		return nil, err
+	}
+
+	s.isOpen = true
+	return s, nil
+}
+
+// Get gets the value for the given key.
+func (s *segmentStorage) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !s.isOpen {
+		return nil, leveldb.ErrClosed
+	}
+
+	loc, ok := s.lookup(key)
+	if !ok {
+		return nil, leveldb.ErrNotFound
+	}
+
+	return s.read(loc)
+}
+
+// Put sets the value for the given key.
+func (s *segmentStorage) Put(key, value []byte, sync bool) error {
+	batch := new(leveldb.Batch)
+	batch.Put(key, value)
+	return s.Write(batch, sync)
+}
+
+// Delete deletes the value for the given key.
+func (s *segmentStorage) Delete(key []byte, sync bool) error {
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	return s.Write(batch, sync)
+}
+
+// Write appends the given batch as a single record frame, which is
+// either read back whole or not at all after a crash.
+func (s *segmentStorage) Write(batch *leveldb.Batch, sync bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if storage is closed.
+	if !s.isOpen {
+		return leveldb.ErrClosed
+	}
+
+	if err := s.append(batch, sync); err != nil {
+		return err
+	}
+
+	return s.clean()
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole storage if it is nil. Values are read as the iterator reaches
+// them.
+func (s *segmentStorage) NewIterator(r *util.Range) iterator.Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !s.isOpen {
+		return iterator.NewEmptyIterator(leveldb.ErrClosed)
+	}
+
+	start, limit := 0, len(s.entries)
+	if r != nil && r.Start != nil {
+		start, _ = s.find(r.Start)
+	}
+	if r != nil && r.Limit != nil {
+		limit, _ = s.find(r.Limit)
+	}
+
+	var keys [][]byte
+	for i := start; i < limit; i++ {
+		keys = append(keys, s.entries[i].key)
+	}
+
+	// Merge the internal keys of the range into the sorted keys.
+	var internal [][]byte
+	for key := range s.internal {
+		if (r == nil || r.Start == nil || key >= string(r.Start)) && (r == nil || r.Limit == nil || key < string(r.Limit)) {
+			internal = append(internal, []byte(key))
+		}
+	}
+	if len(internal) > 0 {
+		sort.Slice(internal, func(i, j int) bool {
+			return bytes.Compare(internal[i], internal[j]) < 0
+		})
+		keys = mergeKeys(keys, internal)
+	}
+
+	return &segmentIterator{s: s, keys: keys, pos: -1}
+}
+
+// Snapshot returns a copy of the storage held in memory. Taking it copies
+// every key.
+func (s *segmentStorage) Snapshot() (StorageSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Check if storage is closed.
+	if !s.isOpen {
+		return nil, leveldb.ErrClosed
+	}
+
+	db := memdb.New(comparer.DefaultComparer, 0)
+	for _, e := range s.all() {
+		value, err := s.read(e.loc)
+		if err != nil {
+			return nil, err
+		}
+		db.Put(e.key, value)
+	}
+
+	return &memorySnapshot{db: db}, nil
+}
+
+// Compact does nothing, as consumed segments are deleted as keys are
+// written.
+func (s *segmentStorage) Compact(r util.Range) error {
+	return nil
+}
+
+// Close syncs and closes the segment files.
+func (s *segmentStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if storage is already closed.
+	if !s.isOpen {
+		return nil
+	}
+
+	if err := s.segments[s.tail].f.Sync(); err != nil {
+		return err
+	}
+	if err := s.closeFiles(); err != nil {
+		return err
+	}
+	if err := s.lock.Close(); err != nil {
+		return err
+	}
+
+	s.entries = nil
+	s.internal = nil
+	s.isOpen = false
+
+	return nil
+}
+
+// find returns the index of the first entry with a key at or after the
+// given key, and whether its key is the given key.
+func (s *segmentStorage) find(key []byte) (int, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return bytes.Compare(s.entries[i].key, key) >= 0
+	})
+
+	return i, i < len(s.entries) && bytes.Equal(s.entries[i].key, key)
+}
+
+// lookup returns the location of the value for the given key, and
+// whether it exists.
+func (s *segmentStorage) lookup(key []byte) (segmentLoc, bool) {
+	if isInternalKey(key) {
+		loc, ok := s.internal[string(key)]
+		return loc, ok
+	}
+
+	i, ok := s.find(key)
+	if !ok {
+		return segmentLoc{}, false
+	}
+
+	return s.entries[i].loc, true
+}
+
+// all returns every live key and the location of its value.
+func (s *segmentStorage) all() []segmentEntry {
+	entries := append(make([]segmentEntry, 0, len(s.entries)+len(s.internal)), s.entries...)
+	for key, loc := range s.internal {
+		entries = append(entries, segmentEntry{key: []byte(key), loc: loc})
+	}
+
+	return entries
+}
+
+// set sets the location of the value for the given key.
+func (s *segmentStorage) set(key []byte, loc segmentLoc) {
+	s.segments[loc.seg].live += int64(len(key) + loc.size)
+
+	if isInternalKey(key) {
+		if old, ok := s.internal[string(key)]; ok {
+			s.release(segmentEntry{key: key, loc: old})
+		}
+		s.internal[string(key)] = loc
+		return
+	}
+
+	// Append keys after every other key, such as new queue items.
+	n := len(s.entries)
+	if n == 0 || bytes.Compare(s.entries[n-1].key, key) < 0 {
+		s.entries = append(s.entries, segmentEntry{key: key, loc: loc})
+		return
+	}
+
+	i, ok := s.find(key)
+	if ok {
+		s.release(s.entries[i])
+		s.entries[i].loc = loc
+		return
+	}
+
+	s.entries = append(s.entries, segmentEntry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = segmentEntry{key: key, loc: loc}
+}
+
+// remove removes the given key.
+func (s *segmentStorage) remove(key []byte) {
+	if isInternalKey(key) {
+		if old, ok := s.internal[string(key)]; ok {
+			s.release(segmentEntry{key: key, loc: old})
+			delete(s.internal, string(key))
+		}
+		return
+	}
+
+	i, ok := s.find(key)
+	if !ok {
+		return
+	}
+	s.release(s.entries[i])
+
+	// Remove keys before every other key, such as consumed queue items,
+	// without moving the rest.
+	if i == 0 {
+		s.entries[0] = segmentEntry{}
+		s.entries = s.entries[1:]
+		return
+	}
+
+	copy(s.entries[i:], s.entries[i+1:])
+	s.entries[len(s.entries)-1] = segmentEntry{}
+	s.entries = s.entries[:len(s.entries)-1]
+}
+
+// release subtracts the given entry from the live bytes of its segment.
+func (s *segmentStorage) release(e segmentEntry) {
+	if seg, ok := s.segments[e.loc.seg]; ok {
+		seg.live -= int64(len(e.key) + e.loc.size)
+	}
+}
+
+// apply applies the operations of the record frame payload at the given
+// offset of the given segment to the index.
+func (s *segmentStorage) apply(seg uint64, off int64, payload []byte) error {
+	base := off + segmentHeaderSize
+	for pos := 0; pos < len(payload); {
+		kind := payload[pos]
+		pos++
+
+		keyLen, n := binary.Uvarint(payload[pos:])
+		if n <= 0 || uint64(len(payload)-pos-n) < keyLen {
+			return errSegmentCorrupt
+		}
+		pos += n
+		key := append([]byte{}, payload[pos:pos+int(keyLen)]...)
+		pos += int(keyLen)
+
+		if kind == segmentDelete {
+			s.remove(key)
+			continue
+		}
+
+		valLen, n := binary.Uvarint(payload[pos:])
+		if n <= 0 || uint64(len(payload)-pos-n) < valLen {
+			return errSegmentCorrupt
+		}
+		pos += n
+		s.set(key, segmentLoc{seg: seg, off: base + int64(pos), size: int(valLen)})
+		pos += int(valLen)
+	}
+
+	return nil
+}
+
+// read reads the value at the given location.
+func (s *segmentStorage) read(loc segmentLoc) ([]byte, error) {
+	value := make([]byte, loc.size)
+	if _, err := s.segments[loc.seg].f.ReadAt(value, loc.off); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// append appends the given batch to the last segment as a single record
+// frame, starting a new segment if it does not fit, and applies it to the
+// index.
+func (s *segmentStorage) append(batch *leveldb.Batch, sync bool) error {
+	// Encode the batch as a record frame.
+	enc := &segmentEncoder{frame: make([]byte, segmentHeaderSize)}
+	if err := batch.Replay(enc); err != nil {
+		return err
+	}
+	frame := enc.frame
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-segmentHeaderSize))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(frame[segmentHeaderSize:], segmentCRC))
+
+	// Start a new segment if the frame does not fit in the last one.
+	seg := s.segments[s.tail]
+	if seg.size > 0 && seg.size+int64(len(frame)) > s.segSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+		seg = s.segments[s.tail]
+	}
+
+	// Append the frame.
+	off := seg.size
+	if _, err := seg.f.WriteAt(frame, off); err != nil {
+		seg.f.Truncate(off)
+		return err
+	}
+	if sync {
+		if err := seg.f.Sync(); err != nil {
+			return err
+		}
+	}
+	seg.size += int64(len(frame))
+
+	return s.apply(s.tail, off, frame[segmentHeaderSize:])
+}
+
+// roll syncs the last segment file and starts a new one.
+func (s *segmentStorage) roll() error {
+	if err := s.segments[s.tail].f.Sync(); err != nil {
+		return err
+	}
+
+	if err := s.saveIndex(s.head, s.tail+1); err != nil {
+		return err
+	}
+	s.tail++
+
+	return s.openSegment(s.tail, true)
+}
+
+// clean deletes the oldest segment files while their live records are
+// consumed, appending any that are left to the last segment first once
+// they take up less than a quarter of the segment.
+func (s *segmentStorage) clean() error {
+	for s.head < s.tail {
+		seg := s.segments[s.head]
+		if seg.live > s.segSize/4 {
+			return nil
+		}
+
+		// Append the records left in the segment again.
+		if seg.live > 0 {
+			if err := s.rewrite(s.head); err != nil {
+				return err
+			}
+		}
+
+		// Delete the segment, recording the new first segment before the
+		// file is removed.
+		if err := s.saveIndex(s.head+1, s.tail); err != nil {
+			return err
+		}
+		seg.f.Close()
+		delete(s.segments, s.head)
+		if err := os.Remove(s.segmentPath(s.head)); err != nil {
+			return err
+		}
+		s.head++
+	}
+
+	return nil
+}
+
+// rewrite appends the live records of the given segment to the last
+// segment as a single record frame.
+func (s *segmentStorage) rewrite(n uint64) error {
+	batch := new(leveldb.Batch)
+	for _, e := range s.all() {
+		if e.loc.seg != n {
+			continue
+		}
+
+		value, err := s.read(e.loc)
+		if err != nil {
+			return err
+		}
+		batch.Put(e.key, value)
+	}
+
+	// Sync the frame, as the segment is removed right after.
+	return s.append(batch, true)
+}
+
+// init reads the segment index and replays every segment file.
+func (s *segmentStorage) init() error {
+	// Read the first and last segment numbers.
+	idx, err := ioutil.ReadFile(filepath.Join(s.dir, segmentIndexFile))
+	if err == nil && len(idx) == 16 {
+		s.head = binary.BigEndian.Uint64(idx)
+		s.tail = binary.BigEndian.Uint64(idx[8:])
+	} else if err == nil {
+		return errSegmentCorrupt
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if err := s.saveIndex(s.head, s.tail); err != nil {
+		return err
+	}
+
+	// Remove segment files left outside of the index by a crash.
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var n uint64
+		if _, err := fmt.Sscanf(filepath.Base(file), "%016d.seg", &n); err != nil {
+			continue
+		}
+		if n < s.head || n > s.tail {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replay the segments.
+	for n := s.head; n <= s.tail; n++ {
+		if err := s.openSegment(n, n == s.tail); err != nil {
+			return err
+		}
+		if err := s.replay(n); err != nil {
+			return err
+		}
+	}
+
+	return s.clean()
+}
+
+// replay applies the record frames of the given segment to the index. A
+// frame cut short by a crash at the end of the last segment is removed.
+func (s *segmentStorage) replay(n uint64) error {
+	seg := s.segments[n]
+	data, err := ioutil.ReadFile(s.segmentPath(n))
+	if err != nil {
+		return err
+	}
+
+	var off int64
+	for off < int64(len(data)) {
+		frame := data[off:]
+		valid := len(frame) >= segmentHeaderSize
+		var size int64
+		if valid {
+			size = int64(binary.BigEndian.Uint32(frame))
+			valid = int64(len(frame))-segmentHeaderSize >= size &&
+				crc32.Checksum(frame[segmentHeaderSize:segmentHeaderSize+size], segmentCRC) == binary.BigEndian.Uint32(frame[4:])
+		}
+
+		if !valid {
+			if n != s.tail {
+				return errSegmentCorrupt
+			}
+			if err := seg.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+
+		if err := s.apply(n, off, frame[segmentHeaderSize:segmentHeaderSize+size]); err != nil {
+			return err
+		}
+		off += segmentHeaderSize + size
+	}
+	seg.size = off
+
+	return nil
+}
+
+// openSegment opens the given segment file, creating it if create is
+// true and it does not exist yet.
+func (s *segmentStorage) openSegment(n uint64, create bool) error {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+
+	f, err := os.OpenFile(s.segmentPath(n), flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.segments[n] = &segment{f: f}
+	return nil
+}
+
+// segmentPath returns the path of the given segment file.
+func (s *segmentStorage) segmentPath(n uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.seg", n))
+}
+
+// saveIndex durably saves the given first and last segment numbers.
+func (s *segmentStorage) saveIndex(head, tail uint64) error {
+	idx := make([]byte, 16)
+	binary.BigEndian.PutUint64(idx, head)
+	binary.BigEndian.PutUint64(idx[8:], tail)
+
+	path := filepath.Join(s.dir, segmentIndexFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(idx); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// closeFiles closes every open segment file, returning the first error.
+func (s *segmentStorage) closeFiles() error {
+	var err error
+	for n, seg := range s.segments {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.segments, n)
+	}
+
+	return err
+}
+
+// isInternalKey returns whether the given key is an internal key of a
+// data structure rather than one of its items.
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, internalPrefix)
+}
+
+// mergeKeys returns the keys of the two given sorted lists as a single
+// sorted list.
+func mergeKeys(a, b [][]byte) [][]byte {
+	keys := make([][]byte, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if bytes.Compare(a[0], b[0]) < 0 {
+			keys, a = append(keys, a[0]), a[1:]
+		} else {
+			keys, b = append(keys, b[0]), b[1:]
+		}
+	}
+
+	return append(append(keys, a...), b...)
+}
+
+// segmentEncoder encodes the operations of a batch as the payload of a
+// record frame.
+type segmentEncoder struct {
+	frame []byte
+}
+
+// Put adds the given put to the payload.
+func (se *segmentEncoder) Put(key, value []byte) {
+	se.frame = append(se.frame, segmentPut)
+	se.frame = appendUvarintBytes(se.frame, key)
+	se.frame = appendUvarintBytes(se.frame, value)
+}
+
+// Delete adds the given delete to the payload.
+func (se *segmentEncoder) Delete(key []byte) {
+	se.frame = append(se.frame, segmentDelete)
+	se.frame = appendUvarintBytes(se.frame, key)
+}
+
+// appendUvarintBytes appends the length of the given bytes followed by
+// the bytes.
+func appendUvarintBytes(dst, b []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	return append(append(dst, buf[:n]...), b...)
+}
+
+// segmentIterator iterates over a copy of the keys of a segmentStorage,
+// reading the value of each key as it is reached.
+type segmentIterator struct {
+	util.BasicReleaser
+	s     *segmentStorage
+	keys  [][]byte
+	pos   int
+	value []byte
+	err   error
+}
+
+// First moves the iterator to the first key.
+func (it *segmentIterator) First() bool {
+	it.pos = 0
+	return it.load()
+}
+
+// Last moves the iterator to the last key.
+func (it *segmentIterator) Last() bool {
+	it.pos = len(it.keys) - 1
+	return it.load()
+}
+
+// Seek moves the iterator to the first key at or after the given key.
+func (it *segmentIterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.keys), func(i int) bool {
+		return bytes.Compare(it.keys[i], key) >= 0
+	})
+	return it.load()
+}
+
+// Next moves the iterator to the next key.
+func (it *segmentIterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.load()
+}
+
+// Prev moves the iterator to the previous key.
+func (it *segmentIterator) Prev() bool {
+	if it.pos >= 0 {
+		it.pos--
+	}
+	return it.load()
+}
+
+// load reads the value of the current key.
+func (it *segmentIterator) load() bool {
+	it.value = nil
+	if it.err != nil || it.Released() || it.pos < 0 || it.pos >= len(it.keys) {
+		return false
+	}
+
+	it.value, it.err = it.s.Get(it.keys[it.pos])
+	return it.err == nil
+}
+
+// Valid returns whether the iterator is at a key.
+func (it *segmentIterator) Valid() bool {
+	return it.value != nil
+}
+
+// Key returns the current key.
+func (it *segmentIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+
+	return it.keys[it.pos]
+}
+
+// Value returns the value of the current key.
+func (it *segmentIterator) Value() []byte {
+	return it.value
+}
+
+// Error returns the error that stopped the iterator, if any.
+func (it *segmentIterator) Error() error {
+	return it.err
+}
+
+// Release releases the keys of the iterator.
+func (it *segmentIterator) Release() {
+	it.keys = nil
+	it.value = nil
+	it.BasicReleaser.Release()
+}
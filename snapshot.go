@@ -0,0 +1,473 @@
+package goque
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// StackSnapshot is a read-only view of a stack as it was when the
+// snapshot was taken, backed by a storage snapshot. It is not affected
+// by later changes to the stack, and reading it does not block them.
+// Release must be called once the snapshot is no longer needed.
+type StackSnapshot struct {
+	s *Stack
+}
+
+// Snapshot returns a read-only view of the current state of the stack.
+func (s *Stack) Snapshot() (*StackSnapshot, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	db, err := s.db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &StackSnapshot{s: &Stack{
+		DataDir: s.DataDir,
+		db:      db,
+		head:    s.head,
+		tail:    s.tail,
+		isOpen:  true,
+	}}, nil
+}
+
+// Peek returns the next item in the stack snapshot.
+func (ss *StackSnapshot) Peek() (*Item, error) {
+	return ss.s.Peek()
+}
+
+// PeekByOffset returns the item located at the given offset, starting
+// from the top of the stack snapshot.
+func (ss *StackSnapshot) PeekByOffset(offset uint64) (*Item, error) {
+	return ss.s.PeekByOffset(offset)
+}
+
+// PeekByID returns the item with the given ID in the stack snapshot.
+func (ss *StackSnapshot) PeekByID(id uint64) (*Item, error) {
+	return ss.s.PeekByID(id)
+}
+
+// Length returns the total number of items in the stack snapshot.
+func (ss *StackSnapshot) Length() uint64 {
+	return ss.s.Length()
+}
+
+// ForEach calls fn for every item in the stack snapshot, from the top of
+// the stack to the bottom. It stops at the first error returned by fn and
+// returns it. The snapshot must not be released from within fn.
+func (ss *StackSnapshot) ForEach(fn func(item *Item) error) error {
+	ss.s.RLock()
+	defer ss.s.RUnlock()
+
+	// Check if snapshot is released.
+	if !ss.s.isOpen {
+		return ErrDBClosed
+	}
+
+	iter := ss.s.db.NewIterator(&util.Range{Start: idToKey(ss.s.tail + 1), Limit: idToKey(ss.s.head + 1)}, nil)
+	defer iter.Release()
+
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		key := append([]byte{}, iter.Key()...)
+		item := &Item{
+			ID:    keyToID(key),
+			Key:   key,
+			Value: append([]byte{}, iter.Value()...),
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Release releases the storage snapshot. Reading the stack snapshot
+// afterwards returns ErrDBClosed.
+func (ss *StackSnapshot) Release() error {
+	ss.s.Lock()
+	defer ss.s.Unlock()
+
+	// Check if snapshot is already released.
+	if !ss.s.isOpen {
+		return nil
+	}
+
+	ss.s.isOpen = false
+	return ss.s.db.Close()
+}
+
+// QueueSnapshot is a read-only view of a queue as it was when the
+// snapshot was taken, backed by a storage snapshot. It is not affected
+// by later changes to the queue, and reading it does not block them.
+// Release must be called once the snapshot is no longer needed.
+type QueueSnapshot struct {
+	q *Queue
+}
+
+// Snapshot returns a read-only view of the current state of the queue.
+// Leased items are not part of it until they are returned to the queue.
+func (q *Queue) Snapshot() (*QueueSnapshot, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	// Check if queue is closed.
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	db, err := q.db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueueSnapshot{q: &Queue{
+		DataDir: q.DataDir,
+		db:      db,
+		head:    q.head,
+		tail:    q.tail,
+		dead:    newDeadLetters(db, nil, internalPrefix),
+		isOpen:  true,
+	}}, nil
+}
+
+// Peek returns the next item in the queue snapshot.
+func (qs *QueueSnapshot) Peek() (*Item, error) {
+	return qs.q.Peek()
+}
+
+// PeekByOffset returns the item located at the given offset, starting
+// from the head of the queue snapshot.
+func (qs *QueueSnapshot) PeekByOffset(offset uint64) (*Item, error) {
+	return qs.q.PeekByOffset(offset)
+}
+
+// PeekByID returns the item with the given ID in the queue snapshot.
+func (qs *QueueSnapshot) PeekByID(id uint64) (*Item, error) {
+	return qs.q.PeekByID(id)
+}
+
+// Length returns the total number of items in the queue snapshot.
+func (qs *QueueSnapshot) Length() uint64 {
+	return qs.q.Length()
+}
+
+// ForEach calls fn for every item in the queue snapshot, from the head of
+// the queue to the tail. It stops at the first error returned by fn and
+// returns it. The snapshot must not be released from within fn.
+func (qs *QueueSnapshot) ForEach(fn func(item *Item) error) error {
+	qs.q.RLock()
+	defer qs.q.RUnlock()
+
+	// Check if snapshot is released.
+	if !qs.q.isOpen {
+		return ErrDBClosed
+	}
+
+	iter := qs.q.db.NewIterator(&util.Range{Start: idToKey(qs.q.head + 1), Limit: idToKey(qs.q.tail + 1)}, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		item := &Item{
+			ID:    keyToID(key),
+			Key:   key,
+			Value: append([]byte{}, iter.Value()...),
+		}
+
+		// Get its delivery attempts.
+		var err error
+		if item.Attempts, err = qs.q.dead.attempts(key); err != nil {
+			return err
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Release releases the storage snapshot. Reading the queue snapshot
+// afterwards returns ErrDBClosed.
+func (qs *QueueSnapshot) Release() error {
+	qs.q.Lock()
+	defer qs.q.Unlock()
+
+	// Check if snapshot is already released.
+	if !qs.q.isOpen {
+		return nil
+	}
+
+	qs.q.isOpen = false
+	return qs.q.db.Close()
+}
+
+// PriorityQueueSnapshot is a read-only view of a priority queue as it was
+// when the snapshot was taken, backed by a storage snapshot. It is not
+// affected by later changes to the priority queue, and reading it does
+// not block them. Release must be called once the snapshot is no longer
+// needed.
+type PriorityQueueSnapshot struct {
+	pq *PriorityQueue
+}
+
+// Snapshot returns a read-only view of the current state of the priority
+// queue. Leased items are not part of it until they are returned to the
+// priority queue.
+func (pq *PriorityQueue) Snapshot() (*PriorityQueueSnapshot, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	db, err := pq.db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &PriorityQueue{
+		DataDir:  pq.DataDir,
+		db:       db,
+		order:    pq.order,
+		curLevel: pq.curLevel,
+		dead:     newDeadLetters(db, nil, internalPrefix),
+		isOpen:   true,
+	}
+	for i, level := range pq.levels {
+		snap.levels[i] = &priorityLevel{head: level.head, tail: level.tail}
+	}
+
+	return &PriorityQueueSnapshot{pq: snap}, nil
+}
+
+// Peek returns the next item in the priority queue snapshot.
+func (pqs *PriorityQueueSnapshot) Peek() (*PriorityItem, error) {
+	return pqs.pq.Peek()
+}
+
+// PeekByOffset returns the item located at the given offset, starting
+// from the head of the priority queue snapshot.
+func (pqs *PriorityQueueSnapshot) PeekByOffset(offset uint64) (*PriorityItem, error) {
+	return pqs.pq.PeekByOffset(offset)
+}
+
+// PeekByPriorityID returns the item with the given ID and priority in the
+// priority queue snapshot.
+func (pqs *PriorityQueueSnapshot) PeekByPriorityID(priority uint8, id uint64) (*PriorityItem, error) {
+	return pqs.pq.PeekByPriorityID(priority, id)
+}
+
+// Length returns the total number of items in the priority queue
+// snapshot.
+func (pqs *PriorityQueueSnapshot) Length() uint64 {
+	return pqs.pq.Length()
+}
+
+// ForEach calls fn for every item in the priority queue snapshot, in the
+// order they would be dequeued. It stops at the first error returned by
+// fn and returns it. The snapshot must not be released from within fn.
+func (pqs *PriorityQueueSnapshot) ForEach(fn func(item *PriorityItem) error) error {
+	pqs.pq.RLock()
+	defer pqs.pq.RUnlock()
+
+	// Check if snapshot is released.
+	if !pqs.pq.isOpen {
+		return ErrDBClosed
+	}
+
+	// Loop through the priority levels from the most important.
+	for i := 0; i <= 255; i++ {
+		priority := uint8(i)
+		if pqs.pq.order == DESC {
+			priority = uint8(255 - i)
+		}
+
+		level := pqs.pq.levels[priority]
+		if level.length() == 0 {
+			continue
+		}
+
+		if err := pqs.forEachInLevel(priority, level, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachInLevel calls fn for every item in the given priority level.
+func (pqs *PriorityQueueSnapshot) forEachInLevel(priority uint8, level *priorityLevel, fn func(item *PriorityItem) error) error {
+	iter := pqs.pq.db.NewIterator(&util.Range{
+		Start: pqs.pq.generateKey(priority, level.head+1),
+		Limit: pqs.pq.generateKey(priority, level.tail+1),
+	}, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		item := &PriorityItem{
+			ID:       keyToID(key[2:]),
+			Priority: priority,
+			Key:      key,
+			Value:    append([]byte{}, iter.Value()...),
+		}
+
+		// Get its delivery attempts.
+		var err error
+		if item.Attempts, err = pqs.pq.dead.attempts(key); err != nil {
+			return err
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Release releases the storage snapshot. Reading the priority queue
+// snapshot afterwards returns ErrDBClosed.
+func (pqs *PriorityQueueSnapshot) Release() error {
+	pqs.pq.Lock()
+	defer pqs.pq.Unlock()
+
+	// Check if snapshot is already released.
+	if !pqs.pq.isOpen {
+		return nil
+	}
+
+	pqs.pq.isOpen = false
+	return pqs.pq.db.Close()
+}
+
+// PrefixQueueSnapshot is a read-only view of a prefix queue as it was
+// when the snapshot was taken, backed by a storage snapshot. It is not
+// affected by later changes to the prefix queue, and reading it does not
+// block them. Release must be called once the snapshot is no longer
+// needed.
+type PrefixQueueSnapshot struct {
+	pq *PrefixQueue
+}
+
+// Snapshot returns a read-only view of the current state of the prefix
+// queue.
+func (pq *PrefixQueue) Snapshot() (*PrefixQueueSnapshot, error) {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	// Check if queue is closed.
+	if !pq.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	db, err := pq.db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrefixQueueSnapshot{pq: &PrefixQueue{
+		DataDir: pq.DataDir,
+		db:      db,
+		size:    pq.size,
+		dead:    newDeadLetters(db, nil, prefixInternal),
+		isOpen:  true,
+	}}, nil
+}
+
+// Peek returns the next item in the given queue of the prefix queue
+// snapshot.
+func (pqs *PrefixQueueSnapshot) Peek(prefix []byte) (*Item, error) {
+	return pqs.pq.Peek(prefix)
+}
+
+// PeekString is a helper function for Peek that accepts the prefix as a
+// string rather than a byte slice.
+func (pqs *PrefixQueueSnapshot) PeekString(prefix string) (*Item, error) {
+	return pqs.pq.PeekString(prefix)
+}
+
+// PeekByID returns the item with the given prefix and ID in the prefix
+// queue snapshot.
+func (pqs *PrefixQueueSnapshot) PeekByID(prefix []byte, id uint64) (*Item, error) {
+	return pqs.pq.PeekByID(prefix, id)
+}
+
+// PeekByIDString is a helper function for PeekByID that accepts the
+// prefix as a string rather than a byte slice.
+func (pqs *PrefixQueueSnapshot) PeekByIDString(prefix string, id uint64) (*Item, error) {
+	return pqs.pq.PeekByIDString(prefix, id)
+}
+
+// Length returns the total number of items in the prefix queue snapshot.
+func (pqs *PrefixQueueSnapshot) Length() uint64 {
+	return pqs.pq.Length()
+}
+
+// ForEach calls fn for every item in the prefix queue snapshot, ordered
+// by prefix and then from the head of each queue to its tail. It stops at
+// the first error returned by fn and returns it. The snapshot must not be
+// released from within fn.
+func (pqs *PrefixQueueSnapshot) ForEach(fn func(item *Item) error) error {
+	pqs.pq.RLock()
+	defer pqs.pq.RUnlock()
+
+	// Check if snapshot is released.
+	if !pqs.pq.isOpen {
+		return ErrDBClosed
+	}
+
+	iter := pqs.pq.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if !isPrefixItemKey(iter.Key()) {
+			continue
+		}
+
+		key := append([]byte{}, iter.Key()...)
+		item := &Item{
+			ID:    keyToID(key[len(key)-8:]),
+			Key:   key,
+			Value: append([]byte{}, iter.Value()...),
+		}
+
+		// Get its delivery attempts.
+		var err error
+		if item.Attempts, err = pqs.pq.dead.attempts(key); err != nil {
+			return err
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// Release releases the storage snapshot. Reading the prefix queue
+// snapshot afterwards returns ErrDBClosed.
+func (pqs *PrefixQueueSnapshot) Release() error {
+	pqs.pq.Lock()
+	defer pqs.pq.Unlock()
+
+	// Check if snapshot is already released.
+	if !pqs.pq.isOpen {
+		return nil
+	}
+
+	pqs.pq.isOpen = false
+	return pqs.pq.db.Close()
+}
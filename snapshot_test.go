@@ -0,0 +1,291 @@
+package goque
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStackSnapshot(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err = s.Pop(); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err = s.PushString("value for new item"); err != nil {
+		t.Error(err)
+	}
+
+	if snap.Length() != 10 {
+		t.Errorf("Expected snapshot length of 10, got %d", snap.Length())
+	}
+
+	peekItem, err := snap.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 10"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	offsetItem, err := snap.PeekByOffset(2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for item 8"
+
+	if offsetItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, offsetItem.ToString())
+	}
+
+	var ids []uint64
+	if err = snap.ForEach(func(item *Item) error {
+		ids = append(ids, item.ID)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if fmt.Sprint(ids) != "[10 9 8 7 6 5 4 3 2 1]" {
+		t.Errorf("Expected IDs from 10 down to 1, got %v", ids)
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = snap.Peek(); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestQueueSnapshot(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 100; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	snap, err := q.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer snap.Release()
+
+	// Keep producing and consuming while reading the snapshot.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			q.EnqueueString("value for new item")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			q.Dequeue()
+		}
+	}()
+
+	var count uint64
+	if err = snap.ForEach(func(item *Item) error {
+		count++
+		compStr := fmt.Sprintf("value for item %d", count)
+		if item.ID != count || item.ToString() != compStr {
+			t.Errorf("Expected item %d to be '%s', got %d '%s'", count, compStr, item.ID, item.ToString())
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	wg.Wait()
+
+	if count != 100 {
+		t.Errorf("Expected to iterate over 100 items, got %d", count)
+	}
+
+	if snap.Length() != 100 {
+		t.Errorf("Expected snapshot length of 100, got %d", snap.Length())
+	}
+
+	idItem, err := snap.PeekByID(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if idItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, idItem.ToString())
+	}
+
+	if _, err = snap.PeekByID(101); err != ErrOutOfBounds {
+		t.Errorf("Expected to get out of bounds error, got %v", err)
+	}
+
+	errStop := fmt.Errorf("stop")
+	if err = snap.ForEach(func(item *Item) error {
+		return errStop
+	}); err != errStop {
+		t.Errorf("Expected to get the error returned by fn, got %v", err)
+	}
+}
+
+func TestPriorityQueueSnapshot(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPriorityQueue(file, DESC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 4; p++ {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for item %d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	snap, err := pq.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer snap.Release()
+
+	if _, err = pq.Dequeue(); err != nil {
+		t.Error(err)
+	}
+	if _, err = pq.EnqueueString(9, "value for new item"); err != nil {
+		t.Error(err)
+	}
+
+	if snap.Length() != 10 {
+		t.Errorf("Expected snapshot length of 10, got %d", snap.Length())
+	}
+
+	peekItem, err := snap.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if peekItem.Priority != 4 || peekItem.ID != 1 {
+		t.Errorf("Expected priority 4 item 1, got priority %d item %d", peekItem.Priority, peekItem.ID)
+	}
+
+	offsetItem, err := snap.PeekByOffset(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if offsetItem.Priority != 3 || offsetItem.ID != 2 {
+		t.Errorf("Expected priority 3 item 2, got priority %d item %d", offsetItem.Priority, offsetItem.ID)
+	}
+
+	var order []string
+	if err = snap.ForEach(func(item *PriorityItem) error {
+		order = append(order, fmt.Sprintf("%d:%d", item.Priority, item.ID))
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if fmt.Sprint(order) != "[4:1 4:2 3:1 3:2 2:1 2:2 1:1 1:2 0:1 0:2]" {
+		t.Errorf("Expected items in priority order, got %v", order)
+	}
+}
+
+func TestPrefixQueueSnapshot(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	pq, err := OpenPrefixQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for _, prefix := range []string{"b", "a"} {
+		for i := 1; i <= 2; i++ {
+			if _, err = pq.EnqueueString(prefix, fmt.Sprintf("value for %s item %d", prefix, i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	snap, err := pq.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	defer snap.Release()
+
+	if _, err = pq.DequeueString("a"); err != nil {
+		t.Error(err)
+	}
+	if _, err = pq.EnqueueString("c", "value for c item 1"); err != nil {
+		t.Error(err)
+	}
+
+	if snap.Length() != 4 {
+		t.Errorf("Expected snapshot length of 4, got %d", snap.Length())
+	}
+
+	peekItem, err := snap.PeekString("a")
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for a item 1"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	if _, err = snap.PeekString("c"); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+
+	var values []string
+	if err = snap.ForEach(func(item *Item) error {
+		values = append(values, item.ToString())
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	compStr = "[value for a item 1 value for a item 2 value for b item 1 value for b item 2]"
+
+	if fmt.Sprint(values) != compStr {
+		t.Errorf("Expected values to be %s, got %v", compStr, values)
+	}
+}
@@ -2,52 +2,87 @@ package goque
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/json"
-	"os"
+	"context"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Stack is a standard LIFO (last in, first out) stack.
 type Stack struct {
 	sync.RWMutex
 	DataDir string
-	db      *leveldb.DB
+	db      *keyspace
+	codec   Codec
+	onError func(err error)
 	head    uint64
 	tail    uint64
+	sync    *syncer
+	compact *compactor
+	cap     *capacity
+	corrupt *quarantine
+	notify  *notifier
 	isOpen  bool
 }
 
 // OpenStack opens a stack if one exists at the given directory. If one
 // does not already exist, a new stack is created.
 func OpenStack(dataDir string) (*Stack, error) {
-	var err error
+	return OpenStackWithOptions(dataDir, nil)
+}
+
+// OpenStackWithOptions opens a stack like OpenStack, using the given
+// options. If opts is nil, the default options are used.
+func OpenStackWithOptions(dataDir string, opts *Options) (*Stack, error) {
+	// Open database for the stack.
+	db, err := openKeyspace(dataDir, goqueStack, opts)
+	if err != nil {
+		return &Stack{DataDir: dataDir}, err
+	}
+
+	return openStack(dataDir, db, opts)
+}
+
+// OpenStackInMemory opens a new stack that keeps its items in memory only.
+// They are lost once the stack is closed.
+func OpenStackInMemory() (*Stack, error) {
+	return OpenStackWithStorage(NewMemoryStorage(), nil)
+}
+
+// OpenStackWithStorage opens the stack kept in the given storage, using
+// the given options. The stack takes ownership of the storage and closes
+// it when the stack is closed. The LevelDB settings of the options are
+// ignored.
+func OpenStackWithStorage(storage Storage, opts *Options) (*Stack, error) {
+	return openStack("", &keyspace{db: storage}, opts)
+}
+
+// openStack opens the stack stored in the given keyspace.
+func openStack(dataDir string, db *keyspace, opts *Options) (*Stack, error) {
+	// Compress, encrypt and checksum the values of the data structure,
+	// and spill them to blob files, if enabled.
+	if err := db.setValueOptions(opts, isItemKey); err != nil {
+		db.Close()
+		return &Stack{DataDir: dataDir}, err
+	}
 
 	// Create a new Stack.
 	s := &Stack{
 		DataDir: dataDir,
-		db:      &leveldb.DB{},
+		db:      db,
+		codec:   codecOf(opts),
+		onError: consumeErrorOf(opts),
 		head:    0,
 		tail:    0,
+		notify:  newNotifier(),
 		isOpen:  false,
 	}
-
-	// Open database for the stack.
-	s.db, err = leveldb.OpenFile(dataDir, nil)
-	if err != nil {
-		return s, err
-	}
-
-	// Check if this Goque type can open the requested data directory.
-	ok, err := checkGoqueType(dataDir, goqueStack)
-	if err != nil {
-		return s, err
-	}
-	if !ok {
-		return s, ErrIncompatibleType
-	}
+	s.sync = newSyncer(s.db, internalPrefix, opts)
+	s.compact = newCompactor(s.db, opts)
+	s.cap = newCapacity(s.db, internalPrefix, opts)
+	s.corrupt = newQuarantine(s.db, s.sync, internalPrefix)
 
 	// Set isOpen and return.
 	s.isOpen = true
@@ -64,22 +99,85 @@ func (s *Stack) Push(value []byte) (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Create new Item.
-	item := &Item{
-		ID:    s.head + 1,
-		Key:   idToKey(s.head + 1),
-		Value: value,
+	return s.push(value)
+}
+
+// PushWait adds an item to the stack. If the stack is full, it blocks
+// until enough items are removed to make space for it, the given context
+// is done or the stack is closed.
+func (s *Stack) PushWait(ctx context.Context, value []byte) (*Item, error) {
+	for {
+		s.Lock()
+
+		// Check if stack is closed.
+		if !s.isOpen {
+			s.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to push the item. If it does not fit in an empty stack, it
+		// never will.
+		item, err := s.push(value)
+		if err != ErrFull || s.Length() == 0 {
+			s.Unlock()
+			return item, err
+		}
+
+		// Wait for space to be freed.
+		wait := s.cap.wait()
+		s.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	// Add it to the stack.
-	if err := s.db.Put(item.Key, item.Value, nil); err != nil {
+// PushBatch adds the given values to the stack as a single atomic
+// write. Either every item is added or none are, and the last value
+// ends up on top of the stack.
+func (s *Stack) PushBatch(values [][]byte) ([]*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if the items fit in the stack.
+	size := valuesSize(values)
+	if !s.cap.fits(s.Length(), uint64(len(values)), size) {
+		return nil, ErrFull
+	}
+
+	// Create new Items and add them to the batch.
+	items := make([]*Item, len(values))
+	batch := new(leveldb.Batch)
+	for i, value := range values {
+		id := s.head + uint64(i) + 1
+		items[i] = &Item{
+			ID:    id,
+			Key:   idToKey(id),
+			Value: value,
+		}
+		batch.Put(items[i].Key, items[i].Value)
+	}
+	s.cap.batch(batch, nil, size, 0)
+
+	// Add them to the stack.
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
 		return nil, err
 	}
 
 	// Increment head position.
-	s.head++
+	s.head += uint64(len(items))
+	s.cap.added(nil, size)
 
-	return item, nil
+	// Wake any goroutines waiting for an item.
+	s.notify.broadcast()
+
+	return items, nil
 }
 
 // PushString is a helper function for Push that accepts a
@@ -97,13 +195,12 @@ func (s *Stack) PushString(value string) (*Item, error) {
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (s *Stack) PushObject(value interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(value); err != nil {
+	data, err := GobCodec.Encode(value)
+	if err != nil {
 		return nil, err
 	}
 
-	return s.Push(buffer.Bytes())
+	return s.Push(data)
 }
 
 // PushObjectAsJSON is a helper function for Push that accepts any
@@ -112,12 +209,23 @@ func (s *Stack) PushObject(value interface{}) (*Item, error) {
 //
 // Use this function to handle encoding of complex types.
 func (s *Stack) PushObjectAsJSON(value interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(value)
+	data, err := JSONCodec.Encode(value)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.Push(jsonBytes)
+	return s.Push(data)
+}
+
+// PushValue is a helper function for Push that accepts any value type,
+// which is then encoded into a byte slice using the codec of the stack.
+func (s *Stack) PushValue(value interface{}) (*Item, error) {
+	data, err := s.codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Push(data)
 }
 
 // Pop removes the next item in the stack and returns it.
@@ -130,21 +238,142 @@ func (s *Stack) Pop() (*Item, error) {
 		return nil, ErrDBClosed
 	}
 
-	// Try to get the next item in the stack.
-	item, err := s.getItemByID(s.head)
-	if err != nil {
+	return s.pop(nil)
+}
+
+// PopN removes up to n items from the top of the stack and returns them
+// in the order they would have been popped, reading them with a single
+// iterator and removing them as a single atomic write. If n is negative,
+// every item in the stack is removed.
+func (s *Stack) PopN(n int) ([]*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Check if stack is empty.
+	if s.Length() == 0 {
+		return nil, ErrEmpty
+	}
+
+	// Find how many items to remove.
+	count := s.Length()
+	if n >= 0 && uint64(n) < count {
+		count = uint64(n)
+	}
+
+	// Get the items from the database, starting at the top.
+	iter := s.db.NewIterator(&util.Range{Start: idToKey(s.head - count + 1), Limit: idToKey(s.head + 1)}, nil)
+	defer iter.Release()
+
+	var items []*Item
+	batch := new(leveldb.Batch)
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		key := append([]byte{}, iter.Key()...)
+		items = append(items, &Item{
+			ID:    keyToID(key),
+			Key:   key,
+			Value: append([]byte{}, iter.Value()...),
+		})
+		batch.Delete(key)
+	}
+	if err := iter.Error(); err != nil {
 		return nil, err
 	}
+	s.cap.batch(batch, nil, 0, itemsSize(items))
 
-	// Remove this item from the stack.
-	if err := s.db.Delete(item.Key, nil); err != nil {
+	// Remove these items from the stack.
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
 		return nil, err
 	}
 
 	// Decrement head position.
-	s.head--
+	s.head -= uint64(len(items))
+	for _, item := range items {
+		s.compact.consumed(item.Key)
+		s.cap.removed(nil, uint64(len(item.Value)))
+	}
 
-	return item, nil
+	return items, nil
+}
+
+// PopWait removes the next item in the stack and returns it. If the
+// stack is empty, it blocks until an item is added, the given context is
+// done or the stack is closed.
+func (s *Stack) PopWait(ctx context.Context) (*Item, error) {
+	for {
+		s.Lock()
+
+		// Check if stack is closed.
+		if !s.isOpen {
+			s.Unlock()
+			return nil, ErrDBClosed
+		}
+
+		// Try to pop the next item.
+		item, err := s.pop(nil)
+		if err != ErrEmpty {
+			s.Unlock()
+			return item, err
+		}
+
+		// Wait for an item to be added.
+		wait := s.notify.wait()
+		s.Unlock()
+
+		if err := waitFor(ctx, wait, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Consume returns a channel that is fed items from the top of the stack
+// by a background goroutine as they become available, holding up to
+// bufferSize items that have been popped but not yet received.
+//
+// The channel is closed once the given context is done, the stack is
+// closed or an error occurs. When the context is done, any items that
+// were popped but not received are pushed back onto the stack. When the
+// stack is closed, items still buffered in the channel can be received
+// after it is closed.
+//
+// The error that stops the goroutine, or that prevents the items from
+// being pushed back, is passed to the OnConsumeError callback of the
+// options, if any.
+func (s *Stack) Consume(ctx context.Context, bufferSize int) <-chan *Item {
+	ch := make(chan *Item, bufferSize)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			item, err := s.PopWait(ctx)
+			if err == nil {
+				select {
+				case ch <- item:
+					continue
+				case <-ctx.Done():
+				}
+			}
+
+			// Push back the items that were dequeued but never received
+			// once the context is done, whether it was noticed while
+			// waiting for an item or while sending one.
+			if ctx.Err() != nil {
+				if items := drainItems(ch, item); len(items) > 0 {
+					reportConsumeError(s.onError, s.restore(items))
+				}
+			} else if err != ErrDBClosed {
+				reportConsumeError(s.onError, err)
+			}
+			return
+		}
+	}()
+
+	return ch
 }
 
 // Peek returns the next item in the stack without removing it.
@@ -209,10 +438,25 @@ func (s *Stack) Update(id uint64, newValue []byte) (*Item, error) {
 		Value: newValue,
 	}
 
+	// Check if the new value fits in the stack.
+	oldValue, err := s.db.Get(item.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	oldSize := uint64(len(oldValue))
+	if uint64(len(newValue)) > oldSize && !s.cap.fits(0, 0, uint64(len(newValue))-oldSize) {
+		return nil, ErrFull
+	}
+
 	// Update this item in the stack.
-	if err := s.db.Put(item.Key, item.Value, nil); err != nil {
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	s.cap.batch(batch, nil, uint64(len(newValue)), oldSize)
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
 		return nil, err
 	}
+	s.cap.removed(nil, oldSize)
+	s.cap.added(nil, uint64(len(newValue)))
 
 	return item, nil
 }
@@ -232,12 +476,12 @@ func (s *Stack) UpdateString(id uint64, newValue string) (*Item, error) {
 // package works. Because of this, you should only use this function
 // to encode simple types.
 func (s *Stack) UpdateObject(id uint64, newValue interface{}) (*Item, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(newValue); err != nil {
+	data, err := GobCodec.Encode(newValue)
+	if err != nil {
 		return nil, err
 	}
-	return s.Update(id, buffer.Bytes())
+
+	return s.Update(id, data)
 }
 
 // UpdateObjectAsJSON is a helper function for Update that accepts
@@ -246,12 +490,30 @@ func (s *Stack) UpdateObject(id uint64, newValue interface{}) (*Item, error) {
 //
 // Use this function to handle encoding of complex types.
 func (s *Stack) UpdateObjectAsJSON(id uint64, newValue interface{}) (*Item, error) {
-	jsonBytes, err := json.Marshal(newValue)
+	data, err := JSONCodec.Encode(newValue)
 	if err != nil {
 		return nil, err
 	}
 
-	return s.Update(id, jsonBytes)
+	return s.Update(id, data)
+}
+
+// UpdateValue is a helper function for Update that accepts any value
+// type, which is then encoded into a byte slice using the codec of the
+// stack.
+func (s *Stack) UpdateValue(id uint64, newValue interface{}) (*Item, error) {
+	data, err := s.codec.Encode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Update(id, data)
+}
+
+// DecodeValue decodes the value of the given item into the value pointed
+// to by value, using the codec of the stack.
+func (s *Stack) DecodeValue(item *Item, value interface{}) error {
+	return s.codec.Decode(item.Value, value)
 }
 
 // Length returns the total number of items in the stack.
@@ -259,6 +521,138 @@ func (s *Stack) Length() uint64 {
 	return s.head - s.tail
 }
 
+// SizeBytes returns the total size in bytes of the item values in the
+// stack.
+func (s *Stack) SizeBytes() uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.cap.bytes
+}
+
+// Quarantine removes the corrupt item reported by the given error from
+// the stack without reading its value, keeping the data it was stored as
+// in the quarantine list. Only the item on top of the stack can be
+// quarantined, otherwise ErrOutOfBounds is returned.
+func (s *Stack) Quarantine(corruption *ErrCorrupt) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return ErrDBClosed
+	}
+
+	// Check if the item is on top of the stack.
+	if s.Length() == 0 || !bytes.Equal(corruption.Key, idToKey(s.head)) {
+		return ErrOutOfBounds
+	}
+
+	// Move the item to the quarantine list.
+	batch := new(leveldb.Batch)
+	data, err := s.corrupt.take(batch, corruption.Key)
+	if err != nil {
+		return err
+	}
+	s.cap.batch(batch, nil, 0, uint64(len(data)))
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
+		return err
+	}
+
+	// Decrement head position. The size of the item is estimated from the
+	// data it was stored as.
+	s.head--
+	s.compact.consumed(corruption.Key)
+	s.cap.removed(nil, uint64(len(data)))
+
+	return nil
+}
+
+// Quarantined returns the items removed from the stack by Quarantine,
+// holding the data they were stored as.
+func (s *Stack) Quarantined() ([]*Item, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return s.corrupt.list()
+}
+
+// PurgeQuarantined deletes every item in the quarantine list.
+func (s *Stack) PurgeQuarantined() error {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return ErrDBClosed
+	}
+
+	return s.corrupt.purge()
+}
+
+// Verify deletes the blob files of the stack that no item or record
+// refers to, which can be left behind by a crash while writing or
+// removing an item, and returns their paths. It does nothing unless blob
+// files are enabled.
+func (s *Stack) Verify() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return s.db.verify()
+}
+
+// Reencrypt rewrites every value of the stack that is not encrypted
+// with the current encryption key, so the keys it was encrypted with
+// before can be retired. ErrNoEncryption is returned if the stack was
+// opened without encryption keys.
+func (s *Stack) Reencrypt() error {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return ErrDBClosed
+	}
+
+	return s.db.reencrypt(s.sync.options())
+}
+
+// CompressionStats returns the statistics of the values compressed by
+// the stack since it was opened.
+func (s *Stack) CompressionStats() CompressionStats {
+	return s.db.comp.stats()
+}
+
+// Compact compacts the whole LevelDB database of the stack, reclaiming
+// the space of removed items and speeding up iteration over the keys
+// they left behind.
+func (s *Stack) Compact() error {
+	s.RLock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		s.RUnlock()
+		return ErrDBClosed
+	}
+
+	// Register the compaction so closing waits for it.
+	done := s.compact.begin()
+	s.RUnlock()
+	defer done()
+
+	return s.compact.compact()
+}
+
 // Close closes the LevelDB database of the stack.
 func (s *Stack) Close() error {
 	s.Lock()
@@ -269,6 +663,12 @@ func (s *Stack) Close() error {
 		return nil
 	}
 
+	// Stop compacting and sync any pending writes.
+	s.compact.close()
+	if err := s.sync.close(); err != nil {
+		return err
+	}
+
 	// Close the LevelDB database.
 	if err := s.db.Close(); err != nil {
 		return err
@@ -280,16 +680,132 @@ func (s *Stack) Close() error {
 	s.tail = 0
 	s.isOpen = false
 
+	// Wake any goroutines waiting for an item or for space.
+	s.notify.broadcast()
+	s.cap.reset()
+
 	return nil
 }
 
-// Drop closes and deletes the LevelDB database of the stack.
+// Drop closes and deletes the LevelDB database of the stack, or only its
+// keys if it is hosted by a Store.
 func (s *Stack) Drop() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(s.DataDir)
+	return s.db.drop()
+}
+
+// push adds an item to the stack.
+func (s *Stack) push(value []byte) (*Item, error) {
+	// Check if the item fits in the stack.
+	if !s.cap.fits(s.Length(), 1, uint64(len(value))) {
+		return nil, ErrFull
+	}
+
+	// Create new Item.
+	item := &Item{
+		ID:    s.head + 1,
+		Key:   idToKey(s.head + 1),
+		Value: value,
+	}
+
+	// Add it to the stack.
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	s.cap.batch(batch, nil, uint64(len(value)), 0)
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Increment head position.
+	s.head++
+	s.cap.added(nil, uint64(len(value)))
+
+	// Wake any goroutines waiting for an item.
+	s.notify.broadcast()
+
+	return item, nil
+}
+
+// popChecked removes the next item in the stack like Pop, unless the
+// given function returns an error for its value, in which case the item
+// is kept and returned along with the error.
+func (s *Stack) popChecked(check func(value []byte) error) (*Item, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	return s.pop(check)
+}
+
+// pop removes the next item in the stack and returns it, unless the
+// given function is not nil and returns an error for its value.
+func (s *Stack) pop(check func(value []byte) error) (*Item, error) {
+	// Try to get the next item in the stack.
+	item, err := s.getItemByID(s.head)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the item if the given function rejects its value.
+	if check != nil {
+		if err := check(item.Value); err != nil {
+			return item, err
+		}
+	}
+
+	// Remove this item from the stack.
+	batch := new(leveldb.Batch)
+	batch.Delete(item.Key)
+	s.cap.batch(batch, nil, 0, uint64(len(item.Value)))
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
+		return nil, err
+	}
+
+	// Decrement head position.
+	s.head--
+	s.compact.consumed(item.Key)
+	s.cap.removed(nil, uint64(len(item.Value)))
+
+	return item, nil
+}
+
+// restore pushes the given popped items back onto the stack, where the
+// first item ends up on top.
+func (s *Stack) restore(items []*Item) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// Check if stack is closed.
+	if !s.isOpen {
+		return ErrDBClosed
+	}
+
+	// Push the items back as a single write, the last one first.
+	batch := new(leveldb.Batch)
+	size := itemsSize(items)
+	for i := len(items) - 1; i >= 0; i-- {
+		batch.Put(idToKey(s.head+uint64(len(items)-i)), items[i].Value)
+	}
+	s.cap.batch(batch, nil, size, 0)
+	if err := s.db.Write(batch, s.sync.options()); err != nil {
+		return err
+	}
+
+	// Increment head position.
+	s.head += uint64(len(items))
+	s.cap.added(nil, size)
+
+	// Wake any goroutines waiting for an item.
+	s.notify.broadcast()
+
+	return nil
 }
 
 // getItemByID returns an item, if found, for the given ID.
@@ -314,7 +830,7 @@ func (s *Stack) getItemByID(id uint64) (*Item, error) {
 // init initializes the stack data.
 func (s *Stack) init() error {
 	// Create a new LevelDB Iterator.
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(itemRange(), nil)
 	defer iter.Release()
 
 	// Set stack head to the last item.
@@ -327,5 +843,10 @@ func (s *Stack) init() error {
 		s.tail = keyToID(iter.Key()) - 1
 	}
 
-	return iter.Error()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// Load the size of the items.
+	return s.cap.load(itemRange(), nil, nil, false)
 }
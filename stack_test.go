@@ -1,6 +1,7 @@
 package goque
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -52,6 +53,141 @@ func TestStackDrop(t *testing.T) {
 	}
 }
 
+func TestStackOpenWithOptions(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStackWithOptions(file, &Options{Durability: SyncEveryWrite})
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	if _, err = s.PushString("value"); err != nil {
+		t.Error(err)
+	}
+
+	s.Close()
+
+	s, err = OpenStackWithOptions(file, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Close()
+
+	if s.Length() != 1 {
+		t.Errorf("Expected stack length of 1, got %d", s.Length())
+	}
+}
+
+func TestStackCompact(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStackWithOptions(file, &Options{CompactionThreshold: 10})
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 30; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 20; i++ {
+		if _, err = s.Pop(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = s.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if popItem.ToString() != "value for item 10" {
+		t.Errorf("Expected string to be 'value for item 10', got '%s'", popItem.ToString())
+	}
+}
+
+func TestStackPushWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStackWithOptions(file, &Options{MaxItems: 2})
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 2; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = s.PushString("value for item 3"); err != ErrFull {
+		t.Errorf("Expected to get full error, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Pop()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = s.PushWait(ctx, []byte("value for item 3")); err != nil {
+		t.Fatal(err)
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 3"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+}
+
+func TestStackSizeBytes(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = s.PushString("0123456789"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = s.PopN(3); err != nil {
+		t.Error(err)
+	}
+
+	if s.SizeBytes() != 70 {
+		t.Errorf("Expected size of 70 bytes, got %d", s.SizeBytes())
+	}
+
+	s.Close()
+
+	s, err = OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s.SizeBytes() != 70 {
+		t.Errorf("Expected size of 70 bytes after reopening, got %d", s.SizeBytes())
+	}
+}
+
 func TestStackIncompatibleType(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	pq, err := OpenPriorityQueue(file, ASC)
@@ -85,6 +221,35 @@ func TestStackPush(t *testing.T) {
 	}
 }
 
+func TestStackPushBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	values := [][]byte{[]byte("value for item 1"), []byte("value for item 2")}
+	if _, err = s.PushBatch(values); err != nil {
+		t.Error(err)
+	}
+
+	if s.Length() != 2 {
+		t.Errorf("Expected stack length of 2, got %d", s.Length())
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 2"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+}
+
 func TestStackPop(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	s, err := OpenStack(file)
@@ -119,6 +284,64 @@ func TestStackPop(t *testing.T) {
 	}
 }
 
+func TestStackPopN(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 5; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	items, err := s.PopN(3)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(items))
+	}
+
+	for i, item := range items {
+		compStr := fmt.Sprintf("value for item %d", 5-i)
+
+		if item.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+		}
+	}
+
+	if s.Length() != 2 {
+		t.Errorf("Expected stack length of 2, got %d", s.Length())
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if popItem.ToString() != "value for item 2" {
+		t.Errorf("Expected string to be 'value for item 2', got '%s'", popItem.ToString())
+	}
+
+	items, err = s.PopN(10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(items) != 1 || items[0].ToString() != "value for item 1" {
+		t.Errorf("Expected the remaining item, got %v", items)
+	}
+
+	if _, err = s.PopN(1); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+}
+
 func TestStackPushPopPointerJSON(t *testing.T) {
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
 	q, err := OpenStack(file)
@@ -588,6 +811,91 @@ func TestStackOutOfBounds(t *testing.T) {
 	}
 }
 
+func TestStackPopWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.PushString("value for item")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	popItem, err := s.PopWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compStr := "value for item"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Close()
+	}()
+
+	if _, err = s.PopWait(ctx); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestStackConsume(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	s, err := OpenStack(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 5; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.Consume(ctx, 2)
+
+	received := 0
+	item := <-ch
+	received++
+
+	compStr := "value for item 5"
+
+	if item.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, item.ToString())
+	}
+
+	cancel()
+	for range ch {
+		received++
+	}
+
+	if s.Length() != uint64(5-received) {
+		t.Errorf("Expected stack length of %d, got %d", 5-received, s.Length())
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = fmt.Sprintf("value for item %d", 5-received)
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+}
+
 func BenchmarkStackPush(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
@@ -0,0 +1,129 @@
+package goque
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Storage is an ordered key-value store a data structure keeps its items
+// and internal records in. Keys are ordered bytewise. Get returns
+// leveldb.ErrNotFound for a key that does not exist, and values returned
+// by Get must be safe for the caller to modify.
+//
+// A Storage must be safe for concurrent use. Batches must be applied
+// atomically, and when sync is true, durably before returning. Iterators
+// only need to be consistent for keys that are not written while they
+// are in use.
+type Storage interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte, sync bool) error
+	Delete(key []byte, sync bool) error
+	Write(batch *leveldb.Batch, sync bool) error
+	NewIterator(r *util.Range) iterator.Iterator
+	Snapshot() (StorageSnapshot, error)
+	Compact(r util.Range) error
+	Close() error
+}
+
+// StorageSnapshot is a read-only view of a Storage as it was when the
+// snapshot was taken.
+type StorageSnapshot interface {
+	Get(key []byte) ([]byte, error)
+	NewIterator(r *util.Range) iterator.Iterator
+	Release()
+}
+
+// levelDBStorage is the Storage of a LevelDB database.
+type levelDBStorage struct {
+	db *leveldb.DB
+}
+
+// openLevelDBStorage opens the LevelDB database at the given directory,
+// using the given options.
+func openLevelDBStorage(dataDir string, opts *Options) (*levelDBStorage, error) {
+	db, err := leveldb.OpenFile(dataDir, levelDBOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelDBStorage{db: db}, nil
+}
+
+// writeOptions returns the LevelDB write options for a write that is
+// synced if sync is true.
+func writeOptions(sync bool) *opt.WriteOptions {
+	if !sync {
+		return nil
+	}
+
+	return &opt.WriteOptions{Sync: true}
+}
+
+// Get gets the value for the given key.
+func (ls *levelDBStorage) Get(key []byte) ([]byte, error) {
+	return ls.db.Get(key, nil)
+}
+
+// Put sets the value for the given key.
+func (ls *levelDBStorage) Put(key, value []byte, sync bool) error {
+	return ls.db.Put(key, value, writeOptions(sync))
+}
+
+// Delete deletes the value for the given key.
+func (ls *levelDBStorage) Delete(key []byte, sync bool) error {
+	return ls.db.Delete(key, writeOptions(sync))
+}
+
+// Write applies the given batch as a single atomic write.
+func (ls *levelDBStorage) Write(batch *leveldb.Batch, sync bool) error {
+	return ls.db.Write(batch, writeOptions(sync))
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole database if it is nil.
+func (ls *levelDBStorage) NewIterator(r *util.Range) iterator.Iterator {
+	return ls.db.NewIterator(r, nil)
+}
+
+// Snapshot returns a LevelDB snapshot of the database.
+func (ls *levelDBStorage) Snapshot() (StorageSnapshot, error) {
+	snap, err := ls.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelDBSnapshot{snap: snap}, nil
+}
+
+// Compact compacts the keys of the given range.
+func (ls *levelDBStorage) Compact(r util.Range) error {
+	return ls.db.CompactRange(r)
+}
+
+// Close closes the database.
+func (ls *levelDBStorage) Close() error {
+	return ls.db.Close()
+}
+
+// levelDBSnapshot is the StorageSnapshot of a LevelDB snapshot.
+type levelDBSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+// Get gets the value for the given key.
+func (ls *levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return ls.snap.Get(key, nil)
+}
+
+// NewIterator returns an iterator over the keys of the given range, or of
+// the whole snapshot if it is nil.
+func (ls *levelDBSnapshot) NewIterator(r *util.Range) iterator.Iterator {
+	return ls.snap.NewIterator(r, nil)
+}
+
+// Release releases the snapshot.
+func (ls *levelDBSnapshot) Release() {
+	ls.snap.Release()
+}
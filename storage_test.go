@@ -0,0 +1,500 @@
+package goque
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestStackInMemory(t *testing.T) {
+	s, err := OpenStackInMemory()
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 10"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+
+	if s.Length() != 9 {
+		t.Errorf("Expected stack length of 9, got %d", s.Length())
+	}
+}
+
+func TestQueueInMemory(t *testing.T) {
+	q, err := OpenQueueInMemory()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	// Modifying a returned value must not change the stored one.
+	peekItem, err := q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+	peekItem.Value[0] = 'X'
+
+	peekItem, err = q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for item 2"
+
+	if peekItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, peekItem.ToString())
+	}
+
+	snap, err := q.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.Dequeue(); err != nil {
+		t.Error(err)
+	}
+
+	snapItem, err := snap.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if snapItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, snapItem.ToString())
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Error(err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.Dequeue(); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+
+	if err = q.Drop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriorityQueueInMemory(t *testing.T) {
+	pq, err := OpenPriorityQueueInMemory(DESC)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 4; p++ {
+		if _, err = pq.EnqueueString(uint8(p), fmt.Sprintf("value for priority %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for priority 4"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestPrefixQueueInMemory(t *testing.T) {
+	pq, err := OpenPrefixQueueInMemory()
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = pq.EnqueueString("prefix", fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	deqItem, err := pq.DequeueString("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	if pq.Length() != 9 {
+		t.Errorf("Expected prefix queue length of 9, got %d", pq.Length())
+	}
+}
+
+func TestMemoryStorageRebuild(t *testing.T) {
+	storage := NewMemoryStorage()
+	q, err := OpenQueueWithStorage(storage, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	value := make([]byte, 1024)
+	for i := 0; i < 4096; i++ {
+		if _, err = q.Enqueue(value); err != nil {
+			t.Error(err)
+		}
+		if _, err = q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = q.EnqueueString("value for last item"); err != nil {
+		t.Error(err)
+	}
+
+	ms := storage.(*memoryStorage)
+	if ms.written >= 2*memoryRebuildSize {
+		t.Errorf("Expected storage to be rebuilt, got %d bytes written", ms.written)
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for last item"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+}
+
+func TestQueueSegmentStorage(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	storage, err := OpenSegmentStorage(file, 4096)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	q, err := OpenQueueWithStorage(storage, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 1000; i++ {
+		if _, err = q.EnqueueString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i := 1; i <= 900; i++ {
+		if _, err = q.Dequeue(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	segment := filepath.Join(file, fmt.Sprintf("%016d.seg", 1))
+	if _, err = os.Stat(segment); !os.IsNotExist(err) {
+		t.Errorf("Expected consumed segment to be deleted, got %v", err)
+	}
+
+	if err = q.Close(); err != nil {
+		t.Error(err)
+	}
+
+	storage, err = OpenSegmentStorage(file, 4096)
+	if err != nil {
+		t.Error(err)
+	}
+
+	q, err = OpenQueueWithStorage(storage, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Close()
+
+	if q.Length() != 100 {
+		t.Errorf("Expected queue length of 100, got %d", q.Length())
+	}
+
+	for i := 901; i <= 1000; i++ {
+		deqItem, err := q.Dequeue()
+		if err != nil {
+			t.Error(err)
+		}
+
+		compStr := fmt.Sprintf("value for item %d", i)
+
+		if deqItem.ToString() != compStr {
+			t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+		}
+	}
+}
+
+func TestStackSegmentStorage(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	storage, err := OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	s, err := OpenStackWithStorage(storage, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		if _, err = s.PushString(fmt.Sprintf("value for item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err = s.Pop(); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.PushString("value for new item"); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.UpdateString(1, "value for updated item"); err != nil {
+		t.Error(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	storage, err = OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err = OpenStackWithStorage(storage, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Close()
+
+	if s.Length() != 10 {
+		t.Errorf("Expected stack length of 10, got %d", s.Length())
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for new item"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+
+	idItem, err := s.PeekByID(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for updated item"
+
+	if idItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, idItem.ToString())
+	}
+}
+
+func TestSegmentStorageTornWrite(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	storage, err := OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	for i := 1; i <= 3; i++ {
+		if err = storage.Put(idToKey(uint64(i)), []byte(fmt.Sprintf("value for item %d", i)), false); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = storage.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Append a frame cut short by a crash.
+	segment := filepath.Join(file, fmt.Sprintf("%016d.seg", 1))
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = f.Write([]byte{0, 0, 0, 64, 1, 2, 3, 4, 1}); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+
+	storage, err = OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = storage.Put(idToKey(4), []byte("value for item 4"), true); err != nil {
+		t.Error(err)
+	}
+
+	if err = storage.Close(); err != nil {
+		t.Error(err)
+	}
+
+	storage, err = OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	defer storage.Close()
+
+	iter := storage.NewIterator(nil)
+	defer iter.Release()
+
+	var count uint64
+	for iter.Next() {
+		count++
+
+		compStr := fmt.Sprintf("value for item %d", count)
+
+		if keyToID(iter.Key()) != count || string(iter.Value()) != compStr {
+			t.Errorf("Expected item %d to be '%s', got %d '%s'", count, compStr, keyToID(iter.Key()), iter.Value())
+		}
+	}
+
+	if count != 4 {
+		t.Errorf("Expected 4 items, got %d", count)
+	}
+}
+
+func TestSegmentStorageLock(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	storage, err := OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	if _, err = OpenSegmentStorage(file, 0); err == nil {
+		t.Error("Expected to get an error opening a locked storage, got nil")
+	}
+
+	if err = storage.Close(); err != nil {
+		t.Error(err)
+	}
+
+	storage, err = OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = storage.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSegmentStorageInternalKeys(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	storage, err := OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	internalKey := append(append([]byte{}, internalPrefix...), "size"...)
+
+	for i := 1; i <= 3; i++ {
+		if err = storage.Put(idToKey(uint64(i)), []byte(fmt.Sprintf("value for item %d", i)), false); err != nil {
+			t.Error(err)
+		}
+		if err = storage.Put(internalKey, []byte(fmt.Sprintf("value for key %d", i)), false); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = storage.Close(); err != nil {
+		t.Error(err)
+	}
+
+	storage, err = OpenSegmentStorage(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	value, err := storage.Get(internalKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if compStr := "value for key 3"; string(value) != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, value)
+	}
+
+	iter := storage.NewIterator(nil)
+	defer iter.Release()
+
+	var keys [][]byte
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+
+	if len(keys) != 4 || string(keys[3]) != string(internalKey) {
+		t.Fatalf("Expected 3 items followed by the internal key, got %d keys", len(keys))
+	}
+	for i := 1; i <= 3; i++ {
+		if keyToID(keys[i-1]) != uint64(i) {
+			t.Errorf("Expected key %d to be item %d, got %d", i, i, keyToID(keys[i-1]))
+		}
+	}
+
+	if err = storage.Delete(internalKey, false); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = storage.Get(internalKey); err != leveldb.ErrNotFound {
+		t.Errorf("Expected to get not found error, got %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package goque
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// storeDropBatchSize is the number of keys deleted per write when a data
+// structure hosted by a Store is dropped.
+const storeDropBatchSize = 1000
+
+// storeNamesPrefix is the key prefix for the names of the data structures
+// hosted by a Store. Each data structure stores its keys under a prefix
+// made of its 8 byte ID, which starts at 1, so they never collide.
+var storeNamesPrefix = idToKey(0)
+
+// errStoreRecord is returned when a stored name record cannot be decoded.
+var errStoreRecord = errors.New("goque: Invalid store name record")
+
+// Store hosts many named stacks and queues in a single LevelDB database,
+// storing the keys of each under its own prefix. This avoids the file
+// locks, caches and background compaction of a separate database for
+// every data structure.
+type Store struct {
+	sync.RWMutex
+	DataDir    string
+	db         Storage
+	seq        uint64
+	mu         sync.Mutex
+	structures map[string]io.Closer
+	isOpen     bool
+}
+
+// OpenStore opens a store if one exists at the given directory. If one
+// does not already exist, a new store is created.
+func OpenStore(dataDir string) (*Store, error) {
+	return OpenStoreWithOptions(dataDir, nil)
+}
+
+// OpenStoreWithOptions opens a store like OpenStore, using the LevelDB
+// settings of the given options. If opts is nil, the default options are
+// used.
+func OpenStoreWithOptions(dataDir string, opts *Options) (*Store, error) {
+	// Create a new Store.
+	st := &Store{
+		DataDir:    dataDir,
+		structures: make(map[string]io.Closer),
+		isOpen:     false,
+	}
+
+	// Open database for the store.
+	ks, err := openKeyspace(dataDir, goqueStore, opts)
+	if err != nil {
+		return st, err
+	}
+	st.db = ks.db
+
+	// Set isOpen and return.
+	st.isOpen = true
+	return st, st.init()
+}
+
+// OpenStack opens the stack with the given name, creating it if it does
+// not exist yet.
+func (st *Store) OpenStack(name string) (*Stack, error) {
+	return st.OpenStackWithOptions(name, nil)
+}
+
+// OpenStackWithOptions opens the stack with the given name like
+// OpenStack, using the given options. The LevelDB settings of the options
+// are ignored, as the database is shared by the whole store.
+func (st *Store) OpenStackWithOptions(name string, opts *Options) (*Stack, error) {
+	c, err := st.openStructure(name, goqueStack, func(db *keyspace) (io.Closer, error) {
+		return openStack(st.DataDir, db, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := c.(*Stack)
+	if !ok {
+		return nil, ErrIncompatibleType
+	}
+
+	return s, nil
+}
+
+// OpenQueue opens the queue with the given name, creating it if it does
+// not exist yet.
+func (st *Store) OpenQueue(name string) (*Queue, error) {
+	return st.OpenQueueWithOptions(name, nil)
+}
+
+// OpenQueueWithOptions opens the queue with the given name like
+// OpenQueue, using the given options. The LevelDB settings of the options
+// are ignored, as the database is shared by the whole store.
+func (st *Store) OpenQueueWithOptions(name string, opts *Options) (*Queue, error) {
+	c, err := st.openStructure(name, goqueQueue, func(db *keyspace) (io.Closer, error) {
+		return openQueue(st.DataDir, db, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := c.(*Queue)
+	if !ok {
+		return nil, ErrIncompatibleType
+	}
+
+	return q, nil
+}
+
+// OpenPriorityQueue opens the priority queue with the given name, creating
+// it if it does not exist yet.
+func (st *Store) OpenPriorityQueue(name string, order order) (*PriorityQueue, error) {
+	return st.OpenPriorityQueueWithOptions(name, order, nil)
+}
+
+// OpenPriorityQueueWithOptions opens the priority queue with the given
+// name like OpenPriorityQueue, using the given options. The LevelDB
+// settings of the options are ignored, as the database is shared by the
+// whole store.
+func (st *Store) OpenPriorityQueueWithOptions(name string, order order, opts *Options) (*PriorityQueue, error) {
+	c, err := st.openStructure(name, goquePriorityQueue, func(db *keyspace) (io.Closer, error) {
+		return openPriorityQueue(st.DataDir, db, order, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pq, ok := c.(*PriorityQueue)
+	if !ok {
+		return nil, ErrIncompatibleType
+	}
+
+	return pq, nil
+}
+
+// OpenPrefixQueue opens the prefix queue with the given name, creating it
+// if it does not exist yet.
+func (st *Store) OpenPrefixQueue(name string) (*PrefixQueue, error) {
+	return st.OpenPrefixQueueWithOptions(name, nil)
+}
+
+// OpenPrefixQueueWithOptions opens the prefix queue with the given name
+// like OpenPrefixQueue, using the given options. The LevelDB settings of
+// the options are ignored, as the database is shared by the whole store.
+func (st *Store) OpenPrefixQueueWithOptions(name string, opts *Options) (*PrefixQueue, error) {
+	c, err := st.openStructure(name, goquePrefixQueue, func(db *keyspace) (io.Closer, error) {
+		return openPrefixQueue(st.DataDir, db, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pq, ok := c.(*PrefixQueue)
+	if !ok {
+		return nil, ErrIncompatibleType
+	}
+
+	return pq, nil
+}
+
+// List returns the names of the data structures in the store, in sorted
+// order.
+func (st *Store) List() ([]string, error) {
+	st.RLock()
+	defer st.RUnlock()
+
+	// Check if store is closed.
+	if !st.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	iter := st.db.NewIterator(util.BytesPrefix(storeNamesPrefix))
+	defer iter.Release()
+
+	var names []string
+	for iter.Next() {
+		names = append(names, string(iter.Key()[len(storeNamesPrefix):]))
+	}
+
+	return names, iter.Error()
+}
+
+// Drop closes the data structure with the given name if it is open, and
+// deletes it from the store. Dropping a name that does not exist does
+// nothing.
+func (st *Store) Drop(name string) error {
+	st.Lock()
+	defer st.Unlock()
+
+	// Check if store is closed.
+	if !st.isOpen {
+		return ErrDBClosed
+	}
+
+	// Close the data structure if it is open.
+	st.mu.Lock()
+	c := st.structures[name]
+	st.mu.Unlock()
+	if c != nil {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Get the key prefix of the data structure.
+	nameKey := append(append([]byte{}, storeNamesPrefix...), name...)
+	rec, err := st.db.Get(nameKey)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(rec) != 9 {
+		return errStoreRecord
+	}
+
+	// Delete its keys, followed by its name.
+	iter := st.db.NewIterator(util.BytesPrefix(rec[1:]))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		if batch.Len() >= storeDropBatchSize {
+			if err := st.db.Write(batch, false); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Delete(nameKey)
+	if err := st.db.Write(batch, false); err != nil {
+		return err
+	}
+
+	// Delete its blob files.
+	return dropBlobs(st.DataDir, rec[1:])
+}
+
+// Close closes every open data structure of the store, followed by the
+// LevelDB database of the store.
+func (st *Store) Close() error {
+	st.Lock()
+	defer st.Unlock()
+
+	// Check if store is already closed.
+	if !st.isOpen {
+		return nil
+	}
+
+	// Close the open data structures.
+	st.mu.Lock()
+	structures := make([]io.Closer, 0, len(st.structures))
+	for _, c := range st.structures {
+		structures = append(structures, c)
+	}
+	st.mu.Unlock()
+
+	for _, c := range structures {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Close the LevelDB database.
+	if err := st.db.Close(); err != nil {
+		return err
+	}
+
+	// Reset the ID sequence and set isOpen to false.
+	st.seq = 0
+	st.isOpen = false
+
+	return nil
+}
+
+// openStructure returns the open data structure with the given name, or opens it
+// with the given function, registering it as a data structure of the
+// given type if it does not exist yet.
+func (st *Store) openStructure(name string, gt goqueType, open func(db *keyspace) (io.Closer, error)) (io.Closer, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	// Check if store is closed.
+	if !st.isOpen {
+		return nil, ErrDBClosed
+	}
+
+	// Return the data structure if it is already open.
+	st.mu.Lock()
+	c, ok := st.structures[name]
+	st.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	// Get the key prefix of the data structure.
+	prefix, err := st.register(name, gt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the data structure.
+	c, err = open(&keyspace{
+		db:     st.db,
+		prefix: prefix,
+		dir:    st.DataDir,
+		store:  st,
+		name:   name,
+	})
+	if err != nil {
+		if c != nil {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	st.mu.Lock()
+	st.structures[name] = c
+	st.mu.Unlock()
+
+	return c, nil
+}
+
+// register returns the key prefix of the data structure with the given
+// name, registering it as a data structure of the given type with the
+// next ID if it does not exist yet.
+func (st *Store) register(name string, gt goqueType) ([]byte, error) {
+	nameKey := append(append([]byte{}, storeNamesPrefix...), name...)
+
+	// Check the type of an existing data structure.
+	rec, err := st.db.Get(nameKey)
+	if err == nil {
+		if len(rec) != 9 {
+			return nil, errStoreRecord
+		}
+		if !compatibleTypes(goqueType(rec[0]), gt) {
+			return nil, ErrIncompatibleType
+		}
+
+		return rec[1:], nil
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+
+	// Register a new data structure.
+	rec = append([]byte{byte(gt)}, idToKey(st.seq+1)...)
+	if err := st.db.Put(nameKey, rec, false); err != nil {
+		return nil, err
+	}
+	st.seq++
+
+	return rec[1:], nil
+}
+
+// release removes the data structure with the given name from the open
+// data structures once it has been closed.
+func (st *Store) release(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.structures, name)
+}
+
+// init initializes the store data.
+func (st *Store) init() error {
+	iter := st.db.NewIterator(util.BytesPrefix(storeNamesPrefix))
+	defer iter.Release()
+
+	// Find the highest ID in use.
+	for iter.Next() {
+		rec := iter.Value()
+		if len(rec) != 9 {
+			return errStoreRecord
+		}
+		if id := keyToID(rec[1:]); id > st.seq {
+			st.seq = id
+		}
+	}
+
+	return iter.Error()
+}
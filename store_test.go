@@ -0,0 +1,251 @@
+package goque
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreClose(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	q, err := st.OpenQueue("queue")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = q.EnqueueString("value"); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+
+	if _, err = st.OpenQueue("queue"); err != ErrDBClosed {
+		t.Errorf("Expected to get database closed error, got %v", err)
+	}
+}
+
+func TestStoreStructures(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	q1, err := st.OpenQueue("queue1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	q2, err := st.OpenQueue("queue2")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err := st.OpenStack("stack")
+	if err != nil {
+		t.Error(err)
+	}
+
+	pq, err := st.OpenPriorityQueue("priority", ASC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	prq, err := st.OpenPrefixQueue("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q1.EnqueueString(fmt.Sprintf("queue1 item %d", i)); err != nil {
+			t.Error(err)
+		}
+		if _, err = s.PushString(fmt.Sprintf("stack item %d", i)); err != nil {
+			t.Error(err)
+		}
+		if _, err = pq.EnqueueString(uint8(i%2), fmt.Sprintf("priority item %d", i)); err != nil {
+			t.Error(err)
+		}
+		if _, err = prq.EnqueueString("prefix", fmt.Sprintf("prefix item %d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if q2.Length() != 0 {
+		t.Errorf("Expected queue2 length of 0, got %d", q2.Length())
+	}
+
+	if same, err := st.OpenQueue("queue1"); err != nil || same != q1 {
+		t.Errorf("Expected to get the open queue, got %v", err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Error(err)
+	}
+
+	st, err = OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer st.Close()
+
+	q1, err = st.OpenQueue("queue1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	s, err = st.OpenStack("stack")
+	if err != nil {
+		t.Error(err)
+	}
+
+	pq, err = st.OpenPriorityQueue("priority", ASC)
+	if err != nil {
+		t.Error(err)
+	}
+
+	prq, err = st.OpenPrefixQueue("prefix")
+	if err != nil {
+		t.Error(err)
+	}
+
+	deqItem, err := q1.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "queue1 item 1"
+
+	if deqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, deqItem.ToString())
+	}
+
+	popItem, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "stack item 10"
+
+	if popItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, popItem.ToString())
+	}
+
+	pqItem, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "priority item 2"
+
+	if pqItem.ToString() != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, pqItem.ToString())
+	}
+
+	if prq.Length() != 10 {
+		t.Errorf("Expected prefix queue length of 10, got %d", prq.Length())
+	}
+}
+
+func TestStoreListDrop(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+	defer st.Close()
+
+	for _, name := range []string{"c", "a", "b"} {
+		q, err := st.OpenQueue(name)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if _, err = q.EnqueueString("value for " + name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	names, err := st.List()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fmt.Sprint(names) != "[a b c]" {
+		t.Errorf("Expected names to be [a b c], got %v", names)
+	}
+
+	if err = st.Drop("b"); err != nil {
+		t.Error(err)
+	}
+
+	a, err := st.OpenQueue("a")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = a.Drop(); err != nil {
+		t.Error(err)
+	}
+
+	names, err = st.List()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if fmt.Sprint(names) != "[c]" {
+		t.Errorf("Expected names to be [c], got %v", names)
+	}
+
+	b, err := st.OpenQueue("b")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if b.Length() != 0 {
+		t.Errorf("Expected dropped queue to be recreated empty, got length %d", b.Length())
+	}
+
+	c, err := st.OpenQueue("c")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if c.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", c.Length())
+	}
+}
+
+func TestStoreIncompatibleType(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	st, err := OpenStore(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(file)
+
+	if _, err = st.OpenQueue("queue"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = st.OpenPriorityQueue("queue", ASC); err != ErrIncompatibleType {
+		t.Errorf("Expected to get incompatible type error, got %v", err)
+	}
+
+	st.Close()
+
+	if _, err = OpenQueue(file); err != ErrIncompatibleType {
+		t.Errorf("Expected to get incompatible type error, got %v", err)
+	}
+}
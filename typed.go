@@ -0,0 +1,376 @@
+package goque
+
+// TypedStack is a stack of values of type T. Values are encoded and
+// decoded using the codec of the underlying stack.
+type TypedStack[T any] struct {
+	s *Stack
+}
+
+// OpenTypedStack opens a typed stack like OpenStackWithOptions. If opts
+// is nil, the default options are used.
+func OpenTypedStack[T any](dataDir string, opts *Options) (*TypedStack[T], error) {
+	s, err := OpenStackWithOptions(dataDir, opts)
+	return NewTypedStack[T](s), err
+}
+
+// NewTypedStack returns a typed stack wrapping the given stack.
+func NewTypedStack[T any](s *Stack) *TypedStack[T] {
+	return &TypedStack[T]{s: s}
+}
+
+// Stack returns the underlying stack.
+func (ts *TypedStack[T]) Stack() *Stack {
+	return ts.s
+}
+
+// Push adds a value to the stack and returns its ID.
+func (ts *TypedStack[T]) Push(value T) (uint64, error) {
+	item, err := ts.s.PushValue(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return item.ID, nil
+}
+
+// Pop removes the next value in the stack and returns it with its ID. A
+// value that cannot be decoded is kept in the stack, and its ID returned
+// with the error.
+func (ts *TypedStack[T]) Pop() (T, uint64, error) {
+	return typedCodec[T]{ts.s.codec}.removeItem(ts.s.popChecked)
+}
+
+// Peek returns the next value in the stack and its ID without removing
+// it.
+func (ts *TypedStack[T]) Peek() (T, uint64, error) {
+	return typedCodec[T]{ts.s.codec}.decodeItem(ts.s.Peek())
+}
+
+// PeekByID returns the value with the given ID without removing it.
+func (ts *TypedStack[T]) PeekByID(id uint64) (T, error) {
+	value, _, err := typedCodec[T]{ts.s.codec}.decodeItem(ts.s.PeekByID(id))
+	return value, err
+}
+
+// Update updates the value with the given ID.
+func (ts *TypedStack[T]) Update(id uint64, newValue T) error {
+	_, err := ts.s.UpdateValue(id, newValue)
+	return err
+}
+
+// Length returns the total number of values in the stack.
+func (ts *TypedStack[T]) Length() uint64 {
+	return ts.s.Length()
+}
+
+// Close closes the stack.
+func (ts *TypedStack[T]) Close() error {
+	return ts.s.Close()
+}
+
+// Drop closes and deletes the stack.
+func (ts *TypedStack[T]) Drop() error {
+	return ts.s.Drop()
+}
+
+// TypedQueue is a queue of values of type T. Values are encoded and
+// decoded using the codec of the underlying queue.
+type TypedQueue[T any] struct {
+	q *Queue
+}
+
+// OpenTypedQueue opens a typed queue like OpenQueueWithOptions. If opts
+// is nil, the default options are used.
+func OpenTypedQueue[T any](dataDir string, opts *Options) (*TypedQueue[T], error) {
+	q, err := OpenQueueWithOptions(dataDir, opts)
+	return NewTypedQueue[T](q), err
+}
+
+// NewTypedQueue returns a typed queue wrapping the given queue.
+func NewTypedQueue[T any](q *Queue) *TypedQueue[T] {
+	return &TypedQueue[T]{q: q}
+}
+
+// Queue returns the underlying queue.
+func (tq *TypedQueue[T]) Queue() *Queue {
+	return tq.q
+}
+
+// Enqueue adds a value to the queue and returns its ID.
+func (tq *TypedQueue[T]) Enqueue(value T) (uint64, error) {
+	item, err := tq.q.EnqueueValue(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return item.ID, nil
+}
+
+// Dequeue removes the next value in the queue and returns it with its
+// ID. A value that cannot be decoded is kept in the queue, and its ID
+// returned with the error.
+func (tq *TypedQueue[T]) Dequeue() (T, uint64, error) {
+	return typedCodec[T]{tq.q.codec}.removeItem(tq.q.dequeueChecked)
+}
+
+// Peek returns the next value in the queue and its ID without removing
+// it.
+func (tq *TypedQueue[T]) Peek() (T, uint64, error) {
+	return typedCodec[T]{tq.q.codec}.decodeItem(tq.q.Peek())
+}
+
+// PeekByID returns the value with the given ID without removing it.
+func (tq *TypedQueue[T]) PeekByID(id uint64) (T, error) {
+	value, _, err := typedCodec[T]{tq.q.codec}.decodeItem(tq.q.PeekByID(id))
+	return value, err
+}
+
+// Update updates the value with the given ID.
+func (tq *TypedQueue[T]) Update(id uint64, newValue T) error {
+	_, err := tq.q.UpdateValue(id, newValue)
+	return err
+}
+
+// Length returns the total number of values in the queue.
+func (tq *TypedQueue[T]) Length() uint64 {
+	return tq.q.Length()
+}
+
+// Close closes the queue.
+func (tq *TypedQueue[T]) Close() error {
+	return tq.q.Close()
+}
+
+// Drop closes and deletes the queue.
+func (tq *TypedQueue[T]) Drop() error {
+	return tq.q.Drop()
+}
+
+// TypedPriorityQueue is a priority queue of values of type T. Values are
+// encoded and decoded using the codec of the underlying priority queue.
+type TypedPriorityQueue[T any] struct {
+	pq *PriorityQueue
+}
+
+// OpenTypedPriorityQueue opens a typed priority queue like
+// OpenPriorityQueueWithOptions. If opts is nil, the default options are
+// used.
+func OpenTypedPriorityQueue[T any](dataDir string, order order, opts *Options) (*TypedPriorityQueue[T], error) {
+	pq, err := OpenPriorityQueueWithOptions(dataDir, order, opts)
+	return NewTypedPriorityQueue[T](pq), err
+}
+
+// NewTypedPriorityQueue returns a typed priority queue wrapping the given
+// priority queue.
+func NewTypedPriorityQueue[T any](pq *PriorityQueue) *TypedPriorityQueue[T] {
+	return &TypedPriorityQueue[T]{pq: pq}
+}
+
+// PriorityQueue returns the underlying priority queue.
+func (tpq *TypedPriorityQueue[T]) PriorityQueue() *PriorityQueue {
+	return tpq.pq
+}
+
+// Enqueue adds a value to the priority queue and returns its ID.
+func (tpq *TypedPriorityQueue[T]) Enqueue(priority uint8, value T) (uint64, error) {
+	item, err := tpq.pq.EnqueueValue(priority, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return item.ID, nil
+}
+
+// Dequeue removes the next value in the priority queue and returns it
+// with its ID. A value that cannot be decoded is kept in the priority
+// queue, and its ID returned with the error.
+func (tpq *TypedPriorityQueue[T]) Dequeue() (T, uint64, error) {
+	return typedCodec[T]{tpq.pq.codec}.removePriorityItem(tpq.pq.dequeueChecked)
+}
+
+// DequeueByPriority removes the next value in the given priority level
+// and returns it with its ID. A value that cannot be decoded is kept in
+// the priority queue, and its ID returned with the error.
+func (tpq *TypedPriorityQueue[T]) DequeueByPriority(priority uint8) (T, uint64, error) {
+	return typedCodec[T]{tpq.pq.codec}.removePriorityItem(func(check func(value []byte) error) (*PriorityItem, error) {
+		return tpq.pq.dequeueByPriorityChecked(priority, check)
+	})
+}
+
+// Peek returns the next value in the priority queue and its ID without
+// removing it.
+func (tpq *TypedPriorityQueue[T]) Peek() (T, uint64, error) {
+	return typedCodec[T]{tpq.pq.codec}.decodePriorityItem(tpq.pq.Peek())
+}
+
+// PeekByPriorityID returns the value with the given ID and priority
+// without removing it.
+func (tpq *TypedPriorityQueue[T]) PeekByPriorityID(priority uint8, id uint64) (T, error) {
+	value, _, err := typedCodec[T]{tpq.pq.codec}.decodePriorityItem(tpq.pq.PeekByPriorityID(priority, id))
+	return value, err
+}
+
+// Update updates the value with the given ID and priority.
+func (tpq *TypedPriorityQueue[T]) Update(priority uint8, id uint64, newValue T) error {
+	_, err := tpq.pq.UpdateValue(priority, id, newValue)
+	return err
+}
+
+// Length returns the total number of values in the priority queue.
+func (tpq *TypedPriorityQueue[T]) Length() uint64 {
+	return tpq.pq.Length()
+}
+
+// Close closes the priority queue.
+func (tpq *TypedPriorityQueue[T]) Close() error {
+	return tpq.pq.Close()
+}
+
+// Drop closes and deletes the priority queue.
+func (tpq *TypedPriorityQueue[T]) Drop() error {
+	return tpq.pq.Drop()
+}
+
+// TypedPrefixQueue is a prefix queue of values of type T. Values are
+// encoded and decoded using the codec of the underlying prefix queue.
+type TypedPrefixQueue[T any] struct {
+	pq *PrefixQueue
+}
+
+// OpenTypedPrefixQueue opens a typed prefix queue like
+// OpenPrefixQueueWithOptions. If opts is nil, the default options are
+// used.
+func OpenTypedPrefixQueue[T any](dataDir string, opts *Options) (*TypedPrefixQueue[T], error) {
+	pq, err := OpenPrefixQueueWithOptions(dataDir, opts)
+	return NewTypedPrefixQueue[T](pq), err
+}
+
+// NewTypedPrefixQueue returns a typed prefix queue wrapping the given
+// prefix queue.
+func NewTypedPrefixQueue[T any](pq *PrefixQueue) *TypedPrefixQueue[T] {
+	return &TypedPrefixQueue[T]{pq: pq}
+}
+
+// PrefixQueue returns the underlying prefix queue.
+func (tpq *TypedPrefixQueue[T]) PrefixQueue() *PrefixQueue {
+	return tpq.pq
+}
+
+// Enqueue adds a value to the queue with the given prefix and returns
+// its ID.
+func (tpq *TypedPrefixQueue[T]) Enqueue(prefix []byte, value T) (uint64, error) {
+	item, err := tpq.pq.EnqueueValue(prefix, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return item.ID, nil
+}
+
+// Dequeue removes the next value in the queue with the given prefix and
+// returns it with its ID. A value that cannot be decoded is kept in the
+// queue, and its ID returned with the error.
+func (tpq *TypedPrefixQueue[T]) Dequeue(prefix []byte) (T, uint64, error) {
+	return typedCodec[T]{tpq.pq.codec}.removeItem(func(check func(value []byte) error) (*Item, error) {
+		return tpq.pq.dequeueChecked(prefix, check)
+	})
+}
+
+// Peek returns the next value in the queue with the given prefix and its
+// ID without removing it.
+func (tpq *TypedPrefixQueue[T]) Peek(prefix []byte) (T, uint64, error) {
+	return typedCodec[T]{tpq.pq.codec}.decodeItem(tpq.pq.Peek(prefix))
+}
+
+// PeekByID returns the value with the given ID in the queue with the
+// given prefix without removing it.
+func (tpq *TypedPrefixQueue[T]) PeekByID(prefix []byte, id uint64) (T, error) {
+	value, _, err := typedCodec[T]{tpq.pq.codec}.decodeItem(tpq.pq.PeekByID(prefix, id))
+	return value, err
+}
+
+// Update updates the value with the given ID in the queue with the given
+// prefix.
+func (tpq *TypedPrefixQueue[T]) Update(prefix []byte, id uint64, newValue T) error {
+	_, err := tpq.pq.UpdateValue(prefix, id, newValue)
+	return err
+}
+
+// Length returns the total number of values in the prefix queue.
+func (tpq *TypedPrefixQueue[T]) Length() uint64 {
+	return tpq.pq.Length()
+}
+
+// Close closes the prefix queue.
+func (tpq *TypedPrefixQueue[T]) Close() error {
+	return tpq.pq.Close()
+}
+
+// Drop closes and deletes the prefix queue.
+func (tpq *TypedPrefixQueue[T]) Drop() error {
+	return tpq.pq.Drop()
+}
+
+// typedCodec decodes the items of a typed data structure into values of
+// type T.
+type typedCodec[T any] struct {
+	codec Codec
+}
+
+// decodeItem decodes the value of the given item, and returns it with the
+// ID of the item.
+func (tc typedCodec[T]) decodeItem(item *Item, err error) (T, uint64, error) {
+	var value T
+	if err != nil {
+		return value, 0, err
+	}
+
+	if err = tc.codec.Decode(item.Value, &value); err != nil {
+		return value, item.ID, err
+	}
+
+	return value, item.ID, nil
+}
+
+// removeItem removes an item using the given function, which only
+// removes it if the given check accepts its value, and returns its value
+// decoded by the check with the ID of the item.
+func (tc typedCodec[T]) removeItem(remove func(check func(value []byte) error) (*Item, error)) (T, uint64, error) {
+	var value T
+	item, err := remove(func(data []byte) error {
+		return tc.codec.Decode(data, &value)
+	})
+	if item == nil {
+		return value, 0, err
+	}
+
+	return value, item.ID, err
+}
+
+// removePriorityItem removes a priority item like removeItem.
+func (tc typedCodec[T]) removePriorityItem(remove func(check func(value []byte) error) (*PriorityItem, error)) (T, uint64, error) {
+	var value T
+	item, err := remove(func(data []byte) error {
+		return tc.codec.Decode(data, &value)
+	})
+	if item == nil {
+		return value, 0, err
+	}
+
+	return value, item.ID, err
+}
+
+// decodePriorityItem decodes the value of the given priority item, and
+// returns it with the ID of the item.
+func (tc typedCodec[T]) decodePriorityItem(item *PriorityItem, err error) (T, uint64, error) {
+	var value T
+	if err != nil {
+		return value, 0, err
+	}
+
+	if err = tc.codec.Decode(item.Value, &value); err != nil {
+		return value, item.ID, err
+	}
+
+	return value, item.ID, nil
+}
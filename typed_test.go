@@ -0,0 +1,184 @@
+package goque
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type typedObject struct {
+	Name  string
+	Value int
+}
+
+func TestTypedQueue(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenTypedQueue[typedObject](file, &Options{Codec: JSONCodec})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = q.Enqueue(typedObject{Name: fmt.Sprintf("item %d", i), Value: i}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = q.Update(2, typedObject{Name: "updated item", Value: 0}); err != nil {
+		t.Error(err)
+	}
+
+	obj, id, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != 1 || obj.Name != "item 1" || obj.Value != 1 {
+		t.Errorf("Expected item 1 to be {item 1 1}, got %d %v", id, obj)
+	}
+
+	obj, id, err = q.Peek()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != 2 || obj.Name != "updated item" {
+		t.Errorf("Expected item 2 to be {updated item 0}, got %d %v", id, obj)
+	}
+
+	if q.Length() != 9 {
+		t.Errorf("Expected queue length of 9, got %d", q.Length())
+	}
+
+	if _, err = q.PeekByID(1); err != ErrOutOfBounds {
+		t.Errorf("Expected to get queue out of bounds error, got %v", err)
+	}
+}
+
+func TestTypedQueueDecodeError(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	if _, err = q.EnqueueValue("value for item 1"); err != nil {
+		t.Error(err)
+	}
+
+	tq := NewTypedQueue[typedObject](q)
+
+	// A value of the wrong type fails when it is decoded, and is kept in
+	// the queue.
+	if _, id, err := tq.Dequeue(); err == nil || id != 1 {
+		t.Errorf("Expected to get decode error for item 1, got %d %v", id, err)
+	}
+
+	if tq.Length() != 1 {
+		t.Errorf("Expected queue length of 1, got %d", tq.Length())
+	}
+
+	deqItem, err := q.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var value string
+	if err = q.codec.Decode(deqItem.Value, &value); err != nil || value != "value for item 1" {
+		t.Errorf("Expected item 1 to be kept, got '%s' and %v", value, err)
+	}
+
+	if _, id, err := tq.Dequeue(); err != ErrEmpty || id != 0 {
+		t.Errorf("Expected to get empty error, got %d %v", id, err)
+	}
+}
+
+func TestTypedStack(t *testing.T) {
+	s, err := OpenTypedStack[int](fmt.Sprintf("test_db_%d", time.Now().UnixNano()), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer s.Drop()
+
+	for i := 1; i <= 10; i++ {
+		if _, err = s.Push(i); err != nil {
+			t.Error(err)
+		}
+	}
+
+	value, id, err := s.Pop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != 10 || value != 10 {
+		t.Errorf("Expected item 10 to be 10, got %d %d", id, value)
+	}
+
+	if s.Length() != 9 {
+		t.Errorf("Expected stack length of 9, got %d", s.Length())
+	}
+}
+
+func TestTypedPriorityQueue(t *testing.T) {
+	pq, err := OpenTypedPriorityQueue[string](fmt.Sprintf("test_db_%d", time.Now().UnixNano()), DESC, &Options{Codec: RawCodec})
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	for p := 0; p <= 4; p++ {
+		if _, err = pq.Enqueue(uint8(p), fmt.Sprintf("value for priority %d", p)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	value, _, err := pq.Dequeue()
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr := "value for priority 4"
+
+	if value != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, value)
+	}
+
+	value, _, err = pq.DequeueByPriority(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	compStr = "value for priority 1"
+
+	if value != compStr {
+		t.Errorf("Expected string to be '%s', got '%s'", compStr, value)
+	}
+}
+
+func TestTypedPrefixQueue(t *testing.T) {
+	pq, err := OpenTypedPrefixQueue[[]string](fmt.Sprintf("test_db_%d", time.Now().UnixNano()), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer pq.Drop()
+
+	if _, err = pq.Enqueue([]byte("prefix"), []string{"a", "b"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err = pq.Dequeue([]byte("other")); err != ErrEmpty {
+		t.Errorf("Expected to get empty error, got %v", err)
+	}
+
+	value, id, err := pq.Dequeue([]byte("prefix"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != 1 || len(value) != 2 || value[1] != "b" {
+		t.Errorf("Expected item 1 to be [a b], got %d %v", id, value)
+	}
+}
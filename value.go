@@ -0,0 +1,54 @@
+package goque
+
+import (
+	"bytes"
+)
+
+// valueMagic starts every stored value that has a header recording its
+// format, which follows the magic as a single byte.
+var valueMagic = []byte{0xff, 'g', 'q', 'v'}
+
+// The value formats recorded in a value header.
+const (
+	valueRaw       byte = iota // Stored as is, as it starts with valueMagic.
+	valueFlate                 // Compressed using compress/flate.
+	valueGzip                  // Compressed using compress/gzip.
+	valueEncrypted             // Encrypted using AES-GCM.
+	valueChecksum              // Preceded by its CRC-32C checksum.
+	valueBlob                  // A reference to the blob file holding it.
+)
+
+// valueHeader returns a new value header for the given format.
+func valueHeader(format byte) []byte {
+	return append(append(make([]byte, 0, len(valueMagic)+1), valueMagic...), format)
+}
+
+// escapeValue returns the given value with a valueRaw header if it starts
+// with valueMagic, so it is not mistaken for a value with a header.
+func escapeValue(value []byte) []byte {
+	if !bytes.HasPrefix(value, valueMagic) {
+		return value
+	}
+
+	return append(valueHeader(valueRaw), value...)
+}
+
+// unescapeValue returns the value stored as the given data, removing the
+// valueRaw header added by escapeValue.
+func unescapeValue(data []byte) []byte {
+	if format, ok := valueFormat(data); !ok || format != valueRaw {
+		return data
+	}
+
+	return data[len(valueMagic)+1:]
+}
+
+// valueFormat returns the format recorded in the header of the given
+// stored value, and false if it has no header.
+func valueFormat(data []byte) (byte, bool) {
+	if len(data) <= len(valueMagic) || !bytes.HasPrefix(data, valueMagic) {
+		return 0, false
+	}
+
+	return data[len(valueMagic)], true
+}